@@ -9,7 +9,10 @@ import (
 	"log"
 	"math/rand"
 	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"github.com/yyancy/go-queue/protocol"
@@ -22,15 +25,66 @@ type Client struct {
 	c        *fasthttp.Client
 	off      uint
 	curChunk protocol.Chunk
+	// seek is the position set by SeekToMessage or SeekToTime
+	// that is resolved by the server on the next read.
+	seek url.Values
+	// acked contains the chunks that were read completely. They are only
+	// deleted by the retention policy in the log categories, so they must
+	// not be read again.
+	acked map[string]bool
+	// group is the consumer group set by SetGroup, its offsets
+	// are committed on the server instead of acking the chunks.
+	group string
+	// consumer identifies the client in the group, the chunks are leased
+	// to one consumer at a time. leased is when the lease of curChunk was
+	// last renewed, leaseTTL is how long it is held without renewals.
+	consumer string
+	leased   time.Time
+	leaseTTL time.Duration
+	// failedAddr is the instance that counts the failures of the message
+	// at off, the reads stay there until the message is processed or moved
+	// to the dead-letter category.
+	failedAddr string
 }
 
+// errLeased means that the chunk is leased to another consumer of the group.
+var errLeased = errors.New("the chunk is leased to another consumer")
+
 func NewClient(addrs []string) (*Client, error) {
 	return &Client{
 		addrs: addrs,
-		c: &fasthttp.Client{},
+		c:     &fasthttp.Client{},
+		acked: make(map[string]bool),
 	}, nil
 }
 
+// SetGroup makes Process read as a member of the named consumer group.
+// The offsets are committed on the server after every processed batch,
+// so the next client of the group continues from where this one stopped,
+// and the chunks are deleted only once every group has read them.
+// Every chunk is leased to one member of the group at a time, so the
+// members share the chunks of the category between them. The lease is
+// renewed on every Process call and passes to another member if it is
+// not renewed for the TTL returned by the server, so processFn should
+// return well within it.
+func (c *Client) SetGroup(group string) {
+	c.group = group
+	c.consumer = defaultConsumerName()
+	c.leased = time.Time{}
+	c.curChunk = protocol.Chunk{}
+	c.off = 0
+	c.acked = make(map[string]bool)
+	c.failedAddr = ""
+}
+
+func defaultConsumerName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), rand.Int63())
+}
+
 // ListChunks return the list of chunks for the appropriate
 // TODO extract
 func (c *Client) ListChunks(category, addr string) ([]protocol.Chunk, error) {
@@ -45,7 +99,7 @@ func (c *Client) ListChunks(category, addr string) ([]protocol.Chunk, error) {
 	// log.Printf("received chunks %v", string(resp.Body()))
 	if err != nil {
 		fasthttp.ReleaseResponse(resp)
-		log.Fatalf("ERR Connection error: %s\n", err)
+		return nil, fmt.Errorf("listing chunks at %q: %v", addr, err)
 	}
 	var res []protocol.Chunk
 	body := resp.Body()
@@ -59,7 +113,61 @@ func (c *Client) ListChunks(category, addr string) ([]protocol.Chunk, error) {
 	return res, nil
 }
 
-func (c *Client) Send(category string, msg []byte) error {
+// SendOption changes how the messages are written.
+type SendOption func(req *fasthttp.Request)
+
+// DeliverAfter makes the server hold the messages for d before they become
+// visible to the consumers. The delay is counted from when the server
+// receives them.
+func DeliverAfter(d time.Duration) SendOption {
+	return func(req *fasthttp.Request) {
+		req.Header.Set(protocol.DeliverAfterHeader, d.String())
+	}
+}
+
+// DeliverAt makes the server hold the messages until t.
+func DeliverAt(t time.Time) SendOption {
+	return func(req *fasthttp.Request) {
+		req.Header.Set(protocol.DeliverAtHeader, t.Format(time.RFC3339Nano))
+	}
+}
+
+// WaitForReplicas makes the server acknowledge the write once n replicas
+// store it besides the instance that received it. The write fails if fewer
+// replicas are in sync or they do not confirm it in time.
+func WaitForReplicas(n int) SendOption {
+	return func(req *fasthttp.Request) {
+		req.Header.Set(protocol.AcksHeader, strconv.Itoa(n))
+	}
+}
+
+// WaitForAllReplicas makes the server acknowledge the write once all
+// in-sync replicas, at least one, store it.
+func WaitForAllReplicas() SendOption {
+	return func(req *fasthttp.Request) {
+		req.Header.Set(protocol.AcksHeader, "all")
+	}
+}
+
+// Send writes msg as-is: newline-separated messages for the newline
+// categories or records encoded with protocol.AppendRecord for the framed ones.
+func (c *Client) Send(category string, msg []byte, opts ...SendOption) error {
+	return c.send(category, msg, "", opts)
+}
+
+// SendMessages writes the messages with their keys and headers.
+// The category must use the framed format.
+func (c *Client) SendMessages(category string, msgs []protocol.Message, opts ...SendOption) error {
+	var buf []byte
+	for _, m := range msgs {
+		buf = protocol.AppendMessage(buf, m)
+	}
+	return c.send(category, buf, protocol.FormatFramed.String(), opts)
+}
+
+// send writes msg to the category. If format is set the server
+// rejects the write unless the category uses that format.
+func (c *Client) send(category string, msg []byte, format string, opts []SendOption) error {
 	if len(msg) == 0 {
 		return errors.New("no content to send")
 	}
@@ -72,6 +180,12 @@ func (c *Client) Send(category string, msg []byte) error {
 	defer fasthttp.ReleaseRequest(req)
 	req.SetRequestURI(fmt.Sprintf("%s/write?%s", readURL, u.Encode()))
 	req.Header.SetMethod(fasthttp.MethodPost)
+	if format != "" {
+		req.Header.Set(protocol.FormatHeader, format)
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
 	req.SetBody(msg)
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
@@ -100,19 +214,200 @@ func (c *Client) updateCurrentChunk(category, addr string) error {
 	if err != nil {
 		return fmt.Errorf("listChunks failed: %v", err)
 	}
+	var offsets protocol.GroupOffsets
+	if c.group != "" {
+		offsets, err = c.fetchOffsets(category, addr)
+		if err != nil {
+			return err
+		}
+		for name, off := range offsets {
+			if off.Done {
+				c.acked[name] = true
+			}
+		}
+	}
+	// the output of the compaction only contains the messages of the
+	// chunks it replaced, so it does not need to be read if they were
+	for _, ch := range chunks {
+		if len(ch.Replaces) == 0 {
+			continue
+		}
+		read := true
+		for _, name := range ch.Replaces {
+			read = read && c.acked[name]
+		}
+		if read {
+			c.acked[ch.Name] = true
+		}
+	}
+
+	// forget the chunks that were deleted by the retention policy
+	// or replaced by the compaction
+	listed := make(map[string]bool, len(chunks))
+	for _, ch := range chunks {
+		listed[ch.Name] = true
+	}
+	for name := range c.acked {
+		if !listed[name] {
+			delete(c.acked, name)
+		}
+	}
+
+	var unread []protocol.Chunk
+	for _, ch := range chunks {
+		if !c.acked[ch.Name] {
+			unread = append(unread, ch)
+		}
+	}
+
 	// there is no chunk
-	if len(chunks) == 0 {
+	if len(unread) == 0 {
 		return io.EOF
 	}
 	// We need to prioritise the chunks that are complete
 	// so that we ack them.
-	for _, ch := range chunks {
-		if ch.Complete {
-			c.curChunk = ch
-			return nil
+	sort.SliceStable(unread, func(i, j int) bool {
+		return unread[i].Complete && !unread[j].Complete
+	})
+	for _, ch := range unread {
+		if c.group != "" {
+			err := c.leaseChunk(category, addr, ch.Name)
+			if errors.Is(err, errLeased) {
+				// another consumer of the group reads it
+				continue
+			} else if err != nil {
+				return err
+			}
 		}
+		c.curChunk = ch
+		c.off = uint(offsets[ch.Name].Off)
+		return nil
+	}
+	// all chunks are read by the other consumers
+	return io.EOF
+}
+
+// leaseChunk leases the chunk to the consumer or renews the lease.
+func (c *Client) leaseChunk(category, addr, chunk string) error {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("group", c.group)
+	u.Add("chunk", chunk)
+	u.Add("consumer", c.consumer)
+	leaseURL := addr + "/lease?" + u.Encode()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(leaseURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return fmt.Errorf("lease %q: %v", leaseURL, err)
+	}
+	if resp.StatusCode() == fasthttp.StatusConflict {
+		return errLeased
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	var lease protocol.Lease
+	if err := json.Unmarshal(resp.Body(), &lease); err != nil {
+		return fmt.Errorf("parsing lease %q: %v", leaseURL, err)
+	}
+	c.leased = time.Now()
+	c.leaseTTL = time.Duration(lease.TTL) * time.Second
+	return nil
+}
+
+// Release releases the lease of the chunk the consumer group member reads,
+// e.g. before the client stops, so that another member continues at once.
+func (c *Client) Release(category string) error {
+	if c.group == "" || c.curChunk.Name == "" {
+		return nil
+	}
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("group", c.group)
+	u.Add("chunk", c.curChunk.Name)
+	u.Add("consumer", c.consumer)
+	releaseURL := c.addrs[rand.Intn(len(c.addrs))] + "/release?" + u.Encode()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(releaseURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return fmt.Errorf("release %q: %v", releaseURL, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+	c.curChunk = protocol.Chunk{}
+	c.off = 0
+	c.leased = time.Time{}
+	return nil
+}
+
+// fetchOffsets returns the offsets committed by the consumer group.
+func (c *Client) fetchOffsets(category, addr string) (protocol.GroupOffsets, error) {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("group", c.group)
+	fetchURL := addr + "/fetch?" + u.Encode()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(fetchURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return nil, fmt.Errorf("fetch %q: %v", fetchURL, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	var res protocol.GroupOffsets
+	if err := json.Unmarshal(resp.Body(), &res); err != nil {
+		return nil, fmt.Errorf("parsing offsets %q: %v", fetchURL, err)
+	}
+	return res, nil
+}
+
+// commitOffset commits the current offset of the consumer group,
+// done means that the complete chunk was read.
+func (c *Client) commitOffset(category, addr string, done bool) error {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("group", c.group)
+	u.Add("chunk", c.curChunk.Name)
+	u.Add("off", strconv.Itoa(int(c.off)))
+	u.Add("consumer", c.consumer)
+	if done {
+		u.Add("done", "1")
+	}
+	commitURL := addr + "/commit?" + u.Encode()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(commitURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return fmt.Errorf("commit %q: %v", commitURL, err)
+	}
+	if resp.StatusCode() == fasthttp.StatusConflict {
+		return fmt.Errorf("commit %q: %w", c.curChunk.Name, errLeased)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
 	}
-	c.curChunk = chunks[0]
 	return nil
 }
 
@@ -134,19 +429,188 @@ func (c *Client) updateCurrentChunkCompleteStatus(category, addr string) error {
 	return nil
 }
 
+// Process reads the next batch of at most len(buf) bytes of messages
+// and calls processFn with it. processFn can keep the batch.
 func (c *Client) Process(category string, buf []byte, processFn func([]byte) error) error {
+	return c.process(category, buf, func(_ protocol.Format, b []byte) error {
+		return processFn(b)
+	})
+}
+
+// ProcessMessages is like Process but decodes the batch into messages with
+// their keys and headers. The messages of the newline categories only have
+// the value, without the newline.
+func (c *Client) ProcessMessages(category string, buf []byte, processFn func([]protocol.Message) error) error {
+	return c.process(category, buf, func(format protocol.Format, b []byte) error {
+		msgs, err := decodeBatch(format, b)
+		if err != nil {
+			return err
+		}
+		return processFn(msgs)
+	})
+}
+
+// decodeBatch splits the batch returned by /read into messages.
+func decodeBatch(format protocol.Format, b []byte) ([]protocol.Message, error) {
+	if format == protocol.FormatFramed {
+		return protocol.DecodeMessages(b)
+	}
+
+	var msgs []protocol.Message
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			b = nil
+		}
+		msgs = append(msgs, protocol.Message{Value: line})
+	}
+	return msgs, nil
+}
+
+// ReadTimeRange calls processFn with the messages of the category that were
+// written between from and to, inclusive, chunk by chunk. It does not change
+// the position of Process. The messages of the newline categories have no
+// time, so a few messages written around the time range are returned too.
+// The messages reference buf.
+func (c *Client) ReadTimeRange(category string, from, to time.Time, buf []byte, processFn func([]protocol.Message) error) error {
+	if buf == nil {
+		buf = make([]byte, defaultBufferSize)
+	}
+	addr := c.addrs[rand.Intn(len(c.addrs))]
+
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("from", from.Format(time.RFC3339Nano))
+	u.Add("to", to.Format(time.RFC3339Nano))
+	ranges, err := c.timeRange(addr + "/timeRange?" + u.Encode())
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		for off := r.Off; r.End == 0 || off < r.End; {
+			format, b, err := c.read(addr, category, r.Chunk, off, buf)
+			if err != nil {
+				return err
+			}
+			if len(b) == 0 {
+				break
+			}
+			off += uint64(len(b))
+			if r.End != 0 && off > r.End {
+				b = b[:uint64(len(b))-(off-r.End)]
+			}
+
+			msgs, err := decodeBatch(format, b)
+			if err != nil {
+				return fmt.Errorf("reading %q: %w", r.Chunk, err)
+			}
+			inRange := msgs[:0]
+			for _, m := range msgs {
+				if m.Time.IsZero() || (!m.Time.Before(from) && !m.Time.After(to)) {
+					inRange = append(inRange, m)
+				}
+			}
+			if len(inRange) == 0 {
+				continue
+			}
+			if err := processFn(inRange); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) timeRange(rangeURL string) ([]protocol.ChunkRange, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(rangeURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return nil, fmt.Errorf("time range %q: %v", rangeURL, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	var res []protocol.ChunkRange
+	if err := json.Unmarshal(resp.Body(), &res); err != nil {
+		return nil, fmt.Errorf("parsing time range %q: %v", rangeURL, err)
+	}
+	return res, nil
+}
+
+// read reads the batch of at most len(buf) bytes from the chunk at off into buf.
+func (c *Client) read(addr, category, chunk string, off uint64, buf []byte) (protocol.Format, []byte, error) {
+	u := url.Values{}
+	u.Add("off", strconv.FormatUint(off, 10))
+	u.Add("maxSize", strconv.Itoa(len(buf)))
+	u.Add("chunk", chunk)
+	u.Add("category", category)
+	readURL := fmt.Sprintf("%s/read?%s", addr, u.Encode())
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(readURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return 0, nil, fmt.Errorf("read %q: %v", readURL, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return 0, nil, fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	b := append(buf[:0], resp.Body()...)
+	format, err := validateBatch(resp, b)
+	if err != nil {
+		return 0, nil, fmt.Errorf("read %q: %w", readURL, err)
+	}
+	return format, b, nil
+}
+
+func (c *Client) process(category string, buf []byte, processFn func(protocol.Format, []byte) error) error {
 	if buf == nil {
 		buf = make([]byte, defaultBufferSize)
 	}
 	req := fasthttp.AcquireRequest()
 	addrIdx := rand.Intn(len(c.addrs))
 	readURL := c.addrs[addrIdx]
+	if c.failedAddr != "" {
+		// another instance would count the failures from scratch
+		readURL = c.failedAddr
+	}
 
 	if err := c.updateCurrentChunk(category, readURL); err != nil {
 		return fmt.Errorf("updateCurrentChunk %w", err)
 	}
+	if c.group != "" && time.Since(c.leased) > c.leaseTTL/3 {
+		// the heartbeat, it also leases the chunk set by the seek
+		err := c.leaseChunk(category, readURL, c.curChunk.Name)
+		if errors.Is(err, errLeased) {
+			// the lease has expired and another consumer reads the chunk now
+			c.curChunk = protocol.Chunk{}
+			c.off = 0
+			c.failedAddr = ""
+			return c.process(category, buf, processFn)
+		} else if err != nil {
+			return err
+		}
+	}
 	u := url.Values{}
-	u.Add("off", strconv.Itoa(int(c.off)))
+	if c.seek != nil {
+		for k, v := range c.seek {
+			u[k] = v
+		}
+	} else {
+		u.Add("off", strconv.Itoa(int(c.off)))
+	}
 	u.Add("maxSize", strconv.Itoa(len(buf)))
 	u.Add("chunk", c.curChunk.Name)
 	u.Add("category", category)
@@ -157,19 +621,42 @@ func (c *Client) Process(category string, buf []byte, processFn func([]byte) err
 	defer fasthttp.ReleaseResponse(resp)
 	err := c.c.Do(req, resp)
 	if err != nil {
+		// the failures are counted from scratch by another instance
+		c.failedAddr = ""
 		return fmt.Errorf("read %q: %v", readURL, err)
 	}
 	fasthttp.ReleaseRequest(req)
 
+	if resp.StatusCode() == fasthttp.StatusNotFound && c.seek == nil {
+		// the chunk was deleted, e.g. replaced by the compaction,
+		// continue with the chunks that are there now
+		c.curChunk = protocol.Chunk{}
+		c.off = 0
+		c.failedAddr = ""
+		return c.process(category, buf, processFn)
+	}
 	if resp.StatusCode() != fasthttp.StatusOK {
 		var b bytes.Buffer
 		r := bytes.NewReader(resp.Body())
 		io.Copy(&b, r)
 		return fmt.Errorf("http code %d, %s", resp.StatusCode(), b.String())
 	}
+	if c.seek != nil {
+		off, err := strconv.ParseUint(string(resp.Header.Peek(protocol.OffsetHeader)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("parsing the offset of %q: %v", addr, err)
+		}
+		c.off = uint(off)
+		c.seek = nil
+	}
+	// processFn can keep the batch, so it is not read into buf
 	body := resp.Body()
 	b := make([]byte, len(body))
 	copy(b, body)
+	format, err := validateBatch(resp, b)
+	if err != nil {
+		return fmt.Errorf("read %q: %w", addr, err)
+	}
 	if len(b) == 0 {
 		if !c.curChunk.Complete {
 			if err := c.updateCurrentChunkCompleteStatus(category, readURL); err != nil {
@@ -179,19 +666,150 @@ func (c *Client) Process(category string, buf []byte, processFn func([]byte) err
 		if !c.curChunk.Complete {
 			return io.EOF
 		}
-		if err := c.ackCurrentChunk(category, readURL); err != nil {
+		if c.group != "" {
+			if err := c.commitOffset(category, readURL, true); err != nil {
+				return fmt.Errorf("commit current chunk: %w", err)
+			}
+		} else if err := c.ackCurrentChunk(category, readURL); err != nil {
 			return fmt.Errorf("ack current chunk %w:", err)
 		}
+		c.acked[c.curChunk.Name] = true
 		c.curChunk = protocol.Chunk{}
 		c.off = 0
-		return c.Process(category, buf, processFn)
+		return c.process(category, buf, processFn)
 
 	}
-	if err := processFn(b); err == nil {
-		c.off += uint(len(b))
+	maxDeliveries, _ := strconv.Atoi(string(resp.Header.Peek(protocol.MaxDeliveriesHeader)))
+	n, err := c.processBatch(category, readURL, format, b, maxDeliveries, processFn)
+	if n == 0 {
+		// the batch is read again by the next call
+		return err
+	}
+	c.off += uint(n)
+	if c.group != "" {
+		err := c.commitOffset(category, readURL, false)
+		if errors.Is(err, errLeased) {
+			// the batch is processed again by the consumer that holds the lease
+			c.curChunk = protocol.Chunk{}
+			c.off = 0
+			c.failedAddr = ""
+			c.leased = time.Time{}
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return err
+}
+
+// processBatch calls processFn with the batch b read at the current offset.
+// If it fails and the category limits the deliveries, the messages of b are
+// processed one by one, so the messages before the failed one are processed
+// again, and every failure is reported to the instance at addr. It moves the
+// message to the dead-letter category once it failed too many times.
+// processBatch returns how many bytes of b were processed or moved.
+func (c *Client) processBatch(category, addr string, format protocol.Format, b []byte, maxDeliveries int, processFn func(protocol.Format, []byte) error) (int, error) {
+	err := processFn(format, b)
+	if err == nil {
+		c.failedAddr = ""
+		return len(b), nil
+	}
+	if maxDeliveries == 0 {
+		return 0, nil
+	}
+
+	sizes, serr := messageSizes(format, b)
+	if serr != nil {
+		return 0, serr
+	}
+	done := 0
+	for _, sz := range sizes {
+		if len(sizes) > 1 {
+			err = processFn(format, b[done:done+sz])
+		}
+		if err != nil {
+			moved, ferr := c.failMessage(category, addr, c.off+uint(done), err)
+			if ferr != nil {
+				return done, ferr
+			}
+			if !moved {
+				c.failedAddr = addr
+				return done, nil
+			}
+		}
+		done += sz
+	}
+	c.failedAddr = ""
+	return done, nil
+}
+
+// messageSizes returns the sizes of the messages of the batch.
+func messageSizes(format protocol.Format, b []byte) ([]int, error) {
+	var res []int
+	for len(b) > 0 {
+		sz := len(b)
+		if format == protocol.FormatFramed {
+			_, n, err := protocol.ReadRecord(b)
+			if err != nil {
+				return nil, err
+			}
+			sz = n
+		} else if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			sz = i + 1
+		}
+		res = append(res, sz)
+		b = b[sz:]
+	}
+	return res, nil
+}
+
+// failMessage reports that processFn failed on the message of the current
+// chunk at off. It reports whether the message was moved to the dead-letter
+// category because it failed too many times.
+func (c *Client) failMessage(category, addr string, off uint, cause error) (bool, error) {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("chunk", c.curChunk.Name)
+	u.Add("off", strconv.Itoa(int(off)))
+	u.Add("group", c.group)
+	u.Add("error", cause.Error())
+	b, err := c.get(addr + "/failMessage?" + u.Encode())
+	if err != nil {
+		return false, fmt.Errorf("reporting the failed message: %w", err)
+	}
+	var res protocol.FailedMessage
+	if err := json.Unmarshal(b, &res); err != nil {
+		return false, fmt.Errorf("parsing the response of /failMessage: %v", err)
+	}
+	return res.Moved, nil
+}
+
+// SeekToMessage makes the next Process call start from the message number
+// seq (starting from 0) of the chunk.
+func (c *Client) SeekToMessage(chunk string, seq uint64) {
+	c.curChunk = protocol.Chunk{Name: chunk}
+	c.seek = url.Values{"msg": {strconv.FormatUint(seq, 10)}}
+}
+
+// SeekToTime makes the next Process call start from the first message
+// of the chunk that was written at or after t.
+func (c *Client) SeekToTime(chunk string, t time.Time) {
+	c.curChunk = protocol.Chunk{Name: chunk}
+	c.seek = url.Values{"time": {t.Format(time.RFC3339Nano)}}
+}
+
+// validateBatch checks that the batch returned by /read consists of
+// complete messages in the format announced by the server.
+func validateBatch(resp *fasthttp.Response, b []byte) (protocol.Format, error) {
+	format, err := protocol.ParseFormat(string(resp.Header.Peek(protocol.FormatHeader)))
+	if err != nil {
+		return format, err
+	}
+	if format != protocol.FormatFramed {
+		return format, nil
+	}
+	return format, protocol.ValidateRecords(b)
 }
 
 func (c *Client) ackCurrentChunk(category, addr string) error {
@@ -230,3 +848,113 @@ func cutLast(buf []byte) (msg []byte, rest []byte, err error) {
 	}
 	return buf[:lastI+1], buf[lastI+1:], nil
 }
+
+// Delivery is a message received from a messages category. It must be
+// acknowledged with AckMessage or returned with NackMessage.
+type Delivery struct {
+	protocol.ReceivedMessage
+	// addr is the instance that delivered the message and tracks it.
+	addr string
+}
+
+// Receive receives at most max messages of the messages category that are
+// not delivered to the other consumers for the visibility timeout. Every
+// instance delivers the messages of its own chunks, so the instances are
+// tried in random order until one of them has messages. io.EOF means that
+// there are none.
+func (c *Client) Receive(category string, max int, visibility time.Duration) ([]Delivery, error) {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("max", strconv.Itoa(max))
+	u.Add("visibility", visibility.String())
+
+	for _, i := range rand.Perm(len(c.addrs)) {
+		addr := c.addrs[i]
+		receiveURL := addr + "/receive?" + u.Encode()
+		body, err := c.get(receiveURL)
+		if err != nil {
+			return nil, err
+		}
+
+		var msgs []protocol.ReceivedMessage
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			return nil, fmt.Errorf("parsing messages %q: %v", receiveURL, err)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		res := make([]Delivery, 0, len(msgs))
+		for _, m := range msgs {
+			res = append(res, Delivery{ReceivedMessage: m, addr: addr})
+		}
+		return res, nil
+	}
+	return nil, io.EOF
+}
+
+// AckMessage acknowledges the delivered message so that it is not delivered again.
+func (c *Client) AckMessage(category string, d Delivery) error {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("chunk", d.Chunk)
+	u.Add("off", strconv.FormatUint(d.Off, 10))
+	_, err := c.get(d.addr + "/ackMessage?" + u.Encode())
+	return err
+}
+
+// NackMessage returns the delivered message so that it is delivered again
+// after delay instead of after the visibility timeout. cause is the reason
+// of the failure, it is recorded if the message is moved to the dead-letter
+// category after too many failures.
+func (c *Client) NackMessage(category string, d Delivery, delay time.Duration, cause error) error {
+	u := url.Values{}
+	u.Add("category", category)
+	u.Add("chunk", d.Chunk)
+	u.Add("off", strconv.FormatUint(d.Off, 10))
+	u.Add("delay", delay.String())
+	if cause != nil {
+		u.Add("error", cause.Error())
+	}
+	_, err := c.get(d.addr + "/nackMessage?" + u.Encode())
+	return err
+}
+
+// ProcessEach receives at most max messages of the messages category and
+// calls processFn for each of them. The message is acknowledged if processFn
+// succeeds and returned to be delivered again at once otherwise, so that one
+// failing message neither blocks the others nor is skipped.
+func (c *Client) ProcessEach(category string, max int, visibility time.Duration, processFn func(protocol.Message) error) error {
+	msgs, err := c.Receive(category, max, visibility)
+	if err != nil {
+		return err
+	}
+	for _, d := range msgs {
+		if err := processFn(d.Message); err != nil {
+			if err := c.NackMessage(category, d, 0, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.AckMessage(category, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get does the GET request and returns the body of the successful response.
+func (c *Client) get(reqURL string) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(reqURL)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	if err := c.c.Do(req, resp); err != nil {
+		return nil, fmt.Errorf("get %q: %v", reqURL, err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("http code %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+	return append([]byte(nil), resp.Body()...), nil
+}
@@ -2,7 +2,17 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/yyancy/go-queue/protocol"
 )
 
 func TestCutLast(t *testing.T) {
@@ -26,3 +36,72 @@ func TestCutLastErrors(t *testing.T) {
 		t.Errorf("TestCutLastErrors(%q): want error; but no error", string(buf))
 	}
 }
+
+func TestProcessPinsFailedMessage(t *testing.T) {
+	const contents = "one\nbad\nthree\n"
+	const maxDeliveries = 5
+
+	var mu sync.Mutex
+	failures := make(map[string]int)
+	newServer := func() *httptest.Server {
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			switch r.URL.Path {
+			case "/listChunks":
+				json.NewEncoder(w).Encode([]protocol.Chunk{{Name: "numbers-chunk0", Complete: true, Size: uint64(len(contents))}})
+			case "/read":
+				off, _ := strconv.Atoi(q.Get("off"))
+				w.Header().Set(protocol.FormatHeader, protocol.FormatNewline.String())
+				w.Header().Set(protocol.MaxDeliveriesHeader, strconv.Itoa(maxDeliveries))
+				io.WriteString(w, contents[off:])
+			case "/failMessage":
+				mu.Lock()
+				failures[srv.URL]++
+				attempts := failures[srv.URL]
+				mu.Unlock()
+				json.NewEncoder(w).Encode(protocol.FailedMessage{Attempts: attempts, Moved: attempts >= maxDeliveries})
+			case "/ack":
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		return srv
+	}
+	srv1, srv2 := newServer(), newServer()
+	defer srv1.Close()
+	defer srv2.Close()
+
+	c, _ := NewClient([]string{srv1.URL, srv2.URL})
+	var processed []string
+	processFn := func(b []byte) error {
+		if bytes.Contains(b, []byte("bad")) {
+			return errors.New("bad message")
+		}
+		processed = append(processed, string(b))
+		return nil
+	}
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = c.Process("numbers", nil, processFn)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Process() = %v; want io.EOF once the chunk is acked", err)
+	}
+
+	if want := "one\nthree\n"; strings.Join(processed, "") != want {
+		t.Errorf("processed %q, want %q", processed, want)
+	}
+	if len(failures) != 1 {
+		t.Errorf("failures = %v, want all of them reported to one instance", failures)
+	}
+	for addr, n := range failures {
+		if n != maxDeliveries {
+			t.Errorf("%s counted %d failures, want %d before the message is moved", addr, n, maxDeliveries)
+		}
+	}
+	if c.failedAddr != "" {
+		t.Errorf("failedAddr = %q after the message was moved, want none", c.failedAddr)
+	}
+}
@@ -0,0 +1,299 @@
+// Package config describes the per-category settings. Every instance of
+// the cluster must be started with the same configuration.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// Category contains the settings of a single category.
+type Category struct {
+	// Format is the on-disk format of the messages in the category.
+	Format protocol.Format `json:"format"`
+
+	// Durability defines when the written data is flushed to disk.
+	Durability Durability `json:"durability"`
+	// SyncInterval is the maximum time between two fsyncs
+	// for the DurabilityInterval policy.
+	SyncInterval Duration `json:"sync_interval"`
+	// SyncBytes triggers an fsync before SyncInterval passes once that
+	// many bytes were written, 0 means no threshold.
+	SyncBytes uint64 `json:"sync_bytes"`
+
+	// MaxChunkAge seals the active chunk once it is that old even if it
+	// did not reach the maximum size, zero means no limit.
+	MaxChunkAge Duration `json:"max_chunk_age"`
+
+	// Mode defines how the chunks are consumed.
+	Mode Mode `json:"mode"`
+	// The retention limits are enforced against the sealed chunks
+	// of the category, zero means no limit. RetentionBytes is the disk
+	// space of the chunks, the compressed ones count with their
+	// compressed size.
+	RetentionAge    Duration `json:"retention_age"`
+	RetentionBytes  uint64   `json:"retention_bytes"`
+	RetentionChunks int      `json:"retention_chunks"`
+
+	// TombstoneRetention is how long the compaction keeps the tombstones
+	// so that the consumers can see the deletions, 24h by default.
+	TombstoneRetention Duration `json:"tombstone_retention"`
+
+	// Compression is the codec used to compress the sealed chunks
+	// in the background, empty means no compression.
+	Compression Compression `json:"compression"`
+
+	// MaxDeliveries is how many times a message can fail before it is moved
+	// to the DeadLetter category, zero means that it is retried forever.
+	MaxDeliveries int `json:"max_deliveries"`
+	// DeadLetter is the category that receives the failed messages,
+	// it must use the framed format. It is set with MaxDeliveries.
+	DeadLetter string `json:"dead_letter"`
+
+	// Acks is how many replicas must store a write before /write
+	// returns, AcksLeader by default.
+	Acks Acks `json:"acks"`
+
+	// ReplicationFactor is how many instances store every chunk including
+	// the one that wrote it, zero means all instances.
+	ReplicationFactor int `json:"replication_factor"`
+}
+
+// Acks is the number of replicas that must confirm a write
+// before it is acknowledged.
+type Acks int
+
+const (
+	// AcksLeader acknowledges the write once it is stored
+	// by the instance that received it.
+	AcksLeader Acks = 0
+	// AcksAll waits for all in-sync replicas, at least one.
+	AcksAll Acks = -1
+)
+
+// ParseAcks parses "leader", "all" or the number of replicas, e.g. "2".
+func ParseAcks(s string) (Acks, error) {
+	switch s {
+	case "", "leader":
+		return AcksLeader, nil
+	case "all":
+		return AcksAll, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("unknown acks %q, want leader, all or the number of replicas", s)
+	}
+	return Acks(n), nil
+}
+
+func (a Acks) String() string {
+	switch a {
+	case AcksLeader:
+		return "leader"
+	case AcksAll:
+		return "all"
+	}
+	return strconv.Itoa(int(a))
+}
+
+func (a Acks) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Acks) UnmarshalText(b []byte) error {
+	v, err := ParseAcks(string(b))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Compression is the codec for the sealed chunks.
+type Compression string
+
+const (
+	CompressionNone   Compression = ""
+	CompressionGzip   Compression = "gzip"
+	CompressionBrotli Compression = "brotli"
+)
+
+func (c *Compression) UnmarshalText(b []byte) error {
+	switch v := Compression(b); v {
+	case CompressionNone, CompressionGzip, CompressionBrotli:
+		*c = v
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", string(b))
+}
+
+// Validate checks that the settings can be used together.
+func (c Category) Validate() error {
+	if (c.Mode == ModeCompact || c.Mode == ModeMessages) && c.Format != protocol.FormatFramed {
+		return fmt.Errorf("the %q mode requires the %q format", c.Mode, protocol.FormatFramed)
+	}
+	if (c.MaxDeliveries > 0) != (c.DeadLetter != "") {
+		return fmt.Errorf("max_deliveries and dead_letter must be set together")
+	}
+	if c.ReplicationFactor < 0 {
+		return fmt.Errorf("replication_factor must not be negative")
+	}
+	if c.Acks > 0 && c.ReplicationFactor > 0 && int(c.Acks) >= c.ReplicationFactor {
+		return fmt.Errorf("acks %v needs more replicas than replication_factor %d provides", c.Acks, c.ReplicationFactor)
+	}
+	return nil
+}
+
+// HasRetention reports whether any of the retention limits is set.
+func (c Category) HasRetention() bool {
+	return c.RetentionAge > 0 || c.RetentionBytes > 0 || c.RetentionChunks > 0
+}
+
+// Mode defines how the chunks of a category are consumed.
+type Mode string
+
+const (
+	// ModeQueue is the default mode: a chunk is deleted once
+	// a consumer acknowledges it.
+	ModeQueue Mode = "queue"
+	// ModeLog ignores the acknowledgements, the chunks are only deleted
+	// by the retention policy so that they can be read many times.
+	ModeLog Mode = "log"
+	// ModeCompact is ModeLog where the sealed chunks are also compacted
+	// so that only the latest message for every key is kept.
+	// It requires the framed format.
+	ModeCompact Mode = "compact"
+	// ModePubSub gives every subscriber (consumer group) the whole stream.
+	// The acknowledgements are ignored, a chunk is deleted by the retention
+	// policy or once all subscribers have read it.
+	ModePubSub Mode = "pubsub"
+	// ModeMessages delivers the messages one by one with a visibility
+	// timeout, every message is acknowledged separately and is delivered
+	// again unless it is acknowledged in time. A chunk is deleted once all
+	// its messages are acknowledged. It requires the framed format.
+	ModeMessages Mode = "messages"
+)
+
+// DeletesOnAck reports whether the acknowledged chunks are deleted.
+func (m Mode) DeletesOnAck() bool {
+	return m == "" || m == ModeQueue
+}
+
+func (m *Mode) UnmarshalText(b []byte) error {
+	switch v := Mode(b); v {
+	case "", ModeQueue, ModeLog, ModeCompact, ModePubSub, ModeMessages:
+		*m = v
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", string(b))
+}
+
+// Durability is the fsync policy for the writes.
+type Durability string
+
+const (
+	// DurabilityNone does not fsync the data, it is flushed by the OS eventually.
+	DurabilityNone Durability = "none"
+	// DurabilityAlways fsyncs the chunk after every write.
+	DurabilityAlways Durability = "always"
+	// DurabilityInterval fsyncs the chunk periodically and makes the writers
+	// wait for the next fsync (group commit).
+	DurabilityInterval Durability = "interval"
+)
+
+func (d *Durability) UnmarshalText(b []byte) error {
+	switch v := Durability(b); v {
+	case "", DurabilityNone, DurabilityAlways, DurabilityInterval:
+		*d = v
+		return nil
+	}
+	return fmt.Errorf("unknown durability %q", string(b))
+}
+
+// Duration is a time.Duration that is written as "100ms" or "1h" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config is the configuration file contents.
+type Config struct {
+	// Default is used for the categories that are not listed in Categories.
+	Default    Category            `json:"default"`
+	Categories map[string]Category `json:"categories"`
+}
+
+// Load reads the JSON configuration file.
+func Load(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing config %q: %v", filename, err)
+	}
+	if err := c.Default.Validate(); err != nil {
+		return nil, fmt.Errorf("default category: %v", err)
+	}
+	if err := c.validateDeadLetter("", c.Default); err != nil {
+		return nil, fmt.Errorf("default category: %v", err)
+	}
+	for name, cat := range c.Categories {
+		if err := cat.Validate(); err != nil {
+			return nil, fmt.Errorf("category %q: %v", name, err)
+		}
+		if err := c.validateDeadLetter(name, cat); err != nil {
+			return nil, fmt.Errorf("category %q: %v", name, err)
+		}
+	}
+	return &c, nil
+}
+
+// validateDeadLetter checks that the dead-letter category
+// can store the failed messages with their headers.
+// The name of the default category is empty.
+func (c *Config) validateDeadLetter(name string, cat Category) error {
+	if cat.DeadLetter == "" {
+		return nil
+	}
+	if cat.DeadLetter == name {
+		return fmt.Errorf("the category can not be its own dead_letter")
+	}
+	if _, ok := c.Categories[cat.DeadLetter]; name == "" && !ok {
+		// it would inherit the default and be its own dead_letter
+		return fmt.Errorf("dead_letter %q must be listed in the categories", cat.DeadLetter)
+	}
+	if dl := c.Category(cat.DeadLetter); dl.Format != protocol.FormatFramed {
+		return fmt.Errorf("dead_letter %q must use the %q format", cat.DeadLetter, protocol.FormatFramed)
+	}
+	return nil
+}
+
+// Category returns the settings for the provided category.
+// It is safe to call on a nil *Config.
+func (c *Config) Category(name string) Category {
+	if c == nil {
+		return Category{}
+	}
+	if cat, ok := c.Categories[name]; ok {
+		return cat
+	}
+	return c.Default
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	contents := `{"categories": {"events": {"format": "framed", "mode": "pubsub", "acks": "all"}}}`
+	if err := os.WriteFile(filename, []byte(contents), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	cfg, err := Load(filename)
+	if err != nil {
+		t.Fatalf("Load() = %v, want no errors", err)
+	}
+
+	if got, want := cfg.Category("events").Format, protocol.FormatFramed; got != want {
+		t.Errorf("Category(events).Format = %v, want %v", got, want)
+	}
+	if got, want := cfg.Category("events").Mode, ModePubSub; got != want {
+		t.Errorf("Category(events).Mode = %v, want %v", got, want)
+	}
+	if got, want := cfg.Category("events").Acks, AcksAll; got != want {
+		t.Errorf("Category(events).Acks = %v, want %v", got, want)
+	}
+	if got, want := cfg.Category("numbers").Format, protocol.FormatNewline; got != want {
+		t.Errorf("Category(numbers).Format = %v, want %v", got, want)
+	}
+}
+
+func TestParseAcks(t *testing.T) {
+	for s, want := range map[string]Acks{"": AcksLeader, "leader": AcksLeader, "all": AcksAll, "2": 2} {
+		got, err := ParseAcks(s)
+		if err != nil || got != want {
+			t.Errorf("ParseAcks(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"-1", "some", "1.5"} {
+		if _, err := ParseAcks(s); err == nil {
+			t.Errorf("ParseAcks(%q) = nil error, want an error", s)
+		}
+	}
+}
+
+func TestNilConfig(t *testing.T) {
+	var cfg *Config
+	if got, want := cfg.Category("numbers").Format, protocol.FormatNewline; got != want {
+		t.Errorf("Category(numbers).Format = %v, want %v", got, want)
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	contents := `{"categories": {"profiles": {"mode": "compact"}}}`
+	if err := os.WriteFile(filename, []byte(contents), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	if _, err := Load(filename); err == nil {
+		t.Errorf("Load() = nil, want an error for the compact mode with the newline format")
+	}
+
+	for _, contents := range []string{
+		`{"categories": {"jobs": {"mode": "messages"}}}`,
+		`{"categories": {"jobs": {"max_deliveries": 3}}}`,
+		`{"categories": {"jobs": {"max_deliveries": 3, "dead_letter": "jobs"}}}`,
+		`{"categories": {"jobs": {"max_deliveries": 3, "dead_letter": "failed"}}}`,
+		`{"categories": {"jobs": {"replication_factor": -1}}}`,
+		`{"categories": {"jobs": {"replication_factor": 2, "acks": "2"}}}`,
+		`{"default": {"max_deliveries": 3, "dead_letter": "failed"}}`,
+		`{"default": {"max_deliveries": 3, "dead_letter": "failed"}, "categories": {"failed": {}}}`,
+	} {
+		if err := os.WriteFile(filename, []byte(contents), 0666); err != nil {
+			t.Fatalf("WriteFile() failed: %v", err)
+		}
+		if _, err := Load(filename); err == nil {
+			t.Errorf("Load(%s) = nil, want an error", contents)
+		}
+	}
+
+	contents = `{"categories": {
+		"jobs": {"max_deliveries": 3, "dead_letter": "failed"},
+		"failed": {"format": "framed"}
+	}}`
+	if err := os.WriteFile(filename, []byte(contents), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if _, err := Load(filename); err != nil {
+		t.Errorf("Load() = %v, want no errors for the framed dead_letter", err)
+	}
+
+	contents = `{
+		"default": {"max_deliveries": 3, "dead_letter": "failed"},
+		"categories": {"failed": {"format": "framed"}}
+	}`
+	if err := os.WriteFile(filename, []byte(contents), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if _, err := Load(filename); err != nil {
+		t.Errorf("Load() = %v, want no errors for the framed dead_letter of the default", err)
+	}
+}
@@ -3,9 +3,11 @@ module github.com/yyancy/go-queue
 go 1.16
 
 require (
-	github.com/coreos/etcd v2.3.8+incompatible // indirect
+	github.com/andybalholm/brotli v1.0.4
+	github.com/coreos/etcd v2.3.8+incompatible
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/klauspost/compress v1.15.0
 	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5
 	github.com/valyala/fasthttp v1.34.0
 	go.etcd.io/etcd v2.3.8+incompatible
@@ -0,0 +1,68 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/phayes/freeport"
+	"github.com/yyancy/go-queue/client"
+	"github.com/yyancy/go-queue/config"
+)
+
+// BenchmarkWrite sends the batches of the integration workload to /write,
+// which returns once the data is stored as the fsync policy requires.
+func BenchmarkWrite(b *testing.B) {
+	if _, err := exec.LookPath("etcd"); err != nil {
+		b.Skip("etcd is not found in PATH")
+	}
+	etcdPort := runEtcd(b)
+
+	batch := make([]byte, 0, maxBufferSize+16)
+	for i := 0; len(batch) < maxBufferSize; i++ {
+		batch = strconv.AppendInt(batch, int64(i), 10)
+		batch = append(batch, '\n')
+	}
+
+	for _, d := range []config.Durability{config.DurabilityNone, config.DurabilityAlways, config.DurabilityInterval} {
+		b.Run(string(d), func(b *testing.B) {
+			port, err := freeport.GetFreePort()
+			if err != nil {
+				b.Fatalf("Failed to get free port: %v", err)
+			}
+			dbPath, err := os.MkdirTemp(os.TempDir(), "go-queue")
+			if err != nil {
+				b.Fatalf("Failed to create temp dir: %v", err)
+			}
+			b.Cleanup(func() { os.RemoveAll(dbPath) })
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- InitAndServe(InitArgs{
+					EtcdAddr:     []string{fmt.Sprintf("localhost:%d", etcdPort)},
+					InstanceName: "moscow",
+					ClusterName:  "bench-" + string(d),
+					DirName:      dbPath,
+					ListenAddr:   fmt.Sprintf("localhost:%d", port),
+					Config:       &config.Config{Default: config.Category{Durability: d}},
+				})
+			}()
+			waitForPort(b, port, errCh)
+
+			s, err := client.NewClient([]string{fmt.Sprintf("http://localhost:%d", port)})
+			if err != nil {
+				b.Fatalf("NewClient() failed: %v", err)
+			}
+
+			b.SetBytes(int64(len(batch)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Send("numbers", batch); err != nil {
+					b.Fatalf("Send() failed: %v", err)
+				}
+			}
+		})
+	}
+}
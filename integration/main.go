@@ -2,7 +2,6 @@ package integration
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,6 +10,8 @@ import (
 	"time"
 
 	"github.com/valyala/fasthttp"
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
 	"github.com/yyancy/go-queue/server"
 	"github.com/yyancy/go-queue/server/replication"
 	"github.com/yyancy/go-queue/web"
@@ -24,6 +25,15 @@ type InitArgs struct {
 
 	DirName    string
 	ListenAddr string
+
+	// Config contains the per-category settings; nil means the defaults.
+	Config *config.Config
+
+	// ReplicationWorkers is the number of concurrent chunk downloads,
+	// zero means the default. ReplicationBandwidth limits their total speed
+	// in bytes per second, zero means no limit.
+	ReplicationWorkers   int
+	ReplicationBandwidth int64
 }
 
 func writeHander(ctx *fasthttp.RequestCtx) {
@@ -52,18 +62,30 @@ func InitAndServe(a InitArgs) error {
 	}
 	fp.Close()
 	os.Remove(fp.Name())
-	replStorage := replication.NewStorage(replState, a.InstanceName)
+	replStorage := replication.NewStorage(replState, a.InstanceName, a.Config)
+	go replStorage.CleanupDeparted(context.Background())
 	creator := &OnDiskCreator{
 		dirName:      a.DirName,
 		instanceName: a.InstanceName,
 		replStorage:  replStorage,
+		cfg:          a.Config,
 		storages:     make(map[string]*server.OnDisk),
 	}
 
 	w := web.NewWeb(replState, a.InstanceName, a.DirName, a.ListenAddr, replStorage, creator.Get)
 
-	replClient := replication.NewClient(replState, creator, a.InstanceName)
+	replClient := replication.NewClient(replState, creator, a.InstanceName, a.Config)
+	replClient.SetDownloadLimits(a.ReplicationWorkers, a.ReplicationBandwidth)
 	go replClient.Loop(context.Background())
+	catchUp := func() {
+		if err := replClient.CatchUp(context.Background()); err != nil {
+			log.Printf("catch-up replication failed: %v", err)
+		}
+	}
+	// the other instances delete the replication queue of an instance
+	// that stayed unregistered for too long
+	replState.OnReregistered(catchUp)
+	go catchUp()
 	log.Printf("Listening connections")
 	return w.Serve()
 }
@@ -72,19 +94,24 @@ type OnDiskCreator struct {
 	dirName      string
 	instanceName string
 	replStorage  *replication.Storage
+	cfg          *config.Config
 	m            sync.Mutex
 	storages     map[string]*server.OnDisk
 }
 
 func (c *OnDiskCreator) Stat(category, fileName string) (size int64, exists bool, err error) {
-	st, err := os.Stat(filepath.Join(c.dirName, category, fileName))
-	if errors.Is(err, os.ErrNotExist) {
-		return 0, false, nil
-	} else if err != nil {
+	inst, err := c.Get(category)
+	if err != nil {
 		return 0, false, err
 	}
-
-	return st.Size(), true, nil
+	return inst.ChunkSize(fileName)
+}
+func (c *OnDiskCreator) Sealed(category, fileName string) (bool, error) {
+	inst, err := c.Get(category)
+	if err != nil {
+		return false, err
+	}
+	return inst.ChunkSealed(fileName)
 }
 func (c *OnDiskCreator) WriteDirect(category, fileName string, contents []byte) error {
 	inst, err := c.Get(category)
@@ -93,6 +120,41 @@ func (c *OnDiskCreator) WriteDirect(category, fileName string, contents []byte)
 	}
 	return inst.WriteDirectly(fileName, contents)
 }
+func (c *OnDiskCreator) Seal(category, fileName string, source protocol.ChunkMeta) error {
+	inst, err := c.Get(category)
+	if err != nil {
+		return err
+	}
+	return inst.SealDirectly(fileName, source)
+}
+func (c *OnDiskCreator) StatCompressed(category, fileName string) (size int64, err error) {
+	inst, err := c.Get(category)
+	if err != nil {
+		return 0, err
+	}
+	return inst.CompressedPartSize(fileName)
+}
+func (c *OnDiskCreator) WriteCompressed(category, fileName string, contents []byte) error {
+	inst, err := c.Get(category)
+	if err != nil {
+		return err
+	}
+	return inst.WriteCompressedDirectly(fileName, contents)
+}
+func (c *OnDiskCreator) SealCompressed(category, fileName string, source protocol.ChunkMeta) error {
+	inst, err := c.Get(category)
+	if err != nil {
+		return err
+	}
+	return inst.SealCompressedDirectly(fileName, source)
+}
+func (c *OnDiskCreator) Replace(category, fileName string, replaced []string) error {
+	inst, err := c.Get(category)
+	if err != nil {
+		return err
+	}
+	return inst.ReplaceDirectly(fileName, replaced)
+}
 func (c *OnDiskCreator) Get(category string) (*server.OnDisk, error) {
 
 	c.m.Lock()
@@ -117,5 +179,5 @@ func (c *OnDiskCreator) newOnDisk(category string) (*server.OnDisk, error) {
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, fmt.Errorf("creating directory for the category: %v", err)
 	}
-	return server.NewOnDisk(dir, category, c.instanceName, c.replStorage)
+	return server.NewOnDisk(dir, category, c.instanceName, c.cfg.Category(category), c.replStorage)
 }
@@ -42,33 +42,19 @@ func SimpleClientAndServerTest(t *testing.T, concurrent bool) {
 
 	log.SetFlags(log.Flags() | log.Lmicroseconds)
 
-	etcdPeerPort, err := freeport.GetFreePort()
-	if err != nil {
-		t.Fatalf("Failed to get free port for etcd peer: %v", err)
-	}
-
-	etcdPort, err := freeport.GetFreePort()
-	if err != nil {
-		t.Fatalf("Failed to get free port for etcd: %v", err)
-	}
+	etcdPort := runEtcd(t)
 
 	port, err := freeport.GetFreePort()
 	if err != nil {
 		t.Fatalf("Failed to get free port: %v", err)
 	}
 
-	etcdPath, err := os.MkdirTemp(os.TempDir(), "etcd")
-	if err != nil {
-		t.Fatalf("Failed to create temp dir for etcd: %v", err)
-	}
-
 	dbPath, err := os.MkdirTemp(os.TempDir(), "go-queue")
 	if err != nil {
 		t.Fatalf("Failed to create temp dir: %v", err)
 	}
 
 	t.Cleanup(func() { os.RemoveAll(dbPath) })
-	t.Cleanup(func() { os.RemoveAll(etcdPath) })
 
 	categoryPath := filepath.Join(dbPath, "numbers")
 	os.MkdirAll(categoryPath, 0777)
@@ -78,25 +64,6 @@ func SimpleClientAndServerTest(t *testing.T, concurrent bool) {
 	// be preserved when writing to this directory.
 	ioutil.WriteFile(filepath.Join(categoryPath, fmt.Sprintf("moscow-chunk%09d", 1)), []byte("12345\n"), 0666)
 
-	etcdArgs := []string{"--data-dir", etcdPath,
-		"--listen-client-urls", fmt.Sprintf("http://localhost:%d", etcdPort),
-		"--advertise-client-urls", fmt.Sprintf("http://localhost:%d", etcdPort),
-		"--listen-peer-urls", fmt.Sprintf("http://localhost:%d", etcdPeerPort)}
-
-	log.Printf("Running `etcd %s`", strings.Join(etcdArgs, " "))
-
-	cmd := exec.Command("etcd", etcdArgs...)
-	cmd.Env = append(os.Environ(), "ETCD_UNSUPPORTED_ARCH=arm64")
-	if err := cmd.Start(); err != nil {
-		t.Fatalf("Could not run etcd: %v", err)
-	}
-
-	t.Cleanup(func() { cmd.Process.Kill() })
-
-	log.Printf("Waiting for the etcd port localhost:%d to open", etcdPort)
-
-	waitForPort(t, etcdPort, make(chan error, 1))
-
 	log.Printf("Running chukcha on port %d", port)
 
 	errCh := make(chan error, 1)
@@ -278,7 +245,48 @@ func recv(c *client.Client, completeCh chan bool) (sum int64, err error) {
 
 }
 
-func waitForPort(t *testing.T, port int, errCh chan error) {
+// runEtcd starts etcd on a free port for the duration of the test.
+func runEtcd(t testing.TB) int {
+	t.Helper()
+
+	etcdPeerPort, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port for etcd peer: %v", err)
+	}
+
+	etcdPort, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port for etcd: %v", err)
+	}
+
+	etcdPath, err := os.MkdirTemp(os.TempDir(), "etcd")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir for etcd: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(etcdPath) })
+
+	etcdArgs := []string{"--data-dir", etcdPath,
+		"--listen-client-urls", fmt.Sprintf("http://localhost:%d", etcdPort),
+		"--advertise-client-urls", fmt.Sprintf("http://localhost:%d", etcdPort),
+		"--listen-peer-urls", fmt.Sprintf("http://localhost:%d", etcdPeerPort)}
+
+	log.Printf("Running `etcd %s`", strings.Join(etcdArgs, " "))
+
+	cmd := exec.Command("etcd", etcdArgs...)
+	cmd.Env = append(os.Environ(), "ETCD_UNSUPPORTED_ARCH=arm64")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Could not run etcd: %v", err)
+	}
+
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	log.Printf("Waiting for the etcd port localhost:%d to open", etcdPort)
+
+	waitForPort(t, etcdPort, make(chan error, 1))
+	return etcdPort
+}
+
+func waitForPort(t testing.TB, port int, errCh chan error) {
 	t.Helper()
 
 	for i := 0; i <= 100; i++ {
@@ -5,6 +5,7 @@ import (
 	"log"
 	"strings"
 
+	"github.com/yyancy/go-queue/config"
 	"github.com/yyancy/go-queue/integration"
 )
 
@@ -14,6 +15,10 @@ var (
 	dirname      = flag.String("dirname", "", "the dirname where to put all data")
 	listenAddr   = flag.String("listen", "127.0.0.1:8080", "Network adddress to listen on")
 	etcdAddr     = flag.String("etcd", "127.0.0.1:2379", "etcd listen to")
+	configFile   = flag.String("config", "", "the JSON file with the per-category settings (optional)")
+
+	replicationWorkers   = flag.Int("replication-workers", 4, "the number of chunks that are downloaded from the other instances concurrently")
+	replicationBandwidth = flag.Int64("replication-bandwidth", 0, "the total download speed of the replication in bytes per second, 0 means no limit")
 )
 
 func main() {
@@ -33,12 +38,25 @@ func main() {
 	if *etcdAddr == "" {
 		log.Fatalf("The flag --etcd must be provided")
 	}
+	var cfg *config.Config
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("Could not load the config: %v", err)
+		}
+	}
+
 	a := integration.InitArgs{
 		EtcdAddr:     strings.Split(*etcdAddr, ","),
 		ClusterName:  *clusterName,
 		InstanceName: *instanceName,
 		DirName:      *dirname,
 		ListenAddr:   *listenAddr,
+		Config:       cfg,
+
+		ReplicationWorkers:   *replicationWorkers,
+		ReplicationBandwidth: *replicationBandwidth,
 	}
 
 	if err := integration.InitAndServe(a); err != nil {
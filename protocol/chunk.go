@@ -1,7 +1,87 @@
 package protocol
 
+import "time"
+
 type Chunk struct {
 	Name     string `json:"name"`
 	Complete bool   `json:"complete"`
-	Size     uint64 `json:"size"`
+	// Size is the size of the uncompressed contents of the chunk.
+	Size uint64 `json:"size"`
+	// Compressed is set when the sealed chunk is stored compressed,
+	// CompressedSize is the size of the compressed file then.
+	Compressed     bool   `json:"compressed,omitempty"`
+	CompressedSize uint64 `json:"compressedSize,omitempty"`
+	// Replaces are the chunks that were compacted into this one,
+	// they are deleted shortly after the compaction.
+	Replaces []string `json:"replaces,omitempty"`
+
+	ChunkMeta
+}
+
+// ChunkMeta is what the server knows about the contents of the chunk.
+// The fields are zero when they are not known, e.g. for the chunks
+// written before the metadata was recorded.
+type ChunkMeta struct {
+	// Messages is the number of messages in the chunk.
+	Messages uint64 `json:"messages"`
+	// FirstTime and LastTime are when the first and the last
+	// message of the chunk were written.
+	FirstTime time.Time `json:"firstTime"`
+	LastTime  time.Time `json:"lastTime"`
+	// Checksum is the hex-encoded CRC-32C of the uncompressed contents
+	// of the complete chunk, empty while the chunk is written to.
+	Checksum string `json:"checksum,omitempty"`
+	// Owner is the instance that wrote the chunk.
+	Owner string `json:"owner"`
+	// Created is when the chunk was created.
+	Created time.Time `json:"created"`
+}
+
+// OffsetHeader is the HTTP header that contains the offset in the chunk
+// from which /read returned the data when reading from a message number
+// or a time instead of the offset.
+const OffsetHeader = "X-Go-Queue-Offset"
+
+// DeliverAtHeader (RFC 3339) and DeliverAfterHeader (a duration, e.g. "5m")
+// are the HTTP headers of /write that make the server hold the messages
+// until that time.
+const (
+	DeliverAtHeader    = "X-Go-Queue-Deliver-At"
+	DeliverAfterHeader = "X-Go-Queue-Deliver-After"
+)
+
+// AcksHeader of /write overrides the acks setting of the category:
+// "leader", "all" or the number of replicas that must store the write.
+const AcksHeader = "X-Go-Queue-Acks"
+
+// MaxDeliveriesHeader is the HTTP header of /read that contains how many
+// times a message can fail before /failMessage moves it to the dead-letter
+// category. It is not set when there is no limit.
+const MaxDeliveriesHeader = "X-Go-Queue-Max-Deliveries"
+
+// ChunkRange is the part of the chunk that contains the messages written
+// in the requested time range. End is the offset past the last such message,
+// zero means the end of the chunk.
+type ChunkRange struct {
+	Chunk string `json:"chunk"`
+	Off   uint64 `json:"off"`
+	End   uint64 `json:"end,omitempty"`
+}
+
+// Offset is the position of a consumer group in the chunk.
+type Offset struct {
+	Off uint64 `json:"off"`
+	// Done is set once the group has read the complete chunk.
+	Done bool `json:"done,omitempty"`
+}
+
+// GroupOffsets are the offsets committed by a consumer group, by chunk name.
+type GroupOffsets map[string]Offset
+
+// Lease is the lease of the chunk to one consumer of a consumer group.
+type Lease struct {
+	Chunk    string `json:"chunk"`
+	Consumer string `json:"consumer"`
+	// TTL is how long the lease is held without heartbeats, in seconds.
+	TTL int64 `json:"ttl"`
 }
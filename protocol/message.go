@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// The flags of the framed records describe what precedes
+// the value of the message in the record payload:
+//
+//	FlagKey:     uvarint length, key
+//	FlagHeaders: uvarint count, count times (uvarint length, name, uvarint length, value)
+//	FlagTime:    8 bytes big-endian Unix time in nanoseconds
+//
+// in that order. FlagTombstone marks the deletion of the key, such messages
+// must have a key and are removed by the compaction eventually.
+// FlagTime is set by the server when the message is written.
+const (
+	FlagKey byte = 1 << iota
+	FlagHeaders
+	FlagTombstone
+	FlagTime
+)
+
+// knownFlags are the flags that this version understands.
+const knownFlags = FlagKey | FlagHeaders | FlagTombstone | FlagTime
+
+// The well-known header names. Any other names can be used as well.
+const (
+	HeaderContentType = "content-type"
+	HeaderTraceID     = "trace-id"
+	HeaderProducerID  = "producer-id"
+	HeaderTimestamp   = "timestamp"
+)
+
+// The headers of the messages in the dead-letter categories that describe
+// where and why the message failed.
+const (
+	HeaderDeadLetterCategory = "dead-letter-category"
+	HeaderDeadLetterChunk    = "dead-letter-chunk"
+	HeaderDeadLetterOffset   = "dead-letter-offset"
+	HeaderDeadLetterAttempts = "dead-letter-attempts"
+	HeaderDeadLetterError    = "dead-letter-error"
+)
+
+// Message is a single message with its optional key and headers.
+type Message struct {
+	Key     []byte
+	Headers []Header
+	Value   []byte
+	// Tombstone means that the key was deleted.
+	Tombstone bool
+	// Time is when the server received the message,
+	// zero for the messages written before it was recorded.
+	Time time.Time
+}
+
+// Header is a named piece of metadata attached to a message.
+type Header struct {
+	Name  string
+	Value []byte
+}
+
+// Header returns the value of the first header with the name.
+func (m Message) Header(name string) ([]byte, bool) {
+	for _, h := range m.Headers {
+		if h.Name == name {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AppendMessage appends the message encoded as a framed record to dst.
+func AppendMessage(dst []byte, m Message) []byte {
+	var flags byte
+	var payload []byte
+	if m.Key != nil {
+		flags |= FlagKey
+		payload = appendBytes(payload, m.Key)
+	}
+	if len(m.Headers) > 0 {
+		flags |= FlagHeaders
+		payload = appendUvarint(payload, uint64(len(m.Headers)))
+		for _, h := range m.Headers {
+			payload = appendBytes(payload, []byte(h.Name))
+			payload = appendBytes(payload, h.Value)
+		}
+	}
+	if m.Tombstone {
+		flags |= FlagTombstone
+	}
+	if !m.Time.IsZero() {
+		flags |= FlagTime
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(m.Time.UnixNano()))
+		payload = append(payload, buf[:]...)
+	}
+	payload = append(payload, m.Value...)
+	return AppendRecord(dst, flags, payload)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func appendBytes(dst []byte, b []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// DecodeMessage decodes the message stored in the record.
+// The key, the header values and the value reference the record payload.
+func DecodeMessage(rec Record) (Message, error) {
+	if rec.Flags&^knownFlags != 0 {
+		return Message{}, fmt.Errorf("%w: unknown flags %#x", ErrCorruptRecord, rec.Flags&^knownFlags)
+	}
+
+	if rec.Flags&FlagTombstone != 0 && rec.Flags&FlagKey == 0 {
+		return Message{}, fmt.Errorf("%w: tombstone without a key", ErrCorruptRecord)
+	}
+
+	m := Message{Tombstone: rec.Flags&FlagTombstone != 0}
+	buf := rec.Payload
+	var err error
+	if rec.Flags&FlagKey != 0 {
+		if m.Key, buf, err = readBytes(buf); err != nil {
+			return Message{}, fmt.Errorf("reading key: %w", err)
+		}
+	}
+	if rec.Flags&FlagHeaders != 0 {
+		count, n := binary.Uvarint(buf)
+		if n <= 0 || count > uint64(len(buf)) {
+			return Message{}, fmt.Errorf("%w: invalid number of headers", ErrCorruptRecord)
+		}
+		buf = buf[n:]
+		m.Headers = make([]Header, count)
+		for i := range m.Headers {
+			var name []byte
+			if name, buf, err = readBytes(buf); err != nil {
+				return Message{}, fmt.Errorf("reading header %d: %w", i, err)
+			}
+			m.Headers[i].Name = string(name)
+			if m.Headers[i].Value, buf, err = readBytes(buf); err != nil {
+				return Message{}, fmt.Errorf("reading header %q: %w", name, err)
+			}
+		}
+	}
+	if rec.Flags&FlagTime != 0 {
+		if len(buf) < 8 {
+			return Message{}, fmt.Errorf("%w: invalid time", ErrCorruptRecord)
+		}
+		m.Time = time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8])))
+		buf = buf[8:]
+	}
+	m.Value = buf
+	return m, nil
+}
+
+func readBytes(buf []byte) (b []byte, rest []byte, err error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || l > uint64(len(buf)-n) {
+		return nil, nil, fmt.Errorf("%w: invalid length", ErrCorruptRecord)
+	}
+	end := n + int(l)
+	return buf[n:end:end], buf[end:], nil
+}
+
+// DecodeMessages decodes all messages in buf, which must consist of complete records only.
+func DecodeMessages(buf []byte) ([]Message, error) {
+	recs, err := DecodeRecords(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Message, 0, len(recs))
+	for i, rec := range recs {
+		m, err := DecodeMessage(rec)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// CountMessages returns the number of messages in buf, which must consist
+// of complete, uncorrupted records with well-formed messages.
+func CountMessages(buf []byte) (int, error) {
+	var n int
+	for off := 0; off < len(buf); n++ {
+		rec, size, err := ReadRecord(buf[off:])
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		if rec.Flags != 0 {
+			if _, err := DecodeMessage(rec); err != nil {
+				return 0, fmt.Errorf("record at offset %d: %w", off, err)
+			}
+		}
+		off += size
+	}
+	return n, nil
+}
+
+// StampMessages appends the messages in buf, which must consist of complete
+// records with well-formed messages, to dst with their Time set to t.
+func StampMessages(dst []byte, buf []byte, t time.Time) ([]byte, error) {
+	for off := 0; off < len(buf); {
+		rec, size, err := ReadRecord(buf[off:])
+		if err != nil {
+			return nil, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		m, err := DecodeMessage(rec)
+		if err != nil {
+			return nil, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		m.Time = t
+		dst = AppendMessage(dst, m)
+		off += size
+	}
+	return dst, nil
+}
+
+// ReceivedMessage is a message delivered by /receive in the messages
+// categories. Chunk and Off identify the message for /ackMessage and
+// /nackMessage.
+type ReceivedMessage struct {
+	Chunk string `json:"chunk"`
+	Off   uint64 `json:"off"`
+	// Attempts is how many times the message was delivered, including this time.
+	Attempts int     `json:"attempts"`
+	Message  Message `json:"message"`
+}
+
+// FailedMessage is the response of /failMessage.
+type FailedMessage struct {
+	// Attempts is how many times the message failed so far.
+	Attempts int `json:"attempts"`
+	// Moved means that the message was moved to the dead-letter category.
+	Moved bool `json:"moved"`
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []Message{
+		{Value: []byte("plain")},
+		{Key: []byte("user-1"), Value: []byte("with\nnewline")},
+		{Key: []byte{}, Value: []byte("empty key")},
+		{
+			Key: []byte("user-2"),
+			Headers: []Header{
+				{Name: HeaderContentType, Value: []byte("application/json")},
+				{Name: HeaderTraceID, Value: []byte("abc")},
+				{Name: "empty", Value: []byte{}},
+			},
+			Value: []byte(`{"name":"bob"}`),
+		},
+		{Headers: []Header{{Name: HeaderProducerID, Value: []byte("p1")}}, Value: []byte{}},
+		{Key: []byte("user-1"), Tombstone: true},
+		{Key: []byte("user-3"), Value: []byte("stamped"), Time: time.Unix(1600000000, 123)},
+	}
+
+	var buf []byte
+	for _, m := range msgs {
+		buf = AppendMessage(buf, m)
+	}
+
+	if n, err := CountMessages(buf); err != nil || n != len(msgs) {
+		t.Fatalf("CountMessages() = %d, %v; want %d, no errors", n, err, len(msgs))
+	}
+
+	got, err := DecodeMessages(buf)
+	if err != nil {
+		t.Fatalf("DecodeMessages() = %v, want no errors", err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("len(DecodeMessages()) = %d, want %d", len(got), len(msgs))
+	}
+	for i := range msgs {
+		if !bytes.Equal(got[i].Key, msgs[i].Key) || (got[i].Key == nil) != (msgs[i].Key == nil) {
+			t.Errorf("message %d key = %q, want %q", i, got[i].Key, msgs[i].Key)
+		}
+		if !bytes.Equal(got[i].Value, msgs[i].Value) || got[i].Tombstone != msgs[i].Tombstone {
+			t.Errorf("message %d value = %q, want %q", i, got[i].Value, msgs[i].Value)
+		}
+		if !got[i].Time.Equal(msgs[i].Time) {
+			t.Errorf("message %d time = %v, want %v", i, got[i].Time, msgs[i].Time)
+		}
+		if len(msgs[i].Headers) != 0 && !reflect.DeepEqual(got[i].Headers, msgs[i].Headers) {
+			t.Errorf("message %d headers = %+v, want %+v", i, got[i].Headers, msgs[i].Headers)
+		}
+	}
+
+	if v, ok := got[3].Header(HeaderTraceID); !ok || string(v) != "abc" {
+		t.Errorf("Header(%q) = %q, %v; want %q, true", HeaderTraceID, v, ok, "abc")
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rec  Record
+	}{
+		{desc: "unknown flags", rec: Record{Flags: 0x80}},
+		{desc: "tombstone without a key", rec: Record{Flags: FlagTombstone}},
+		{desc: "truncated key", rec: Record{Flags: FlagKey, Payload: []byte{5, 'a'}}},
+		{desc: "too many headers", rec: Record{Flags: FlagHeaders, Payload: []byte{100}}},
+		{desc: "truncated header", rec: Record{Flags: FlagHeaders, Payload: []byte{1, 1, 'a', 3}}},
+		{desc: "truncated time", rec: Record{Flags: FlagTime, Payload: []byte{1, 2, 3}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := DecodeMessage(tc.rec); !errors.Is(err, ErrCorruptRecord) {
+				t.Errorf("DecodeMessage() = %v, want %v", err, ErrCorruptRecord)
+			}
+			buf := AppendRecord(nil, tc.rec.Flags, tc.rec.Payload)
+			if _, err := CountMessages(buf); !errors.Is(err, ErrCorruptRecord) {
+				t.Errorf("CountMessages() = %v, want %v", err, ErrCorruptRecord)
+			}
+		})
+	}
+}
+
+func TestStampMessages(t *testing.T) {
+	var buf []byte
+	buf = AppendMessage(buf, Message{Key: []byte("a"), Value: []byte("1")})
+	buf = AppendRecord(buf, 0, []byte("raw"))
+	buf = AppendMessage(buf, Message{Value: []byte("2"), Time: time.Unix(1, 0)})
+
+	now := time.Unix(1600000000, 0)
+	stamped, err := StampMessages(nil, buf, now)
+	if err != nil {
+		t.Fatalf("StampMessages() = %v, want no errors", err)
+	}
+	got, err := DecodeMessages(stamped)
+	if err != nil {
+		t.Fatalf("DecodeMessages() = %v, want no errors", err)
+	}
+	want := []string{"1", "raw", "2"}
+	if len(got) != len(want) {
+		t.Fatalf("len(DecodeMessages()) = %d, want %d", len(got), len(want))
+	}
+	for i, m := range got {
+		if string(m.Value) != want[i] || !m.Time.Equal(now) {
+			t.Errorf("message %d = %q at %v, want %q at %v", i, m.Value, m.Time, want[i], now)
+		}
+	}
+
+	if _, err := StampMessages(nil, buf[:len(buf)-1], now); !errors.Is(err, ErrShortRecord) {
+		t.Errorf("StampMessages() of a truncated batch = %v, want %v", err, ErrShortRecord)
+	}
+}
@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Format describes how messages are laid out inside of a chunk.
+type Format int
+
+const (
+	// FormatNewline stores messages as newline-delimited lines.
+	FormatNewline Format = iota
+	// FormatFramed stores messages as length-prefixed, checksummed records
+	// so that the payload can contain arbitrary bytes.
+	FormatFramed
+)
+
+// FormatHeader is the HTTP header used to tell the client the format
+// of the chunk contents returned by /read.
+const FormatHeader = "X-Go-Queue-Format"
+
+func (f Format) String() string {
+	switch f {
+	case FormatNewline:
+		return "newline"
+	case FormatFramed:
+		return "framed"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat converts the textual representation of the format.
+// An empty string means the default newline format.
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "newline":
+		return FormatNewline, nil
+	case "framed":
+		return FormatFramed, nil
+	}
+	return FormatNewline, fmt.Errorf("unknown format %q", s)
+}
+
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *Format) UnmarshalText(b []byte) error {
+	v, err := ParseFormat(string(b))
+	if err != nil {
+		return err
+	}
+	*f = v
+	return nil
+}
+
+// Every framed record starts with the header:
+//
+//	length uint32 (big endian) - the length of the payload
+//	crc    uint32 (big endian) - CRC-32C of the flags and the payload
+//	flags  uint8
+//
+// and is followed by length bytes of the payload.
+const RecordHeaderSize = 9
+
+// MaxRecordSize is the maximum size of a record payload.
+const MaxRecordSize = 4 * 1024 * 1024
+
+var (
+	// ErrShortRecord means that the buffer ends in the middle of a record.
+	ErrShortRecord = errors.New("incomplete record")
+	// ErrCorruptRecord means that the record header or checksum is invalid.
+	ErrCorruptRecord = errors.New("corrupt record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is a single decoded framed message.
+type Record struct {
+	Flags   byte
+	Payload []byte
+}
+
+// AppendRecord appends the encoded record to dst and returns the extended buffer.
+func AppendRecord(dst []byte, flags byte, payload []byte) []byte {
+	var hdr [RecordHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:8], recordChecksum(flags, payload))
+	hdr[8] = flags
+
+	dst = append(dst, hdr[:]...)
+	return append(dst, payload...)
+}
+
+func recordChecksum(flags byte, payload []byte) uint32 {
+	crc := crc32.Update(0, crcTable, []byte{flags})
+	return crc32.Update(crc, crcTable, payload)
+}
+
+// ReadRecord decodes the record at the beginning of buf and returns
+// the total number of bytes that the record occupies.
+// The payload of the returned record references buf.
+func ReadRecord(buf []byte) (rec Record, n int, err error) {
+	if len(buf) < RecordHeaderSize {
+		return Record{}, 0, ErrShortRecord
+	}
+
+	length := binary.BigEndian.Uint32(buf[0:4])
+	if length > MaxRecordSize {
+		return Record{}, 0, fmt.Errorf("%w: length %d exceeds the maximum of %d", ErrCorruptRecord, length, MaxRecordSize)
+	}
+
+	n = RecordHeaderSize + int(length)
+	if len(buf) < n {
+		return Record{}, 0, ErrShortRecord
+	}
+
+	rec = Record{
+		Flags:   buf[8],
+		Payload: buf[RecordHeaderSize:n],
+	}
+	if recordChecksum(rec.Flags, rec.Payload) != binary.BigEndian.Uint32(buf[4:8]) {
+		return Record{}, 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+	return rec, n, nil
+}
+
+// RecordSize returns the total size of the record from its header
+// without reading the payload. hdr must hold at least RecordHeaderSize bytes.
+func RecordSize(hdr []byte) (int, error) {
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	if length > MaxRecordSize {
+		return 0, fmt.Errorf("%w: length %d exceeds the maximum of %d", ErrCorruptRecord, length, MaxRecordSize)
+	}
+	return RecordHeaderSize + int(length), nil
+}
+
+// CutLastRecord splits buf into the complete records and the incomplete rest.
+// buf must start at a record boundary. ErrShortRecord is returned when
+// not even a single record fits into buf.
+func CutLastRecord(buf []byte) (records []byte, rest []byte, err error) {
+	off := 0
+	for off < len(buf) {
+		_, n, err := ReadRecord(buf[off:])
+		if err == ErrShortRecord {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		off += n
+	}
+
+	if off == 0 && len(buf) != 0 {
+		return nil, nil, ErrShortRecord
+	}
+	return buf[:off], buf[off:], nil
+}
+
+// ValidateRecords checks that buf consists of complete, uncorrupted records.
+func ValidateRecords(buf []byte) error {
+	_, err := CountRecords(buf)
+	return err
+}
+
+// CountRecords returns the number of records in buf, which must consist
+// of complete, uncorrupted records.
+func CountRecords(buf []byte) (int, error) {
+	var n int
+	for off := 0; off < len(buf); n++ {
+		_, size, err := ReadRecord(buf[off:])
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		off += size
+	}
+	return n, nil
+}
+
+// DecodeRecords decodes all records in buf, which must consist of complete records only.
+func DecodeRecords(buf []byte) ([]Record, error) {
+	var res []Record
+	for off := 0; off < len(buf); {
+		rec, n, err := ReadRecord(buf[off:])
+		if err != nil {
+			return nil, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		res = append(res, rec)
+		off += n
+	}
+	return res, nil
+}
+
+// RecordReader reads framed records from a stream one by one.
+type RecordReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewRecordReader creates a RecordReader that reads from r,
+// which must be positioned at a record boundary.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next record and the number of bytes that it occupies in the stream.
+// The payload is only valid until the next call to Next.
+// io.EOF is returned when the stream ends at a record boundary and
+// ErrShortRecord when it ends in the middle of a record.
+func (rr *RecordReader) Next() (rec Record, n int, err error) {
+	hdr, err := rr.r.Peek(RecordHeaderSize)
+	if err == io.EOF {
+		if len(hdr) == 0 {
+			return Record{}, 0, io.EOF
+		}
+		return Record{}, 0, ErrShortRecord
+	} else if err != nil {
+		return Record{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	if length > MaxRecordSize {
+		return Record{}, 0, fmt.Errorf("%w: length %d exceeds the maximum of %d", ErrCorruptRecord, length, MaxRecordSize)
+	}
+
+	n = RecordHeaderSize + int(length)
+	if cap(rr.buf) < n {
+		rr.buf = make([]byte, n)
+	}
+	buf := rr.buf[:n]
+	if _, err := io.ReadFull(rr.r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Record{}, 0, ErrShortRecord
+	} else if err != nil {
+		return Record{}, 0, err
+	}
+
+	return ReadRecord(buf)
+}
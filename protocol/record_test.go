@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("one"),
+		[]byte("with\nnewline"),
+		{0, 1, 2, 255},
+		{},
+	}
+
+	var buf []byte
+	for i, p := range payloads {
+		buf = AppendRecord(buf, byte(i), p)
+	}
+
+	recs, err := DecodeRecords(buf)
+	if err != nil {
+		t.Fatalf("DecodeRecords() = %v, want no errors", err)
+	}
+	if got, want := len(recs), len(payloads); got != want {
+		t.Fatalf("len(DecodeRecords()) = %d, want %d", got, want)
+	}
+	for i, rec := range recs {
+		if rec.Flags != byte(i) || !bytes.Equal(rec.Payload, payloads[i]) {
+			t.Errorf("record %d = (%d, %q), want (%d, %q)", i, rec.Flags, rec.Payload, i, payloads[i])
+		}
+	}
+}
+
+func TestCutLastRecord(t *testing.T) {
+	buf := AppendRecord(nil, 0, []byte("100"))
+	buf = AppendRecord(buf, 0, []byte("200"))
+	wantRes := buf
+	buf = AppendRecord(buf, 0, []byte("300"))
+	buf = buf[:len(buf)-1]
+
+	gotRes, gotRest, err := CutLastRecord(buf)
+	if err != nil {
+		t.Fatalf("CutLastRecord(): got error %v; want no error", err)
+	}
+	if !bytes.Equal(gotRes, wantRes) || len(gotRest) != len(buf)-len(wantRes) {
+		t.Errorf("CutLastRecord(): got %d, %d bytes; want %d, %d bytes",
+			len(gotRes), len(gotRest), len(wantRes), len(buf)-len(wantRes))
+	}
+}
+
+func TestCutLastRecordErrors(t *testing.T) {
+	rec := AppendRecord(nil, 0, []byte("100"))
+
+	if _, _, err := CutLastRecord(rec[:len(rec)-1]); err != ErrShortRecord {
+		t.Errorf("CutLastRecord(short) = %v; want %v", err, ErrShortRecord)
+	}
+
+	corrupt := append([]byte{}, rec...)
+	corrupt[len(corrupt)-1] = '9'
+	if _, _, err := CutLastRecord(corrupt); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("CutLastRecord(corrupt) = %v; want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	testCases := []struct {
+		s       string
+		want    Format
+		wantErr bool
+	}{
+		{s: "", want: FormatNewline},
+		{s: "newline", want: FormatNewline},
+		{s: "framed", want: FormatFramed},
+		{s: "json", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := ParseFormat(tc.s)
+		if tc.wantErr && err == nil {
+			t.Errorf("ParseFormat(%q): want error; but no error", tc.s)
+		} else if !tc.wantErr && got != tc.want {
+			t.Errorf("ParseFormat(%q) = %v, %v; want %v", tc.s, got, err, tc.want)
+		}
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	buf := AppendRecord(nil, 0, []byte("one"))
+	buf = AppendRecord(buf, 0, []byte("two"))
+
+	rr := NewRecordReader(bytes.NewReader(buf[:len(buf)-1]))
+	rec, n, err := rr.Next()
+	if err != nil || string(rec.Payload) != "one" || n != RecordHeaderSize+3 {
+		t.Fatalf("Next() = %q, %d, %v; want %q, %d, no error", rec.Payload, n, err, "one", RecordHeaderSize+3)
+	}
+	if _, _, err := rr.Next(); err != ErrShortRecord {
+		t.Fatalf("Next() at a torn record = %v; want %v", err, ErrShortRecord)
+	}
+
+	rr = NewRecordReader(bytes.NewReader(buf))
+	for i := 0; i < 2; i++ {
+		if _, _, err := rr.Next(); err != nil {
+			t.Fatalf("Next() = %v; want no error", err)
+		}
+	}
+	if _, _, err := rr.Next(); err != io.EOF {
+		t.Fatalf("Next() at the end = %v; want %v", err, io.EOF)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
@@ -13,54 +14,240 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/yyancy/go-queue/config"
 	"github.com/yyancy/go-queue/protocol"
 )
 
 const defaultBlockSize = 8 * 1024 * 1024
 const maxFileChunkSize = 20 * 1024 * 1024
+const defaultSyncInterval = 10 * time.Millisecond
 
 var errSmallBuffer = errors.New("too small buffer")
 
 type StorageHooks interface {
 	BeforeCreatingChunk(ctx context.Context, category, filename string) error
+	// AfterDeletingChunk is called once the chunk is deleted, e.g. because
+	// it was acknowledged, consumed by all groups or expired.
+	AfterDeletingChunk(ctx context.Context, category, filename string) error
 }
 
+// deleteHookTimeout limits the AfterDeletingChunk hook.
+const deleteHookTimeout = 10 * time.Second
+
 type OnDisk struct {
 	dirname      string
 	instanceName string
 	category     string
+	format       protocol.Format
+	mode         config.Mode
 	repl         StorageHooks
 
+	retentionAge    time.Duration
+	retentionBytes  uint64
+	retentionChunks int
+
 	writeMu       sync.Mutex
 	lastChunk     string
 	lastChunkSize uint64
 	lastChunkIdx  uint64
+	// lastChunkRecovered is set when lastChunk already existed on startup
+	// and must be reopened for appends instead of being created.
+	lastChunkRecovered bool
+	// writtenBytes is the number of bytes written since the start,
+	// lastSyncRequest is its value when the last early fsync was requested.
+	writtenBytes    uint64
+	lastSyncRequest uint64
+	// lastChunkMsgs is the number of messages in the active chunk,
+	// lastIndexOff is the offset of its last index entry.
+	lastChunkMsgs uint64
+	lastIndexOff  uint64
+	lastIndexTime time.Time
+	indexFp       *os.File
+	// stampBuf is reused to stamp the framed messages with the time
+	// they were received.
+	stampBuf []byte
+	// lastChunkFp is the descriptor the active chunk is written through,
+	// the readers use their own descriptors from handles.
+	lastChunkFp *os.File
+	// lastChunkCreated is when the first message was written to lastChunk,
+	// the chunk is sealed once it is older than maxChunkAge.
+	lastChunkCreated time.Time
+	maxChunkAge      time.Duration
+	// lastChunkCRC, lastChunkFirstTime and lastChunkLastTime are the
+	// metadata of the active chunk that is written to metaSuffix on seal.
+	lastChunkCRC       uint32
+	lastChunkFirstTime time.Time
+	lastChunkLastTime  time.Time
+
+	durability  config.Durability
+	syncBytes   uint64
+	syncNowCh   chan struct{}
+	syncMu      sync.Mutex
+	syncCond    *sync.Cond
+	syncedBytes uint64
+	syncErr     error
+	stopCh      chan struct{}
+	closeOnce   sync.Once
+
+	compression config.Compression
+
+	// tombstoneRetention is how long the compaction keeps the tombstones.
+	tombstoneRetention time.Duration
+
+	// maxDeliveries is how many times a message can fail before
+	// it is moved to the deadLetter category, zero means no limit.
+	maxDeliveries int
+	deadLetter    string
+
+	handles *handleCache
+
+	// filesMu serializes the deletion of the chunks with the compression
+	// that replaces their files.
+	filesMu sync.Mutex
+
+	metaMu sync.Mutex
+	metas  map[string]*protocol.ChunkMeta
+
+	// deliveryMu protects the deliveries of the messages categories:
+	// cursor is the first message that was never delivered and inFlight
+	// are the delivered messages that were not acknowledged yet.
+	deliveryMu sync.Mutex
+	cursor     msgPos
+	inFlight   map[msgPos]*inFlight
+
+	// failuresMu serializes the updates of the failures of the messages
+	// that were read with /read.
+	failuresMu sync.Mutex
 
-	fpsMu sync.Mutex
-	fps   map[string]*os.File
+	// delayed are the batches written with SendAt that are not due yet.
+	delayMu sync.Mutex
+	delayed []delayedBatch
+
+	// acks is the default number of replicas that must store a write,
+	// replicas is the progress they reported and replicaWaiters are the
+	// writes that wait for them.
+	acks           config.Acks
+	replicaMu      sync.Mutex
+	replicas       map[string]replicaProgress
+	replicaWaiters map[*replicaWaiter]struct{}
 }
 
 var filenameRegexp = regexp.MustCompile("^chunk([0-9]+)$")
 
-func NewOnDisk(dirname string, category string, instanceName string, repl StorageHooks) (*OnDisk, error) {
+// chunkNameRegexp matches the chunks of all instances, the other files
+// in the directory are sidecars or temporary files.
+var chunkNameRegexp = regexp.MustCompile("^.+-chunk[0-9]+$")
+
+// sealSuffix is the suffix of the marker file that is created next to the
+// chunk when the chunk is complete and will not be written to anymore.
+const sealSuffix = ".sealed"
+
+func NewOnDisk(dirname string, category string, instanceName string, cfg config.Category, repl StorageHooks) (*OnDisk, error) {
 	s := &OnDisk{
 		dirname:      dirname,
 		category:     category,
+		format:       cfg.Format,
+		mode:         cfg.Mode,
 		repl:         repl,
 		instanceName: instanceName,
-		fps:          make(map[string]*os.File),
+		handles:      newHandleCache(maxOpenChunks),
+		metas:        make(map[string]*protocol.ChunkMeta),
+		compression:  cfg.Compression,
+		durability:   cfg.Durability,
+		syncBytes:    cfg.SyncBytes,
+		syncNowCh:    make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
+
+		retentionAge:    time.Duration(cfg.RetentionAge),
+		retentionBytes:  cfg.RetentionBytes,
+		retentionChunks: cfg.RetentionChunks,
+		maxChunkAge:     time.Duration(cfg.MaxChunkAge),
+
+		tombstoneRetention: time.Duration(cfg.TombstoneRetention),
+
+		maxDeliveries: cfg.MaxDeliveries,
+		deadLetter:    cfg.DeadLetter,
+
+		acks:           cfg.Acks,
+		replicas:       make(map[string]replicaProgress),
+		replicaWaiters: make(map[*replicaWaiter]struct{}),
 	}
+	s.syncCond = sync.NewCond(&s.syncMu)
 
-	if err := s.initLastChunkIdx(); err != nil {
+	ownChunks, newestChunk, err := s.initLastChunkIdx()
+	if err != nil {
 		return nil, err
 	}
+
+	// Only the newest chunk of the instance could have been written to
+	// before the restart, the rest of them are complete even if they
+	// were created before the seal markers were introduced.
+	for _, chunk := range ownChunks {
+		if chunk == newestChunk || s.isSealed(chunk) {
+			continue
+		}
+		meta, _, err := s.computeMeta(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("computing metadata of chunk %q: %v", chunk, err)
+		}
+		if err := s.writeMeta(chunk, meta); err != nil {
+			return nil, err
+		}
+		if err := s.sealChunk(chunk); err != nil {
+			return nil, fmt.Errorf("sealing chunk %q: %v", chunk, err)
+		}
+	}
+
+	if newestChunk != "" && !s.isSealed(newestChunk) {
+		if err := s.recoverLastChunk(newestChunk); err != nil {
+			return nil, fmt.Errorf("recovering chunk %q: %v", newestChunk, err)
+		}
+	}
+
+	if err := s.openFollowedChunk(context.Background()); err != nil {
+		return nil, fmt.Errorf("creating the chunk for the replicas: %v", err)
+	}
+
+	if s.mode == config.ModeMessages {
+		if err := s.loadDeliveries(); err != nil {
+			return nil, fmt.Errorf("loading deliveries: %v", err)
+		}
+	}
+	if err := s.loadDelayed(); err != nil {
+		return nil, fmt.Errorf("loading delayed messages: %v", err)
+	}
+
+	if s.durability == config.DurabilityInterval {
+		interval := time.Duration(cfg.SyncInterval)
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		go s.syncLoop(interval)
+	}
+	if cfg.HasRetention() {
+		go s.retentionLoop()
+	}
+	if cfg.Compression != "" {
+		go s.compressLoop()
+	}
+	if s.maxChunkAge > 0 {
+		go s.rolloverLoop()
+	}
+	if s.mode == config.ModeCompact {
+		go s.compactLoop()
+	}
+	go s.delayLoop()
 	return s, nil
 }
-func (c *OnDisk) initLastChunkIdx() error {
+
+// initLastChunkIdx finds the next chunk index for this instance and
+// returns the chunks of this instance and the name of the newest one.
+func (c *OnDisk) initLastChunkIdx() (ownChunks []string, newestChunk string, err error) {
 	files, err := os.ReadDir(c.dirname)
 	if err != nil {
-		return fmt.Errorf("ReadDir: %v", err)
+		return nil, "", fmt.Errorf("ReadDir: %v", err)
 	}
 	prefix := c.instanceName + "-"
 	// find the existing maximum index of chunks
@@ -75,17 +262,92 @@ func (c *OnDisk) initLastChunkIdx() error {
 		}
 		chunkIdx, err := strconv.Atoi(res[1])
 		if err != nil {
-			return fmt.Errorf("strconv.atoi(%s): %v", res[1], err)
+			return nil, "", fmt.Errorf("strconv.atoi(%s): %v", res[1], err)
 		}
+		ownChunks = append(ownChunks, file.Name())
 		// log.Printf("chunkIdx=%d", chunkIdx)
 		if uint64(chunkIdx)+1 > c.lastChunkIdx {
 			c.lastChunkIdx = uint64(chunkIdx) + 1
+			newestChunk = file.Name()
 		}
 	}
-	return err
+	return ownChunks, newestChunk, nil
+}
+
+// recoverLastChunk truncates the partially written message at the end of
+// the chunk, e.g. when the process died in the middle of Send, and makes
+// the chunk active again so that new messages are appended to it.
+func (c *OnDisk) recoverLastChunk(chunk string) error {
+	filename := filepath.Join(c.dirname, chunk)
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	valid, err := c.validSize(fp, size)
+	if err != nil {
+		return fmt.Errorf("scanning: %v", err)
+	}
+
+	if valid < size {
+		log.Printf("recovery: dropping %d bytes of incomplete messages at offset %d of chunk %q", size-valid, valid, chunk)
+		if err := os.Truncate(filename, valid); err != nil {
+			return fmt.Errorf("truncating: %v", err)
+		}
+	}
+
+	msgs, err := c.recoverIndex(chunk, fp, valid)
+	if err != nil {
+		return err
+	}
+
+	meta, crc, err := c.computeMeta(chunk)
+	if err != nil {
+		return err
+	}
+
+	c.lastChunk = chunk
+	c.lastChunkSize = uint64(valid)
+	c.lastChunkMsgs = msgs
+	c.lastChunkRecovered = true
+	// the creation time is lost, the last write is the closest thing to it
+	c.lastChunkCreated = fi.ModTime()
+	c.lastChunkCRC = crc
+	c.lastChunkFirstTime = meta.FirstTime
+	c.lastChunkLastTime = meta.LastTime
+	return nil
+}
+
+// validSize returns the size of the prefix of the chunk that only
+// contains complete messages.
+func (c *OnDisk) validSize(r io.ReaderAt, size int64) (int64, error) {
+	if c.format == protocol.FormatFramed {
+		rr := protocol.NewRecordReader(io.NewSectionReader(r, 0, size))
+		var valid int64
+		for {
+			_, n, err := rr.Next()
+			if err == io.EOF || errors.Is(err, protocol.ErrShortRecord) || errors.Is(err, protocol.ErrCorruptRecord) {
+				return valid, nil
+			} else if err != nil {
+				return 0, err
+			}
+			valid += int64(n)
+		}
+	}
+
+	// look for the last newline starting from the end of the chunk
+	return lastNewline(r, 0, size)
 }
 
-// WriteDirectly writes directly to the chunk files to avoid circular dependancy with replication
+// WriteDirectly writes directly to the chunk files to avoid circular dependancy with replication.
+// The contents are synced to disk before it returns, so that the replica can confirm them.
 func (s *OnDisk) WriteDirectly(chunk string, contents []byte) error {
 	fl := os.O_CREATE | os.O_WRONLY | os.O_APPEND
 
@@ -97,127 +359,521 @@ func (s *OnDisk) WriteDirectly(chunk string, contents []byte) error {
 
 	defer fp.Close()
 
-	_, err = fp.Write(contents)
-	return err
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(contents); err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		return err
+	}
+
+	// the index only speeds up the seeks, the chunk is fine without it
+	if err := s.indexReplicated(chunk, uint64(fi.Size()), contents, time.Now()); err != nil {
+		log.Printf("indexing replicated chunk %q failed: %v", chunk, err)
+	}
+	return nil
+}
+
+// SealDirectly marks the replicated chunk as complete once all of its
+// contents have been downloaded from the owner. The chunk is removed if
+// its contents do not match the checksum of the source so that it is
+// downloaded again.
+func (s *OnDisk) SealDirectly(chunk string, source protocol.ChunkMeta) error {
+	if err := checkChunkName(chunk); err != nil {
+		return err
+	}
+
+	// the seal must not get to the disk before the contents
+	if err := syncFile(s.chunkFilename(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("syncing chunk %q: %v", chunk, err)
+	}
+	h, size, err := s.chunkReader(chunk)
+	if err != nil {
+		return err
+	}
+	err = s.verifyChecksum(h, size, source)
+	h.Release()
+	if errors.Is(err, errChecksumMismatch) {
+		s.forgetHandles(chunk)
+		if err := os.Remove(s.chunkFilename(chunk)); err != nil {
+			return err
+		}
+		if err := os.Remove(s.indexFilename(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return fmt.Errorf("verifying chunk %q: %w", chunk, err)
+	} else if err != nil {
+		return fmt.Errorf("verifying chunk %q: %v", chunk, err)
+	}
+
+	if err := s.indexSealedReplica(chunk); err != nil {
+		log.Printf("indexing replicated chunk %q failed: %v", chunk, err)
+	}
+	if err := s.writeReplicaMeta(chunk, source); err != nil {
+		return err
+	}
+	if err := s.sealChunk(chunk); err != nil {
+		return err
+	}
+	s.forgetHandles(chunk)
+	return nil
+}
+
+// writeReplicaMeta writes the metadata of the source chunk,
+// or computes it if the source has none.
+func (s *OnDisk) writeReplicaMeta(chunk string, source protocol.ChunkMeta) error {
+	meta := source
+	if meta.Checksum == "" {
+		var err error
+		if meta, _, err = s.computeMeta(chunk); err != nil {
+			return err
+		}
+	}
+	return s.writeMeta(chunk, meta)
+}
+
+func (c *OnDisk) chunkFilename(chunk string) string {
+	return filepath.Join(c.dirname, chunk)
+}
+
+func (c *OnDisk) sealFilename(chunk string) string {
+	return filepath.Join(c.dirname, chunk+sealSuffix)
+}
+
+// sealChunk persists the fact that the chunk is complete. The marker and
+// its directory entry are synced, so a chunk that was reported as complete
+// stays complete after a power loss.
+func (c *OnDisk) sealChunk(chunk string) error {
+	fp, err := os.OpenFile(c.sealFilename(chunk), os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return syncDir(c.dirname)
+}
+
+// syncFile persists the contents of the file.
+func syncFile(filename string) error {
+	fp, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
+// syncDir persists the entries of the directory, e.g. a new file.
+func syncDir(dirname string) error {
+	d, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ChunkSealed reports whether the chunk is complete on this instance.
+func (c *OnDisk) ChunkSealed(chunk string) (bool, error) {
+	if err := checkChunkName(chunk); err != nil {
+		return false, err
+	}
+	return c.isSealed(chunk), nil
+}
+
+func (c *OnDisk) isSealed(chunk string) bool {
+	_, err := os.Stat(c.sealFilename(chunk))
+	return err == nil
+}
+
+// sealLastChunk flushes the active chunk to disk and seals it.
+// It must be called with writeMu held.
+func (c *OnDisk) sealLastChunk() error {
+	fp := c.lastChunkFp
+	if fp == nil {
+		// the recovered chunk was not written to after the restart
+		var err error
+		fp, err = openChunkFile(c.chunkFilename(c.lastChunk), false)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("syncing chunk %q: %v", c.lastChunk, err)
+	}
+	if err := c.writeMeta(c.lastChunk, c.activeMeta()); err != nil {
+		return err
+	}
+	if err := c.sealChunk(c.lastChunk); err != nil {
+		return fmt.Errorf("sealing chunk %q: %v", c.lastChunk, err)
+	}
+	return nil
+}
+
+// rollLastChunk seals the active chunk so that the next write creates
+// a new one. It must be called with writeMu held.
+func (c *OnDisk) rollLastChunk() error {
+	if err := c.sealLastChunk(); err != nil {
+		return err
+	}
+	// everything written so far is in the sealed chunk
+	c.markSynced(c.writtenBytes, nil)
+
+	c.closeIndex()
+	c.closeLastChunk()
+	// the next readers memory-map the sealed chunk
+	c.forgetHandles(c.lastChunk)
+	c.lastChunk = ""
+	c.lastChunkRecovered = false
+	return nil
+}
+
+// Format returns the format of the messages stored in the category.
+func (c *OnDisk) Format() protocol.Format {
+	return c.format
 }
 
 func (c *OnDisk) Send(ctx context.Context, msg []byte) error {
+	_, err := c.send(ctx, msg)
+	return err
+}
+
+// writePos is where a batch was written.
+type writePos struct {
+	// written is the total number of bytes written by the instance
+	// including the batch.
+	written uint64
+	chunk   string
+	// end is the offset right after the batch in the chunk.
+	end uint64
+}
+
+func (c *OnDisk) send(ctx context.Context, msg []byte) (writePos, error) {
 	// time.Sleep(time.Millisecond * 100)
+	msgs, err := c.countBatch(msg)
+	if err != nil {
+		return writePos{}, err
+	}
 
+	pos, err := c.append(ctx, msg, msgs)
+	if err != nil {
+		return writePos{}, err
+	}
+
+	if c.durability == config.DurabilityInterval {
+		return pos, c.waitForSync(pos.written)
+	}
+	return pos, nil
+}
+
+// countBatch returns the number of messages in the written batch.
+func (c *OnDisk) countBatch(msg []byte) (uint64, error) {
+	if c.format == protocol.FormatFramed {
+		// the chunks must only contain complete records so that the readers
+		// can always find the message boundaries
+		n, err := protocol.CountMessages(msg)
+		if err != nil {
+			return 0, fmt.Errorf("invalid records: %w", err)
+		}
+		return uint64(n), nil
+	}
+	return uint64(bytes.Count(msg, []byte{'\n'})), nil
+}
+
+// append writes msg that contains msgs messages to the active chunk and
+// returns where it was written.
+func (c *OnDisk) append(ctx context.Context, msg []byte, msgs uint64) (writePos, error) {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
-	if c.lastChunk == "" || (c.lastChunkSize+uint64(len(msg))) > maxFileChunkSize {
+	if c.lastChunk != "" && (c.lastChunkSize+uint64(len(msg)) > maxFileChunkSize || c.lastChunkExpired(time.Now())) {
+		if err := c.rollLastChunk(); err != nil {
+			return writePos{}, err
+		}
+	}
+	if err := c.openLastChunk(ctx); err != nil {
+		return writePos{}, err
+	}
+	fp := c.lastChunkFp
+
+	now := time.Now()
+	if c.format == protocol.FormatFramed {
+		// stamping under writeMu keeps the times in the order of
+		// the messages in the chunk and consistent with the index
+		stamped, err := protocol.StampMessages(c.stampBuf[:0], msg, now)
+		if err != nil {
+			return writePos{}, fmt.Errorf("invalid records: %w", err)
+		}
+		c.stampBuf = stamped
+		msg = stamped
+	}
+
+	off := c.lastChunkSize
+	if off == 0 {
+		c.lastChunkCreated = now
+	}
+	_, err := fp.Write(msg)
+	c.lastChunkSize += uint64(len(msg))
+	if err != nil {
+		return writePos{}, err
+	}
+	c.lastChunkCRC = crc32.Update(c.lastChunkCRC, crcTable, msg)
+	if c.lastChunkFirstTime.IsZero() {
+		c.lastChunkFirstTime = now
+	}
+	c.lastChunkLastTime = now
+	c.writtenBytes += uint64(len(msg))
+	c.indexBatch(off, now)
+	c.lastChunkMsgs += msgs
+
+	switch c.durability {
+	case config.DurabilityAlways:
+		if err := fp.Sync(); err != nil {
+			return writePos{}, fmt.Errorf("syncing chunk %q: %v", c.lastChunk, err)
+		}
+	case config.DurabilityInterval:
+		if c.syncBytes > 0 && c.writtenBytes-c.lastSyncRequest >= c.syncBytes {
+			c.lastSyncRequest = c.writtenBytes
+			select {
+			case c.syncNowCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return writePos{written: c.writtenBytes, chunk: c.lastChunk, end: c.lastChunkSize}, nil
+}
+
+// openLastChunk creates the active chunk if there is none and opens it.
+// It must be called with writeMu held.
+func (c *OnDisk) openLastChunk(ctx context.Context) error {
+	if c.lastChunk == "" {
 		c.lastChunk = fmt.Sprintf("%s-chunk%d", c.instanceName, c.lastChunkIdx)
 		c.lastChunkSize = 0
 		c.lastChunkIdx++
+		c.lastChunkRecovered = false
+		c.lastChunkMsgs = 0
+		c.lastIndexOff = 0
+		c.lastIndexTime = time.Time{}
+		c.lastChunkCRC = 0
+		c.lastChunkFirstTime = time.Time{}
 
 		if err := c.repl.BeforeCreatingChunk(ctx, c.category, c.lastChunk); err != nil {
 			log.Printf("found err %v", err)
 			return fmt.Errorf("before creating new chunk: %w", err)
 		}
 	}
-	fp, err := c.getFileDecriptor(c.lastChunk, true)
+	if c.lastChunkFp == nil {
+		var err error
+		if c.lastChunkRecovered {
+			c.lastChunkFp, err = reopenForAppend(c.chunkFilename(c.lastChunk))
+		} else {
+			c.lastChunkFp, err = openChunkFile(c.chunkFilename(c.lastChunk), true)
+		}
+		if err != nil {
+			return err
+		}
+		c.lastChunkRecovered = false
+	}
+	return nil
+}
 
-	if err != nil {
-		return err
+// waitForSync blocks until the first pos bytes written by the instance are on disk.
+func (c *OnDisk) waitForSync(pos uint64) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	for c.syncedBytes < pos && c.syncErr == nil {
+		c.syncCond.Wait()
+	}
+	return c.syncErr
+}
+
+func (c *OnDisk) markSynced(pos uint64, err error) {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	if err != nil && c.syncErr == nil {
+		c.syncErr = err
 	}
+	if pos > c.syncedBytes {
+		c.syncedBytes = pos
+	}
+	c.syncCond.Broadcast()
+}
 
-	_, err = fp.Write(msg)
-	c.lastChunkSize += uint64(len(msg))
-	return err
+// syncLoop performs the group fsync for the DurabilityInterval policy.
+func (c *OnDisk) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		case <-c.syncNowCh:
+		}
+
+		c.writeMu.Lock()
+		pos := c.writtenBytes
+		chunk := c.lastChunk
+		fp := c.lastChunkFp
+		c.writeMu.Unlock()
+
+		c.syncMu.Lock()
+		synced := c.syncedBytes
+		c.syncMu.Unlock()
+		if synced >= pos || fp == nil {
+			continue
+		}
+
+		// fp can be closed concurrently by the rollover,
+		// *os.File makes it safe to call Sync on it anyway
+		err := fp.Sync()
+		if err != nil && !c.isLastChunk(chunk) {
+			// the chunk was sealed and therefore synced in the meantime
+			err = nil
+		}
+		if err != nil {
+			log.Printf("syncing chunk %q failed: %v", chunk, err)
+			err = fmt.Errorf("syncing chunk %q: %v", chunk, err)
+		}
+		c.markSynced(pos, err)
+	}
 }
 
-func (c *OnDisk) getFileDecriptor(chunk string, write bool) (*os.File, error) {
-	c.fpsMu.Lock()
-	defer c.fpsMu.Unlock()
+// Close stops the background work of the storage.
+func (c *OnDisk) Close() error {
+	c.closeOnce.Do(func() { close(c.stopCh) })
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.closeIndex()
+	c.closeLastChunk()
+	c.handles.closeAll()
+	return nil
+}
 
-	fp, ok := c.fps[chunk]
-	if ok {
-		return fp, nil
+// closeLastChunk closes the descriptor of the active chunk.
+// It must be called with writeMu held.
+func (c *OnDisk) closeLastChunk() {
+	if c.lastChunkFp == nil {
+		return
 	}
+	c.lastChunkFp.Close()
+	c.lastChunkFp = nil
+}
 
+// openChunkFile opens the chunk for reading, or creates a new one for writing.
+func openChunkFile(filename string, write bool) (*os.File, error) {
 	fl := os.O_RDONLY
 	if write {
 		fl = os.O_CREATE | os.O_RDWR | os.O_EXCL
 	}
 
-	filename := filepath.Join(c.dirname, chunk)
 	fp, err := os.OpenFile(filename, fl, 0666)
 	if err != nil {
-		return nil, fmt.Errorf("Could not create chunk file %q: %s", filename, err)
+		return nil, fmt.Errorf("Could not create chunk file %q: %w", filename, err)
 	}
-
-	c.fps[chunk] = fp
 	return fp, nil
 }
 
-func (c *OnDisk) Recv(chunk string, off uint, maxSize uint, w io.Writer) error {
-	// time.Sleep(time.Millisecond * 100)
-	chunk = filepath.Clean(chunk)
-	_, err := os.Stat(filepath.Join(c.dirname, chunk))
+// reopenForAppend opens the existing chunk for writing at its end.
+func reopenForAppend(filename string) (*os.File, error) {
+	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND, 0666)
 	if err != nil {
-		return fmt.Errorf("stat %q: %w", chunk, err)
+		return nil, fmt.Errorf("Could not reopen chunk file %q: %s", filename, err)
 	}
+	return fp, nil
+}
+
+// rawChunk is the uncompressed chunk file.
+type rawChunk struct {
+	*os.File
+}
 
-	fp, err := c.getFileDecriptor(chunk, false)
+func (r rawChunk) Size() (int64, error) {
+	fi, err := r.Stat()
 	if err != nil {
-		return fmt.Errorf("getFileDecriptor(%q): %v", chunk, err)
+		return 0, err
 	}
-	buf := make([]byte, defaultBlockSize)
-	var alreadySendByte uint = 0
-	curOff := off
-	for {
+	return fi.Size(), nil
+}
 
-		n, err := fp.ReadAt(buf, int64(curOff))
-		// there is occaion: err== io.EOF but n != 0,
-		// which means it has read to the end but has data not sent
-		if n == 0 {
-			if err == io.EOF {
-				return nil
-			} else if err != nil {
-				return err
-			}
-		}
-		// log.Printf("alreadySendByte = %d,maxSize = %d", alreadySendByte, maxSize)
-		if alreadySendByte+uint(n) > maxSize {
-			toSend := maxSize - alreadySendByte
-			truncated, _, err := cutLast(buf[0:toSend])
-			if err == errSmallBuffer {
-				return nil
-			} else if err != nil {
-				return err
-			}
-			if _, err = w.Write(truncated); err != nil {
-				return err
-			}
-			// already send to maxSize return to main frame
-			return nil
+// chunkReader returns the handle to the uncompressed contents of the chunk
+// and its current size, regardless of whether the chunk is compressed.
+// The handle must be released after use.
+func (c *OnDisk) chunkReader(chunk string) (*chunkHandle, int64, error) {
+	if err := checkChunkName(chunk); err != nil {
+		return nil, 0, err
+	}
+
+	h, err := c.handles.acquire(chunk, func() (chunkReaderAt, error) {
+		fp, err := openChunkFile(c.chunkFilename(chunk), false)
+		if err != nil {
+			return nil, err
 		}
-		truncated, _, err := cutLast(buf[0:n])
-		if err == errSmallBuffer {
-			return nil
-		} else if err != nil {
-			return err
+		if c.isSealed(chunk) {
+			// sealed chunks never change so they can be scanned in memory
+			return mmapChunk(fp)
 		}
-		if _, err = w.Write(truncated); err != nil {
-			return err
+		return rawChunk{fp}, nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		h, err = c.handles.acquire(chunk+compressedSuffix, func() (chunkReaderAt, error) {
+			return openCompressedChunk(c.compressedFilename(chunk))
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, fmt.Errorf("stat %q: %w", chunk, err)
 		}
-		alreadySendByte += uint(len(truncated))
-		curOff += uint(len(truncated))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
 
+	size, err := h.Size()
+	if err != nil {
+		h.Release()
+		return nil, 0, err
 	}
+	return h, size, nil
+}
 
+// forgetHandles drops the cached handles of the chunk, e.g. when it is
+// deleted or compressed. The readers can still finish with their handles.
+func (c *OnDisk) forgetHandles(chunk string) {
+	c.handles.forget(chunk)
+	c.handles.forget(chunk + compressedSuffix)
 }
-func (c *OnDisk) forgetFileDescriptor(chunk string) {
-	c.fpsMu.Lock()
-	defer c.fpsMu.Unlock()
 
-	fp, ok := c.fps[chunk]
-	if !ok {
-		return
+// ChunkSize returns the size of the uncompressed contents of the chunk.
+func (c *OnDisk) ChunkSize(chunk string) (size int64, exists bool, err error) {
+	if err := checkChunkName(chunk); err != nil {
+		return 0, false, err
+	}
+
+	st, err := os.Stat(c.chunkFilename(chunk))
+	if err == nil {
+		return st.Size(), true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, false, err
+	}
+
+	sz, err := compressedSize(c.compressedFilename(chunk))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
 	}
-	fp.Close()
-	delete(c.fps, chunk)
+	return int64(sz), true, nil
 }
 func (c *OnDisk) ListChunks() ([]protocol.Chunk, error) {
 	var res []protocol.Chunk
@@ -227,20 +883,72 @@ func (c *OnDisk) ListChunks() ([]protocol.Chunk, error) {
 		return nil, err
 	}
 
+	names := make(map[string]bool, len(dis))
 	for _, di := range dis {
+		names[di.Name()] = true
+	}
+
+	// the chunks replaced by the compaction and the output
+	// of the unfinished compaction are not listed
+	replaces, replaced, err := c.compactionLogs(names)
+	if err != nil {
+		return nil, fmt.Errorf("reading compaction logs: %v", err)
+	}
+
+	c.writeMu.Lock()
+	activeChunk, activeMeta := c.lastChunk, c.activeMeta()
+	c.writeMu.Unlock()
+	// the checksum is only known once the chunk is complete
+	activeMeta.Checksum = ""
+
+	for _, di := range dis {
+		name := di.Name()
+		compressed := strings.HasSuffix(name, compressedSuffix)
+		if compressed {
+			name = strings.TrimSuffix(name, compressedSuffix)
+			// the original chunk is still there right after the compression
+			if names[name] {
+				continue
+			}
+		}
+		if !chunkNameRegexp.MatchString(name) {
+			continue
+		}
+		if replaced[name] || (names[name+uncommittedSuffix] && replaces[name] == nil) {
+			continue
+		}
+
 		fi, err := di.Info()
 		if errors.Is(err, os.ErrNotExist) {
 			continue
 		} else if err != nil {
 			return nil, fmt.Errorf("reading directory: %v", err)
 		}
-		c.writeMu.Lock()
 		ch := protocol.Chunk{
-			Name:     di.Name(),
-			Complete: (di.Name() != c.lastChunk),
+			Name:     name,
+			Complete: names[name+sealSuffix],
 			Size:     uint64(fi.Size()),
 		}
-		c.writeMu.Unlock()
+		if compressed {
+			size, err := compressedSize(filepath.Join(c.dirname, di.Name()))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			ch.Size = size
+			ch.Compressed = true
+			ch.CompressedSize = uint64(fi.Size())
+		}
+		ch.Replaces = replaces[name]
+
+		if name == activeChunk {
+			ch.ChunkMeta = activeMeta
+		} else if meta, err := c.readMeta(name); err != nil {
+			return nil, err
+		} else if meta != nil {
+			ch.ChunkMeta = *meta
+		}
 
 		res = append(res, ch)
 	}
@@ -254,22 +962,84 @@ func (s *OnDisk) isLastChunk(chunk string) bool {
 	return chunk == s.lastChunk
 }
 func (c *OnDisk) Ack(chunk string, size uint64) error {
+	if !c.mode.DeletesOnAck() {
+		// the chunks of log categories are only deleted by the retention
+		// policy and the compaction, the pubsub ones also by the subscribers
+		return nil
+	}
+
 	if c.isLastChunk(chunk) {
 		return fmt.Errorf("Could not delete incomplete chunk %q", chunk)
 	}
 
-	chunkFilename := filepath.Join(c.dirname, chunk)
+	return c.deleteChunk(chunk)
+}
+
+// deleteChunk removes the chunk and all its sidecar files
+// and calls the AfterDeletingChunk hook.
+func (c *OnDisk) deleteChunk(chunk string) error {
+	if err := c.removeChunkFiles(chunk); err != nil {
+		return err
+	}
 
-	_, err := os.Stat(chunkFilename)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteHookTimeout)
+	defer cancel()
+	if err := c.repl.AfterDeletingChunk(ctx, c.category, chunk); err != nil {
+		// the chunk is gone anyway
+		log.Printf("after deleting chunk %q of category %q: %v", chunk, c.category, err)
+	}
+	return nil
+}
+
+func (c *OnDisk) removeChunkFiles(chunk string) error {
+	if err := checkChunkName(chunk); err != nil {
+		return err
+	}
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	if _, exists, err := c.ChunkSize(chunk); err != nil {
 		return fmt.Errorf("stat %q: %w", chunk, err)
+	} else if !exists {
+		return fmt.Errorf("stat %q: %w", chunk, os.ErrNotExist)
 	}
 
-	if err := os.Remove(chunkFilename); err != nil {
+	if err := os.Remove(c.chunkFilename(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("removing %q: %v", chunk, err)
 	}
+	if err := c.removeSidecars(chunk); err != nil {
+		return err
+	}
+
+	c.forgetHandles(chunk)
+	return nil
+}
+
+// sidecarSuffixes are the suffixes of all files that belong to a chunk.
+var sidecarSuffixes = []string{
+	sealSuffix, indexSuffix, compressedSuffix, compressedSuffix + partSuffix,
+	replacesSuffix, uncommittedSuffix, partSuffix, metaSuffix,
+	failuresSuffix, failuresSuffix + partSuffix,
+}
+
+// checkChunkName makes sure that the chunk name does not point outside
+// of the category directory.
+func checkChunkName(chunk string) error {
+	if !chunkNameRegexp.MatchString(chunk) || strings.ContainsAny(chunk, `/\`) {
+		return fmt.Errorf("invalid chunk name %q", chunk)
+	}
+	return nil
+}
 
-	c.forgetFileDescriptor(chunk)
+func (c *OnDisk) removeSidecars(chunk string) error {
+	c.forgetMeta(chunk)
+	for _, suffix := range sidecarSuffixes {
+		err := os.Remove(filepath.Join(c.dirname, chunk+suffix))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing %q: %v", chunk+suffix, err)
+		}
+	}
 	return nil
 }
 
@@ -5,7 +5,12 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
 )
 
 func TestLastChunkIdx(t *testing.T) {
@@ -21,7 +26,128 @@ func TestLastChunkIdx(t *testing.T) {
 		t.Fatalf("last chunk index = %d, want %d", got, want)
 	}
 }
-func TestGetFileDescriptor(t *testing.T) {
+func TestRecoveryTruncatesTornWrite(t *testing.T) {
+	dir := getTempDir(t)
+
+	chunkPath := filepath.Join(dir, "moscow-chunk1")
+	if err := os.WriteFile(chunkPath, []byte("one\ntwo\nthr"), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	srv := testNewOnDisk(t, dir)
+
+	if err := srv.Send(context.Background(), []byte("four\n")); err != nil {
+		t.Fatalf("Write failed %v", err)
+	}
+
+	b, err := os.ReadFile(chunkPath)
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if got, want := string(b), "one\ntwo\nfour\n"; got != want {
+		t.Fatalf("chunk contents after recovery = %q, want %q", got, want)
+	}
+	if got, want := srv.lastChunkIdx, uint64(2); got != want {
+		t.Fatalf("last chunk index = %d, want %d", got, want)
+	}
+}
+
+func TestRecoveryTruncatesTornRecord(t *testing.T) {
+	dir := getTempDir(t)
+
+	valid := protocol.AppendRecord(nil, 0, []byte("one"))
+	torn := protocol.AppendRecord(append([]byte{}, valid...), 0, []byte("two"))
+	torn = torn[:len(torn)-1]
+
+	chunkPath := filepath.Join(dir, "moscow-chunk1")
+	if err := os.WriteFile(chunkPath, torn, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed})
+
+	st, err := os.Stat(chunkPath)
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if got, want := st.Size(), int64(len(valid)); got != want {
+		t.Fatalf("chunk size after recovery = %d, want %d", got, want)
+	}
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks failed %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Complete {
+		t.Fatalf("ListChunks() = %+v, want a single incomplete chunk", chunks)
+	}
+}
+
+func TestRecoveryRollsOverFullChunk(t *testing.T) {
+	dir := getTempDir(t)
+
+	// the recovered chunk has no room for the next batch
+	line := bytes.Repeat([]byte("a"), 1023)
+	line = append(line, '\n')
+	full := bytes.Repeat(line, maxFileChunkSize/len(line))
+	if err := os.WriteFile(filepath.Join(dir, "moscow-chunk1"), full, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	srv := testNewOnDisk(t, dir)
+
+	for _, msg := range []string{"one\n", "two\n"} {
+		if err := srv.Send(context.Background(), []byte(msg)); err != nil {
+			t.Fatalf("Send(%q) after recovery failed: %v", msg, err)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "moscow-chunk2"))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if got, want := string(b), "one\ntwo\n"; got != want {
+		t.Errorf("new chunk contents = %q, want %q", got, want)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "moscow-chunk1")); err != nil || fi.Size() != int64(len(full)) {
+		t.Errorf("Stat() of the recovered chunk = %v, %v; want it unchanged", fi, err)
+	}
+}
+
+func TestSealMarkers(t *testing.T) {
+	dir := getTempDir(t)
+
+	testCreateFile(t, filepath.Join(dir, "moscow-chunk1"))
+	testCreateFile(t, filepath.Join(dir, "moscow-chunk2"))
+	testCreateFile(t, filepath.Join(dir, "london-chunk1"))
+	srv := testNewOnDisk(t, dir)
+
+	if err := srv.SealDirectly("london-chunk1", protocol.ChunkMeta{}); err != nil {
+		t.Fatalf("SealDirectly() = %v, want no errors", err)
+	}
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks failed %v", err)
+	}
+
+	got := make(map[string]bool)
+	for _, ch := range chunks {
+		got[ch.Name] = ch.Complete
+	}
+	want := map[string]bool{
+		"london-chunk1": true,
+		"moscow-chunk1": true,
+		"moscow-chunk2": false,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ListChunks() = %+v, want %v", chunks, want)
+	}
+	for name, complete := range want {
+		if got[name] != complete {
+			t.Errorf("chunk %q complete = %v, want %v", name, got[name], complete)
+		}
+	}
+}
+
+func TestOpenChunkFile(t *testing.T) {
 	dir := getTempDir(t)
 
 	testCreateFile(t, filepath.Join(dir, "moscow-chunk1"))
@@ -59,8 +185,10 @@ func TestGetFileDescriptor(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			_, err := srv.getFileDecriptor(tc.filename, tc.write)
-			srv.forgetFileDescriptor(tc.filename)
+			fp, err := openChunkFile(srv.chunkFilename(tc.filename), tc.write)
+			if err == nil {
+				fp.Close()
+			}
 			if tc.wantErr && err == nil {
 				t.Fatalf("wanted error, got not error")
 			} else if !tc.wantErr && err != nil {
@@ -109,6 +237,161 @@ func TestReadWrite(t *testing.T) {
 	}
 
 }
+func TestReadWriteFramed(t *testing.T) {
+	srv := testNewOnDiskWithConfig(t, getTempDir(t), config.Category{Format: protocol.FormatFramed})
+
+	msgs := []string{"one", "two\nlines", "\x00binary"}
+	var batch []byte
+	for _, msg := range msgs {
+		batch = protocol.AppendRecord(batch, 0, []byte(msg))
+	}
+	before := time.Now()
+	if err := srv.Send(context.Background(), batch); err != nil {
+		t.Fatalf("Write failed %v", err)
+	}
+	after := time.Now()
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks failed %v", err)
+	}
+	chunk := chunks[0].Name
+	size := uint(chunks[0].Size)
+
+	var b bytes.Buffer
+	if err := srv.Recv(chunk, 0, size, &b); err != nil {
+		t.Fatalf("Read(%q)=%v, want no errors", chunk, err)
+	}
+	got, err := protocol.DecodeMessages(b.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeMessages(%q) = %v, want no errors", b.String(), err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("len(messages) = %d, want %d", len(got), len(msgs))
+	}
+	for i, m := range got {
+		if string(m.Value) != msgs[i] {
+			t.Errorf("message %d = %q, want %q", i, m.Value, msgs[i])
+		}
+		// the server stamps the messages with the time they were received
+		if m.Time.Before(before) || m.Time.After(after) {
+			t.Errorf("message %d time = %v, want between %v and %v", i, m.Time, before, after)
+		}
+	}
+
+	// the last record must not be cut in half
+	b.Reset()
+	if err := srv.Recv(chunk, 0, size-1, &b); err != nil {
+		t.Fatalf("Read(%q)=%v, want no errors", chunk, err)
+	}
+	recs, err := protocol.DecodeRecords(b.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeRecords(%q) = %v, want no errors", b.String(), err)
+	}
+	if got, want := len(recs), 2; got != want {
+		t.Fatalf("len(records) = %d, want %d", got, want)
+	}
+}
+
+func TestSendFramedRejectsInvalidRecords(t *testing.T) {
+	srv := testNewOnDiskWithConfig(t, getTempDir(t), config.Category{Format: protocol.FormatFramed})
+
+	if err := srv.Send(context.Background(), []byte("one\n")); err == nil {
+		t.Fatalf("Send(newline data) to a framed category: got no error, expected an error")
+	}
+	// a well-formed record with a malformed message
+	if err := srv.Send(context.Background(), protocol.AppendRecord(nil, protocol.FlagKey, []byte{10, 'k'})); err == nil {
+		t.Fatalf("Send(malformed message) to a framed category: got no error, expected an error")
+	}
+}
+
+func TestReadWriteMessages(t *testing.T) {
+	srv := testNewOnDiskWithConfig(t, getTempDir(t), config.Category{Format: protocol.FormatFramed})
+
+	msg := protocol.Message{
+		Key: []byte("user-1"),
+		Headers: []protocol.Header{
+			{Name: protocol.HeaderContentType, Value: []byte("application/json")},
+			{Name: protocol.HeaderTraceID, Value: []byte("trace")},
+		},
+		Value: []byte(`{"name":"bob"}`),
+	}
+	batch := protocol.AppendMessage(nil, msg)
+	batch = protocol.AppendMessage(batch, protocol.Message{Value: []byte("plain")})
+	if err := srv.Send(context.Background(), batch); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := srv.Recv(srv.lastChunk, 0, uint(srv.lastChunkSize), &b); err != nil {
+		t.Fatalf("Recv() failed: %v", err)
+	}
+	got, err := protocol.DecodeMessages(b.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeMessages() failed: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2", len(got))
+	}
+	if string(got[0].Key) != "user-1" || string(got[0].Value) != string(msg.Value) {
+		t.Errorf("message = %q: %q, want %q: %q", got[0].Key, got[0].Value, msg.Key, msg.Value)
+	}
+	if v, _ := got[0].Header(protocol.HeaderTraceID); string(v) != "trace" {
+		t.Errorf("trace ID = %q, want %q", v, "trace")
+	}
+	if got[1].Key != nil || string(got[1].Value) != "plain" {
+		t.Errorf("message = %q: %q, want no key and %q", got[1].Key, got[1].Value, "plain")
+	}
+}
+
+func TestDurability(t *testing.T) {
+	testCases := []struct {
+		desc string
+		cfg  config.Category
+	}{
+		{desc: "none", cfg: config.Category{Durability: config.DurabilityNone}},
+		{desc: "always", cfg: config.Category{Durability: config.DurabilityAlways}},
+		{desc: "interval", cfg: config.Category{Durability: config.DurabilityInterval}},
+		{desc: "bytes", cfg: config.Category{
+			Durability:   config.DurabilityInterval,
+			SyncInterval: config.Duration(time.Hour),
+			SyncBytes:    1,
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv := testNewOnDiskWithConfig(t, getTempDir(t), tc.cfg)
+
+			want := "one\ntwo\n"
+			if err := srv.Send(context.Background(), []byte(want)); err != nil {
+				t.Fatalf("Write failed %v", err)
+			}
+
+			if tc.cfg.Durability == config.DurabilityInterval {
+				srv.syncMu.Lock()
+				synced := srv.syncedBytes
+				srv.syncMu.Unlock()
+				if synced < uint64(len(want)) {
+					t.Errorf("synced bytes after Send = %d, want at least %d", synced, len(want))
+				}
+			}
+
+			chunks, err := srv.ListChunks()
+			if err != nil {
+				t.Fatalf("ListChunks failed %v", err)
+			}
+			var b bytes.Buffer
+			if err := srv.Recv(chunks[0].Name, 0, uint(len(want)), &b); err != nil {
+				t.Fatalf("Read(%q)=%v, want no errors", chunks[0].Name, err)
+			}
+			if b.String() != want {
+				t.Fatalf("Read(%q) = %q, want %q", chunks[0].Name, b.String(), want)
+			}
+		})
+	}
+}
+
 func TestAckOfTheLastChunk(t *testing.T) {
 	srv := testNewOnDisk(t, getTempDir(t))
 
@@ -138,6 +421,24 @@ func TestAckOfTheCompleteChunk(t *testing.T) {
 		t.Errorf("Ack(chunk1) = %v, expected no errors", err)
 	}
 }
+
+func TestAckCallsDeleteHook(t *testing.T) {
+	dir := getTempDir(t)
+	hooks := &recordingHooks{}
+	srv, err := NewOnDisk(dir, "numbers", "moscow", config.Category{}, hooks)
+	if err != nil {
+		t.Fatalf("NewOnDisk failed: %v", err)
+	}
+	defer srv.Close()
+	testCreateFile(t, filepath.Join(dir, "moscow-chunk1"))
+
+	if err := srv.Ack("moscow-chunk1", 10000); err != nil {
+		t.Fatalf("Ack(chunk1) = %v, expected no errors", err)
+	}
+	if want := []string{"moscow-chunk1"}; !reflect.DeepEqual(hooks.deleted, want) {
+		t.Errorf("AfterDeletingChunk() called for %v, want %v", hooks.deleted, want)
+	}
+}
 func getTempDir(t *testing.T) string {
 	t.Helper()
 	dir, err := os.MkdirTemp(os.TempDir(), "lastchunkidx")
@@ -154,13 +455,24 @@ func (s *nilHooks) BeforeCreatingChunk(ctx context.Context, category, filename s
 	return nil
 }
 
+func (s *nilHooks) AfterDeletingChunk(ctx context.Context, category, filename string) error {
+	return nil
+}
+
 func testNewOnDisk(t *testing.T, dir string) *OnDisk {
 	t.Helper()
 
-	srv, err := NewOnDisk(dir, "numbers", "moscow", &nilHooks{})
+	return testNewOnDiskWithConfig(t, dir, config.Category{})
+}
+
+func testNewOnDiskWithConfig(t *testing.T, dir string, cfg config.Category) *OnDisk {
+	t.Helper()
+
+	srv, err := NewOnDisk(dir, "numbers", "moscow", cfg, &nilHooks{})
 	if err != nil {
 		t.Fatalf("NewOnDisk failed: %v", err)
 	}
+	t.Cleanup(func() { srv.Close() })
 	return srv
 }
 func testCreateFile(t *testing.T, path string) {
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// The batches mimic the integration test workload:
+// newline-separated numbers sent in 1 MiB batches.
+const benchBatchSize = 1024 * 1024
+
+func benchBatch(size int) []byte {
+	buf := make([]byte, 0, size+16)
+	for i := 0; len(buf) < size; i++ {
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+var benchDurabilities = []struct {
+	name string
+	cfg  config.Category
+}{
+	{name: "none", cfg: config.Category{Durability: config.DurabilityNone}},
+	{name: "always", cfg: config.Category{Durability: config.DurabilityAlways}},
+	{name: "interval", cfg: config.Category{Durability: config.DurabilityInterval}},
+}
+
+func BenchmarkSend(b *testing.B) {
+	for _, d := range benchDurabilities {
+		b.Run(d.name, func(b *testing.B) {
+			srv := benchNewOnDisk(b, d.cfg)
+			batch := benchBatch(benchBatchSize)
+
+			b.SetBytes(int64(len(batch)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := srv.Send(context.Background(), batch); err != nil {
+					b.Fatalf("Send failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSendParallel shows the effect of the group fsync
+// with many small concurrent writes.
+func BenchmarkSendParallel(b *testing.B) {
+	for _, d := range benchDurabilities {
+		b.Run(d.name, func(b *testing.B) {
+			srv := benchNewOnDisk(b, d.cfg)
+			batch := benchBatch(4 * 1024)
+
+			b.SetBytes(int64(len(batch)))
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := srv.Send(context.Background(), batch); err != nil {
+						b.Errorf("Send failed: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func benchNewOnDisk(b *testing.B, cfg config.Category) *OnDisk {
+	b.Helper()
+
+	srv, err := NewOnDisk(b.TempDir(), "numbers", "moscow", cfg, &nilHooks{})
+	if err != nil {
+		b.Fatalf("NewOnDisk failed: %v", err)
+	}
+	b.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// benchSealedChunk writes a full sealed chunk of the integration workload.
+func benchSealedChunk(b *testing.B, srv *OnDisk) string {
+	b.Helper()
+
+	batch := benchBatch(benchBatchSize)
+	for i := 0; i < maxFileChunkSize/len(batch); i++ {
+		if err := srv.Send(context.Background(), batch); err != nil {
+			b.Fatalf("Send failed: %v", err)
+		}
+	}
+	chunk := srv.lastChunk
+	srv.writeMu.Lock()
+	defer srv.writeMu.Unlock()
+	if err := srv.rollLastChunk(); err != nil {
+		b.Fatalf("rollLastChunk failed: %v", err)
+	}
+	return chunk
+}
+
+// BenchmarkRecv reads a sealed chunk in the batches of the size
+// that the replication uses, run it with -benchmem.
+func BenchmarkRecv(b *testing.B) {
+	for _, format := range []protocol.Format{protocol.FormatNewline, protocol.FormatFramed} {
+		b.Run(format.String(), func(b *testing.B) {
+			srv := benchNewOnDisk(b, config.Category{Format: format})
+			var chunk string
+			if format == protocol.FormatFramed {
+				chunk = benchSealedFramedChunk(b, srv)
+			} else {
+				chunk = benchSealedChunk(b, srv)
+			}
+			const maxSize = 4 * 1024 * 1024
+
+			b.SetBytes(maxSize)
+			b.ReportAllocs()
+			var off uint
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := &countingWriter{w: io.Discard}
+				if err := srv.Recv(chunk, off, maxSize, w); err != nil {
+					b.Fatalf("Recv failed: %v", err)
+				}
+				// start over once the whole chunk was read
+				off += uint(w.n)
+				if w.n == 0 {
+					off = 0
+				}
+			}
+		})
+	}
+}
+
+func benchSealedFramedChunk(b *testing.B, srv *OnDisk) string {
+	b.Helper()
+
+	var batch []byte
+	for i := 0; len(batch) < benchBatchSize; i++ {
+		batch = protocol.AppendRecord(batch, 0, strconv.AppendInt(nil, int64(i), 10))
+	}
+	for i := 0; i < maxFileChunkSize/len(batch); i++ {
+		if err := srv.Send(context.Background(), batch); err != nil {
+			b.Fatalf("Send failed: %v", err)
+		}
+	}
+	chunk := srv.lastChunk
+	srv.writeMu.Lock()
+	defer srv.writeMu.Unlock()
+	if err := srv.rollLastChunk(); err != nil {
+		b.Fatalf("rollLastChunk failed: %v", err)
+	}
+	return chunk
+}
+
+// BenchmarkRecvStream reads a sealed chunk the way /read does.
+func BenchmarkRecvStream(b *testing.B) {
+	srv := benchNewOnDisk(b, config.Category{})
+	chunk := benchSealedChunk(b, srv)
+	const maxSize = 4 * 1024 * 1024
+
+	b.SetBytes(maxSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var off uint64
+	for i := 0; i < b.N; i++ {
+		r, n, err := srv.RecvStream(chunk, off, maxSize)
+		if err != nil {
+			b.Fatalf("RecvStream failed: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			b.Fatalf("Copy failed: %v", err)
+		}
+		r.Close()
+
+		off += uint64(n)
+		if n == 0 {
+			off = 0
+		}
+	}
+}
@@ -0,0 +1,633 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// compactInterval is how often the sealed chunks of the compacted
+// categories are rewritten.
+const compactInterval = time.Minute
+
+// replacedGracePeriod is how long the chunks replaced by the compaction
+// can still be read by the consumers that started reading them before.
+const replacedGracePeriod = 10 * time.Minute
+
+const defaultTombstoneRetention = 24 * time.Hour
+
+// The compaction writes its output into new chunks marked with
+// uncommittedSuffix which are hidden from ListChunks. The compaction is
+// committed by creating the replacesSuffix file next to the last output
+// chunk: it lists the output chunks with the "+" prefix and the replaced
+// chunks with the "-" prefix. From then on the replaced chunks are hidden
+// and the output chunks are listed.
+const (
+	uncommittedSuffix = ".uncommitted"
+	replacesSuffix    = ".replaces"
+)
+
+// compactLoop periodically compacts the sealed chunks of this instance.
+func (c *OnDisk) compactLoop() {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.compact(time.Now()); err != nil {
+			log.Printf("compacting category %q failed: %v", c.category, err)
+		}
+	}
+}
+
+// compactionLog is the contents of a replacesSuffix file.
+type compactionLog struct {
+	outputs  []string
+	replaced []string
+	// order is the position of the outputs among the chunks of the
+	// instance: the output chunks get new indexes, but their messages
+	// precede the messages of the chunks written during the compaction.
+	order uint64
+}
+
+func (c *OnDisk) replacesFilename(chunk string) string {
+	return c.chunkFilename(chunk) + replacesSuffix
+}
+
+func readCompactionLog(filename string) (compactionLog, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return compactionLog{}, err
+	}
+
+	var l compactionLog
+	for _, line := range strings.Split(string(b), "\n") {
+		switch {
+		case strings.HasPrefix(line, "+"):
+			l.outputs = append(l.outputs, line[1:])
+		case strings.HasPrefix(line, "-"):
+			l.replaced = append(l.replaced, line[1:])
+		case strings.HasPrefix(line, "="):
+			order, err := strconv.ParseUint(line[1:], 10, 64)
+			if err != nil {
+				return compactionLog{}, fmt.Errorf("parsing %q: %v", filename, err)
+			}
+			l.order = order
+		}
+	}
+	return l, nil
+}
+
+// writeCompactionLog atomically creates the replacesSuffix file of the chunk.
+func (c *OnDisk) writeCompactionLog(chunk string, l compactionLog) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "=%d\n", l.order)
+	for _, name := range l.outputs {
+		fmt.Fprintf(&b, "+%s\n", name)
+	}
+	for _, name := range l.replaced {
+		fmt.Fprintf(&b, "-%s\n", name)
+	}
+	return writeFileAtomically(c.replacesFilename(chunk), b.Bytes())
+}
+
+func writeFileAtomically(filename string, contents []byte) error {
+	tmpFilename := filename + partSuffix
+	fp, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	defer fp.Close()
+
+	if _, err := fp.Write(contents); err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// compactionLogs returns the chunks replaced by every committed output
+// chunk of the compactions and all replaced chunks.
+// names are the files in the directory.
+func (c *OnDisk) compactionLogs(names map[string]bool) (replaces map[string][]string, replaced map[string]bool, err error) {
+	replaces = make(map[string][]string)
+	replaced = make(map[string]bool)
+	for name := range names {
+		if !strings.HasSuffix(name, replacesSuffix) {
+			continue
+		}
+
+		l, err := readCompactionLog(c.chunkFilename(name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		for _, chunk := range l.replaced {
+			replaced[chunk] = true
+		}
+		for _, chunk := range l.outputs {
+			replaces[chunk] = l.replaced
+		}
+	}
+	return replaces, replaced, nil
+}
+
+// ReplaceDirectly records on the replica that the downloaded chunk is the
+// output of the compaction that replaced the provided chunks.
+func (c *OnDisk) ReplaceDirectly(chunk string, replaced []string) error {
+	if err := checkChunkName(chunk); err != nil {
+		return err
+	}
+	for _, name := range replaced {
+		if err := checkChunkName(name); err != nil {
+			return err
+		}
+	}
+	return c.writeCompactionLog(chunk, compactionLog{outputs: []string{chunk}, replaced: replaced})
+}
+
+// compact rewrites the sealed chunks of this instance so that only the
+// latest message of every key is kept. The messages without a key are
+// always kept and the tombstones are kept for tombstoneRetention.
+//
+// The output is written into new chunks which are replicated like the
+// chunks created by Send. The replaced chunks can still be read for
+// replacedGracePeriod so that the consumers that are in the middle of
+// them can finish.
+func (c *OnDisk) compact(now time.Time) error {
+	if err := c.deleteReplaced(now); err != nil {
+		return fmt.Errorf("deleting replaced chunks: %v", err)
+	}
+	if err := c.cleanupUncommitted(); err != nil {
+		return fmt.Errorf("cleaning up: %v", err)
+	}
+
+	chunks, order, err := c.compactionCandidates()
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	latest, drop, err := c.latestKeys(chunks, now)
+	if err != nil {
+		return err
+	}
+	if drop == 0 {
+		return nil
+	}
+
+	outputs, err := c.writeCompacted(chunks, latest, now)
+	if err != nil {
+		return err
+	}
+
+	if err := c.writeCompactionLog(outputs[len(outputs)-1], compactionLog{outputs: outputs, replaced: chunks, order: order}); err != nil {
+		return fmt.Errorf("committing: %v", err)
+	}
+	log.Printf("compacted %d chunks of category %q into %v dropping %d messages", len(chunks), c.category, outputs, drop)
+
+	for _, chunk := range outputs {
+		os.Remove(c.chunkFilename(chunk) + uncommittedSuffix)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.repl.BeforeCreatingChunk(ctx, c.category, chunk)
+		cancel()
+		if err != nil {
+			log.Printf("could not replicate the compacted chunk %q of category %q: %v", chunk, c.category, err)
+		}
+	}
+	return nil
+}
+
+// compactionCandidates returns the sealed chunks of this instance in the
+// order their messages were written and the position of the first one.
+func (c *OnDisk) compactionCandidates() (names []string, order uint64, err error) {
+	chunks, err := c.ListChunks()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type candidate struct {
+		name  string
+		idx   uint64
+		order uint64
+	}
+	var res []candidate
+	prefix := c.instanceName + "-"
+	for _, ch := range chunks {
+		if !ch.Complete || !strings.HasPrefix(ch.Name, prefix) {
+			continue
+		}
+		m := filenameRegexp.FindStringSubmatch(strings.TrimPrefix(ch.Name, prefix))
+		if m == nil {
+			continue
+		}
+		idx, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = append(res, candidate{name: ch.Name, idx: idx, order: idx})
+	}
+	if len(res) == 0 {
+		return nil, 0, nil
+	}
+
+	// the outputs of the previous compactions precede the chunks
+	// that were written during them
+	orders := make(map[string]uint64)
+	for _, cand := range res {
+		l, err := readCompactionLog(c.replacesFilename(cand.name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		for _, output := range l.outputs {
+			orders[output] = l.order
+		}
+	}
+	for i := range res {
+		if order, ok := orders[res[i].name]; ok {
+			res[i].order = order
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].order != res[j].order {
+			return res[i].order < res[j].order
+		}
+		return res[i].idx < res[j].idx
+	})
+	names = make([]string, 0, len(res))
+	for _, cand := range res {
+		names = append(names, cand.name)
+	}
+	return names, res[0].order, nil
+}
+
+// recordPos is the position of a record among the compacted chunks.
+type recordPos struct {
+	chunk int
+	off   int64
+}
+
+// forEachMessage calls fn for every message of the chunk.
+func (c *OnDisk) forEachMessage(chunk string, fn func(m protocol.Message, rec []byte, off int64) error) error {
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return err
+	}
+	defer h.Release()
+
+	rr := protocol.NewRecordReader(io.NewSectionReader(h, 0, size))
+	var off int64
+	var hdr []byte
+	for {
+		rec, n, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %q at offset %d: %v", chunk, off, err)
+		}
+
+		m, err := protocol.DecodeMessage(rec)
+		if err != nil {
+			return fmt.Errorf("reading %q at offset %d: %v", chunk, off, err)
+		}
+		hdr = protocol.AppendRecord(hdr[:0], rec.Flags, rec.Payload)
+		if err := fn(m, hdr, off); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+}
+
+// chunkModTime returns the modification time of the chunk file.
+func (c *OnDisk) chunkModTime(chunk string) (time.Time, error) {
+	fi, err := os.Stat(c.chunkFilename(chunk))
+	if errors.Is(err, os.ErrNotExist) {
+		fi, err = os.Stat(c.compressedFilename(chunk))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// tombstoneExpired reports whether the tombstones in the chunk with
+// the provided modification time can be dropped.
+func (c *OnDisk) tombstoneExpired(modTime time.Time, now time.Time) bool {
+	retention := c.tombstoneRetention
+	if retention <= 0 {
+		retention = defaultTombstoneRetention
+	}
+	return now.Sub(modTime) >= retention
+}
+
+// latestMessage is the latest message of a key.
+type latestMessage struct {
+	pos recordPos
+	// dropped is set for the tombstones that are older than tombstoneRetention.
+	dropped bool
+}
+
+// latestKeys returns the latest message of every key
+// and the number of messages the compaction would drop.
+func (c *OnDisk) latestKeys(chunks []string, now time.Time) (latest map[string]latestMessage, drop int, err error) {
+	latest = make(map[string]latestMessage)
+	for i, chunk := range chunks {
+		modTime, err := c.chunkModTime(chunk)
+		if err != nil {
+			return nil, 0, err
+		}
+		expired := c.tombstoneExpired(modTime, now)
+
+		err = c.forEachMessage(chunk, func(m protocol.Message, rec []byte, off int64) error {
+			if m.Key == nil {
+				return nil
+			}
+			if _, ok := latest[string(m.Key)]; ok {
+				drop++
+			}
+			latest[string(m.Key)] = latestMessage{
+				pos:     recordPos{chunk: i, off: off},
+				dropped: m.Tombstone && expired,
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	for _, l := range latest {
+		if l.dropped {
+			drop++
+		}
+	}
+	return latest, drop, nil
+}
+
+// writeCompacted writes the messages that survive the compaction into
+// new sealed chunks that are hidden until the compaction is committed.
+func (c *OnDisk) writeCompacted(chunks []string, latest map[string]latestMessage, now time.Time) ([]string, error) {
+	var outputs []string
+	var out *compactedChunk
+	defer func() {
+		if out != nil {
+			out.abort()
+		}
+	}()
+
+	for i, chunk := range chunks {
+		modTime, err := c.chunkModTime(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.forEachMessage(chunk, func(m protocol.Message, rec []byte, off int64) error {
+			if m.Key != nil {
+				l := latest[string(m.Key)]
+				if l.pos != (recordPos{chunk: i, off: off}) || l.dropped {
+					return nil
+				}
+			}
+
+			if out != nil && out.size+int64(len(rec)) > maxFileChunkSize {
+				if err := out.finish(); err != nil {
+					return err
+				}
+				outputs = append(outputs, out.name)
+				out = nil
+			}
+			if out == nil {
+				var err error
+				if out, err = c.newCompactedChunk(); err != nil {
+					return err
+				}
+			}
+			return out.write(rec, modTime)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// there must be an output chunk to commit the compaction even if
+	// all messages were dropped
+	if out == nil {
+		var err error
+		if out, err = c.newCompactedChunk(); err != nil {
+			return nil, err
+		}
+		out.modTime = now
+	}
+
+	if err := out.finish(); err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, out.name)
+	out = nil
+	return outputs, nil
+}
+
+// compactedChunk is an output chunk of the compaction being written.
+type compactedChunk struct {
+	c    *OnDisk
+	name string
+	fp   *os.File
+	w    *bufio.Writer
+	size int64
+	// modTime is the modification time of the newest replaced chunk
+	// that was written into the output, so that the retention and the
+	// tombstone expiration are not postponed by the compaction.
+	modTime time.Time
+}
+
+// newCompactedChunk reserves the name for the next chunk of this instance.
+func (c *OnDisk) newCompactedChunk() (*compactedChunk, error) {
+	c.writeMu.Lock()
+	name := fmt.Sprintf("%s-chunk%d", c.instanceName, c.lastChunkIdx)
+	c.lastChunkIdx++
+	c.writeMu.Unlock()
+
+	fp, err := os.OpenFile(c.chunkFilename(name)+partSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &compactedChunk{c: c, name: name, fp: fp, w: bufio.NewWriterSize(fp, 256*1024)}, nil
+}
+
+func (o *compactedChunk) write(rec []byte, modTime time.Time) error {
+	if modTime.After(o.modTime) {
+		o.modTime = modTime
+	}
+	o.size += int64(len(rec))
+	_, err := o.w.Write(rec)
+	return err
+}
+
+// finish makes the output chunk a sealed, but not yet committed, chunk.
+func (o *compactedChunk) finish() error {
+	if err := o.w.Flush(); err != nil {
+		return err
+	}
+	if err := o.fp.Sync(); err != nil {
+		return err
+	}
+	if err := o.fp.Close(); err != nil {
+		return err
+	}
+
+	filename := o.c.chunkFilename(o.name)
+	if err := o.writeMeta(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(filename+partSuffix, o.modTime, o.modTime); err != nil {
+		return err
+	}
+	// the markers are created before the chunk appears
+	// so that it is never visible before the commit
+	if err := os.WriteFile(filename+uncommittedSuffix, nil, 0666); err != nil {
+		return err
+	}
+	if err := o.c.sealChunk(o.name); err != nil {
+		return err
+	}
+	return os.Rename(filename+partSuffix, filename)
+}
+
+// writeMeta writes the metadata of the output chunk.
+func (o *compactedChunk) writeMeta() error {
+	fp, err := os.Open(o.c.chunkFilename(o.name) + partSuffix)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	meta, _, err := o.c.scanMeta(fp, o.size)
+	if err != nil {
+		return fmt.Errorf("scanning %q: %v", o.name, err)
+	}
+	meta.Owner = o.c.instanceName
+	meta.Created = time.Now()
+	return o.c.writeMeta(o.name, meta)
+}
+
+func (o *compactedChunk) abort() {
+	o.fp.Close()
+	os.Remove(o.c.chunkFilename(o.name) + partSuffix)
+}
+
+// cleanupUncommitted removes the output chunks of the compactions that
+// crashed before the commit and the markers of the committed ones.
+func (c *OnDisk) cleanupUncommitted() error {
+	dis, err := os.ReadDir(c.dirname)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(dis))
+	for _, di := range dis {
+		names[di.Name()] = true
+	}
+	replaces, _, err := c.compactionLogs(names)
+	if err != nil {
+		return err
+	}
+
+	for name := range names {
+		// the output that was being written when the compaction crashed
+		if chunk := strings.TrimSuffix(name, partSuffix); chunk != name && chunkNameRegexp.MatchString(chunk) {
+			if err := os.Remove(c.chunkFilename(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(name, uncommittedSuffix) {
+			continue
+		}
+		chunk := strings.TrimSuffix(name, uncommittedSuffix)
+		if replaces[chunk] != nil {
+			os.Remove(c.chunkFilename(name))
+			continue
+		}
+
+		log.Printf("removing the output of the interrupted compaction %q", chunk)
+		if err := os.Remove(c.chunkFilename(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := c.removeSidecars(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteReplaced deletes the chunks that were replaced by the compaction
+// more than replacedGracePeriod ago.
+func (c *OnDisk) deleteReplaced(now time.Time) error {
+	dis, err := os.ReadDir(c.dirname)
+	if err != nil {
+		return err
+	}
+
+	for _, di := range dis {
+		if !strings.HasSuffix(di.Name(), replacesSuffix) {
+			continue
+		}
+		fi, err := di.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if now.Sub(fi.ModTime()) < replacedGracePeriod {
+			continue
+		}
+
+		l, err := readCompactionLog(c.chunkFilename(di.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, chunk := range l.replaced {
+			if _, exists, err := c.ChunkSize(chunk); err != nil {
+				return err
+			} else if !exists {
+				continue
+			}
+			if err := c.deleteChunk(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
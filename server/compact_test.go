@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+var testCompactConfig = config.Category{Format: protocol.FormatFramed, Mode: config.ModeCompact}
+
+func testCreateMessagesChunk(t *testing.T, dir, name string, modTime time.Time, msgs ...protocol.Message) {
+	t.Helper()
+
+	var b []byte
+	for _, m := range msgs {
+		b = protocol.AppendMessage(b, m)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes() failed: %v", err)
+	}
+	testCreateFile(t, path+sealSuffix)
+}
+
+func testMsg(key, value string) protocol.Message {
+	m := protocol.Message{Value: []byte(value)}
+	if key != "" {
+		m.Key = []byte(key)
+	}
+	return m
+}
+
+func testTombstone(key string) protocol.Message {
+	return protocol.Message{Key: []byte(key), Tombstone: true}
+}
+
+// testChunkMessages returns the messages of the chunk as "key=value"
+// or "key deleted" strings.
+func testChunkMessages(t *testing.T, srv *OnDisk, chunk string) []string {
+	t.Helper()
+
+	var res []string
+	err := srv.forEachMessage(chunk, func(m protocol.Message, rec []byte, off int64) error {
+		if m.Tombstone {
+			res = append(res, string(m.Key)+" deleted")
+		} else {
+			res = append(res, string(m.Key)+"="+string(m.Value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading %q failed: %v", chunk, err)
+	}
+	return res
+}
+
+func testCompact(t *testing.T, srv *OnDisk, now time.Time) {
+	t.Helper()
+
+	if err := srv.compact(now); err != nil {
+		t.Fatalf("compact() failed: %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := getTempDir(t)
+	now := time.Now()
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", now.Add(-2*time.Hour),
+		testMsg("a", "1"), testMsg("b", "1"), testMsg("", "x"))
+	testCreateMessagesChunk(t, dir, "moscow-chunk2", now.Add(-time.Hour),
+		testMsg("a", "2"), testTombstone("b"), testMsg("c", "1"))
+
+	srv := testNewOnDiskWithConfig(t, dir, testCompactConfig)
+	testCompact(t, srv, now)
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Name != "moscow-chunk3" || !chunks[0].Complete {
+		t.Fatalf("ListChunks() = %+v, want only the complete moscow-chunk3", chunks)
+	}
+	if got, want := chunks[0].Replaces, []string{"moscow-chunk1", "moscow-chunk2"}; !equalStrings(got, want) {
+		t.Errorf("Replaces = %v, want %v", got, want)
+	}
+	if got, want := testChunkMessages(t, srv, "moscow-chunk3"), []string{"=x", "a=2", "b deleted", "c=1"}; !equalStrings(got, want) {
+		t.Errorf("compacted messages = %v, want %v", got, want)
+	}
+
+	// the consumers that are reading the replaced chunks can finish
+	if got, want := testChunkMessages(t, srv, "moscow-chunk1"), []string{"a=1", "b=1", "=x"}; !equalStrings(got, want) {
+		t.Errorf("replaced chunk messages = %v, want %v", got, want)
+	}
+
+	// nothing to compact, but the replaced chunks are deleted after the grace period
+	testCompact(t, srv, now.Add(replacedGracePeriod+time.Minute))
+	for _, chunk := range []string{"moscow-chunk1", "moscow-chunk2"} {
+		if _, exists, err := srv.ChunkSize(chunk); err != nil || exists {
+			t.Errorf("ChunkSize(%q) = %v, %v, want the chunk to be deleted", chunk, exists, err)
+		}
+	}
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk3"}; !equalStrings(got, want) {
+		t.Errorf("ListChunks() = %v, want %v", got, want)
+	}
+
+	// the tombstone is dropped once it is older than the retention
+	testCompact(t, srv, now.Add(defaultTombstoneRetention))
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk4"}; !equalStrings(got, want) {
+		t.Fatalf("ListChunks() = %v, want %v", got, want)
+	}
+	if got, want := testChunkMessages(t, srv, "moscow-chunk4"), []string{"=x", "a=2", "c=1"}; !equalStrings(got, want) {
+		t.Errorf("compacted messages = %v, want %v", got, want)
+	}
+}
+
+func TestCompactKeepsOrderWithActiveChunk(t *testing.T) {
+	dir := getTempDir(t)
+	now := time.Now()
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", now.Add(-time.Hour),
+		testMsg("a", "1"), testMsg("a", "2"))
+
+	srv := testNewOnDiskWithConfig(t, dir, testCompactConfig)
+	// written to moscow-chunk2 while the compaction writes moscow-chunk3
+	if err := srv.Send(context.Background(), protocol.AppendMessage(nil, testMsg("a", "3"))); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	testCompact(t, srv, now)
+
+	srv.writeMu.Lock()
+	err := srv.rollLastChunk()
+	srv.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("rollLastChunk() failed: %v", err)
+	}
+
+	testCompact(t, srv, now)
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("ListChunks() = %+v, want one chunk", chunks)
+	}
+	if got, want := testChunkMessages(t, srv, chunks[0].Name), []string{"a=3"}; !equalStrings(got, want) {
+		t.Errorf("compacted messages = %v, want %v", got, want)
+	}
+}
+
+func TestCompactCleansUpUncommitted(t *testing.T) {
+	dir := getTempDir(t)
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", time.Now(), testMsg("a", "1"))
+	testCreateMessagesChunk(t, dir, "moscow-chunk2", time.Now(), testMsg("a", "1"))
+	// the output of the compaction that crashed before the commit
+	testCreateFile(t, filepath.Join(dir, "moscow-chunk2"+uncommittedSuffix))
+	testCreateFile(t, filepath.Join(dir, "moscow-chunk3"+partSuffix))
+
+	srv := testNewOnDiskWithConfig(t, dir, testCompactConfig)
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk1"}; !equalStrings(got, want) {
+		t.Errorf("ListChunks() = %v, want %v", got, want)
+	}
+
+	if err := srv.cleanupUncommitted(); err != nil {
+		t.Fatalf("cleanupUncommitted() failed: %v", err)
+	}
+	for _, name := range []string{"moscow-chunk2", "moscow-chunk2" + sealSuffix, "moscow-chunk2" + uncommittedSuffix, "moscow-chunk3" + partSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%q must be removed, got %v", name, err)
+		}
+	}
+}
+
+func TestReplaceDirectly(t *testing.T) {
+	dir := getTempDir(t)
+	testCreateMessagesChunk(t, dir, "kazan-chunk1", time.Now(), testMsg("a", "1"))
+	testCreateMessagesChunk(t, dir, "kazan-chunk2", time.Now(), testMsg("a", "2"))
+
+	srv := testNewOnDiskWithConfig(t, dir, testCompactConfig)
+	if err := srv.ReplaceDirectly("kazan-chunk2", []string{"kazan-chunk1"}); err != nil {
+		t.Fatalf("ReplaceDirectly() failed: %v", err)
+	}
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Name != "kazan-chunk2" || !equalStrings(chunks[0].Replaces, []string{"kazan-chunk1"}) {
+		t.Errorf("ListChunks() = %+v, want kazan-chunk2 replacing kazan-chunk1", chunks)
+	}
+
+	if err := srv.ReplaceDirectly("kazan-chunk2", []string{"../secret-chunk1"}); err == nil {
+		t.Errorf("ReplaceDirectly() with an invalid chunk name = nil, want an error")
+	}
+}
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// compressedSuffix is the suffix of the compressed sealed chunk.
+// The compressed chunk replaces the original one.
+const compressedSuffix = ".z"
+
+// partSuffix is the suffix of the compressed chunk that is being downloaded
+// from the owner by replication and is not visible yet.
+const partSuffix = ".part"
+
+// compressInterval is how often the sealed chunks are checked for compression.
+const compressInterval = 10 * time.Second
+
+// compressBlockSize is the size of the uncompressed blocks that are compressed
+// independently so that the readers do not need to decompress the whole chunk.
+const compressBlockSize = 1024 * 1024
+
+// The compressed chunk consists of the compressed blocks followed by the
+// table with the offsets of the blocks (uint64 each) and the trailer:
+//
+//	magic       [4]byte
+//	codec       uint8
+//	reserved    [3]byte
+//	blockSize   uint32
+//	numBlocks   uint32
+//	size        uint64 - the size of the uncompressed contents
+//	tableOffset uint64
+const compressedTrailerSize = 32
+
+var compressedMagic = []byte("GQZ1")
+
+const (
+	codecGzip   = 1
+	codecBrotli = 2
+)
+
+func codecFor(c config.Compression) (byte, error) {
+	switch c {
+	case config.CompressionGzip:
+		return codecGzip, nil
+	case config.CompressionBrotli:
+		return codecBrotli, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q", c)
+}
+
+func newCompressor(codec byte, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case codecGzip:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case codecBrotli:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	}
+	return nil, fmt.Errorf("unknown codec %d", codec)
+}
+
+func newDecompressor(codec byte, r io.Reader) (io.Reader, error) {
+	switch codec {
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecBrotli:
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown codec %d", codec)
+}
+
+func (c *OnDisk) compressedFilename(chunk string) string {
+	return c.chunkFilename(chunk) + compressedSuffix
+}
+
+// compressLoop compresses the sealed chunks in the background.
+func (c *OnDisk) compressLoop() {
+	ticker := time.NewTicker(compressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.compressSealed(); err != nil {
+			log.Printf("compressing chunks of category %q failed: %v", c.category, err)
+		}
+	}
+}
+
+// compressSealed compresses all sealed chunks that are not compressed yet.
+func (c *OnDisk) compressSealed() error {
+	chunks, err := c.ListChunks()
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range chunks {
+		if !ch.Complete || ch.Compressed {
+			continue
+		}
+		if err := c.compressChunk(ch.Name); err != nil {
+			return fmt.Errorf("compressing %q: %v", ch.Name, err)
+		}
+	}
+	return nil
+}
+
+// compressChunk replaces the sealed chunk with its compressed version.
+func (c *OnDisk) compressChunk(chunk string) error {
+	codec, err := codecFor(c.compression)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(c.chunkFilename(chunk))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := c.compressedFilename(chunk) + partSuffix
+	dst, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	defer dst.Close()
+
+	cw := &countingWriter{w: dst}
+	var offsets []uint64
+	for off := int64(0); off < fi.Size(); off += compressBlockSize {
+		offsets = append(offsets, cw.n)
+
+		zw, err := newCompressor(codec, cw)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(zw, io.NewSectionReader(src, off, compressBlockSize)); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCompressedTrailer(cw, codec, offsets, uint64(fi.Size())); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// the retention policy relies on the modification time of the chunk
+	if err := os.Chtimes(tmpFilename, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	if ok, err := c.commitCompressed(chunk, tmpFilename); err != nil || !ok {
+		return err
+	}
+
+	st, err := os.Stat(c.compressedFilename(chunk))
+	if err == nil {
+		log.Printf("compressed chunk %q of category %q: %d -> %d bytes", chunk, c.category, fi.Size(), st.Size())
+	}
+	return nil
+}
+
+// commitCompressed replaces the chunk with its compressed version. It returns
+// false if the chunk was deleted while it was compressed, e.g. by the
+// retention policy, so that the compressed version does not bring it back.
+func (c *OnDisk) commitCompressed(chunk, tmpFilename string) (bool, error) {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	if _, err := os.Stat(c.chunkFilename(chunk)); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpFilename, c.compressedFilename(chunk)); err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(c.chunkFilename(chunk)); err != nil {
+		return false, err
+	}
+	c.forgetHandles(chunk)
+	return true, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += uint64(n)
+	return n, err
+}
+
+func writeCompressedTrailer(cw *countingWriter, codec byte, offsets []uint64, size uint64) error {
+	tableOffset := cw.n
+
+	buf := make([]byte, len(offsets)*8+compressedTrailerSize)
+	for i, off := range offsets {
+		binary.BigEndian.PutUint64(buf[i*8:], off)
+	}
+	trailer := buf[len(offsets)*8:]
+	copy(trailer[0:4], compressedMagic)
+	trailer[4] = codec
+	binary.BigEndian.PutUint32(trailer[8:12], compressBlockSize)
+	binary.BigEndian.PutUint32(trailer[12:16], uint32(len(offsets)))
+	binary.BigEndian.PutUint64(trailer[16:24], size)
+	binary.BigEndian.PutUint64(trailer[24:32], tableOffset)
+
+	_, err := cw.Write(buf)
+	return err
+}
+
+// compressedChunk reads the uncompressed contents of the compressed chunk.
+type compressedChunk struct {
+	fp        *os.File
+	codec     byte
+	blockSize int64
+	size      int64
+	// offsets of the compressed blocks, the last one is the table offset
+	offsets []uint64
+
+	mu          sync.Mutex
+	cachedBlock int
+	cached      []byte
+}
+
+func openCompressedChunk(filename string) (*compressedChunk, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := readCompressedTrailer(fp)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("reading %q: %v", filename, err)
+	}
+	return cc, nil
+}
+
+func readCompressedTrailer(fp *os.File) (*compressedChunk, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < compressedTrailerSize {
+		return nil, errors.New("the compressed chunk is too small")
+	}
+
+	trailer := make([]byte, compressedTrailerSize)
+	if _, err := fp.ReadAt(trailer, fi.Size()-compressedTrailerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[0:4], compressedMagic) {
+		return nil, errors.New("invalid magic of the compressed chunk")
+	}
+
+	numBlocks := binary.BigEndian.Uint32(trailer[12:16])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+	if tableOffset+uint64(numBlocks)*8+compressedTrailerSize != uint64(fi.Size()) {
+		return nil, errors.New("invalid block table of the compressed chunk")
+	}
+
+	table := make([]byte, numBlocks*8)
+	if _, err := fp.ReadAt(table, int64(tableOffset)); err != nil {
+		return nil, err
+	}
+
+	cc := &compressedChunk{
+		fp:          fp,
+		codec:       trailer[4],
+		blockSize:   int64(binary.BigEndian.Uint32(trailer[8:12])),
+		size:        int64(binary.BigEndian.Uint64(trailer[16:24])),
+		cachedBlock: -1,
+	}
+	for i := 0; i < int(numBlocks); i++ {
+		cc.offsets = append(cc.offsets, binary.BigEndian.Uint64(table[i*8:i*8+8]))
+	}
+	cc.offsets = append(cc.offsets, tableOffset)
+	return cc, nil
+}
+
+// block returns the uncompressed contents of the block.
+// It must be called with mu held.
+func (cc *compressedChunk) block(idx int) ([]byte, error) {
+	if cc.cachedBlock == idx {
+		return cc.cached, nil
+	}
+
+	start, end := cc.offsets[idx], cc.offsets[idx+1]
+	zr, err := newDecompressor(cc.codec, io.NewSectionReader(cc.fp, int64(start), int64(end-start)))
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.Grow(int(cc.blockSize))
+	if _, err := io.Copy(&b, zr); err != nil {
+		return nil, fmt.Errorf("decompressing block %d: %v", idx, err)
+	}
+
+	cc.cachedBlock = idx
+	cc.cached = b.Bytes()
+	return cc.cached, nil
+}
+
+func (cc *compressedChunk) ReadAt(p []byte, off int64) (int, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	var n int
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= cc.size {
+			return n, io.EOF
+		}
+
+		idx := int(cur / cc.blockSize)
+		b, err := cc.block(idx)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], b[cur-int64(idx)*cc.blockSize:])
+	}
+	return n, nil
+}
+
+// Size returns the size of the uncompressed contents.
+func (cc *compressedChunk) Size() (int64, error) {
+	return cc.size, nil
+}
+
+func (cc *compressedChunk) Close() error {
+	return cc.fp.Close()
+}
+
+// compressedSize returns the uncompressed size of the compressed chunk.
+func compressedSize(filename string) (uint64, error) {
+	cc, err := openCompressedChunk(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer cc.Close()
+	return uint64(cc.size), nil
+}
+
+// RecvCompressed writes the raw contents of the compressed chunk
+// starting from off so that it can be replicated as-is.
+func (c *OnDisk) RecvCompressed(chunk string, off uint64, maxSize uint64, w io.Writer) error {
+	if err := checkChunkName(chunk); err != nil {
+		return err
+	}
+
+	fp, err := os.Open(c.compressedFilename(chunk))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(fp, int64(off), int64(maxSize)))
+	return err
+}
+
+// CompressedPartSize returns the size of the compressed chunk
+// that is being downloaded by replication.
+func (c *OnDisk) CompressedPartSize(chunk string) (int64, error) {
+	if err := checkChunkName(chunk); err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(c.compressedFilename(chunk) + partSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// WriteCompressedDirectly appends to the compressed chunk
+// that is being downloaded by replication.
+func (c *OnDisk) WriteCompressedDirectly(chunk string, contents []byte) error {
+	if err := checkChunkName(chunk); err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(c.compressedFilename(chunk)+partSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = fp.Write(contents)
+	return err
+}
+
+// SealCompressedDirectly makes the fully downloaded compressed chunk visible.
+func (c *OnDisk) SealCompressedDirectly(chunk string, source protocol.ChunkMeta) error {
+	if err := checkChunkName(chunk); err != nil {
+		return err
+	}
+
+	partFilename := c.compressedFilename(chunk) + partSuffix
+	cc, err := openCompressedChunk(partFilename)
+	if err != nil {
+		return fmt.Errorf("validating the downloaded chunk: %v", err)
+	}
+	err = c.verifyChecksum(cc, cc.size, source)
+	cc.Close()
+	if errors.Is(err, errChecksumMismatch) {
+		if err := os.Remove(partFilename); err != nil {
+			return err
+		}
+		return fmt.Errorf("verifying chunk %q: %w", chunk, err)
+	} else if err != nil {
+		return fmt.Errorf("verifying chunk %q: %v", chunk, err)
+	}
+
+	if err := syncFile(partFilename); err != nil {
+		return fmt.Errorf("syncing chunk %q: %v", chunk, err)
+	}
+	if err := os.Rename(partFilename, c.compressedFilename(chunk)); err != nil {
+		return err
+	}
+
+	// an empty chunk could have been created before the owner compressed it
+	if err := os.Remove(c.chunkFilename(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	c.forgetHandles(chunk)
+	if err := c.indexSealedReplica(chunk); err != nil {
+		log.Printf("indexing replicated chunk %q failed: %v", chunk, err)
+	}
+	if err := c.writeReplicaMeta(chunk, source); err != nil {
+		return err
+	}
+	return c.sealChunk(chunk)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+func testCompressedContents() []byte {
+	var b bytes.Buffer
+	// more than one compression block so that reads cross block boundaries
+	for i := 0; b.Len() < compressBlockSize*2+1000; i++ {
+		fmt.Fprintf(&b, "message number %d with some log-shaped payload\n", i)
+	}
+	return b.Bytes()
+}
+
+func TestCompressSealedChunks(t *testing.T) {
+	for _, compression := range []config.Compression{config.CompressionGzip, config.CompressionBrotli} {
+		t.Run(string(compression), func(t *testing.T) {
+			dir := getTempDir(t)
+			want := testCompressedContents()
+			if err := os.WriteFile(dir+"/moscow-chunk1", want, 0666); err != nil {
+				t.Fatalf("WriteFile() failed: %v", err)
+			}
+			testCreateFile(t, dir+"/moscow-chunk1"+sealSuffix)
+
+			srv := testNewOnDiskWithConfig(t, dir, config.Category{Compression: compression})
+			if err := srv.compressSealed(); err != nil {
+				t.Fatalf("compressSealed() failed: %v", err)
+			}
+
+			if _, err := os.Stat(dir + "/moscow-chunk1"); !os.IsNotExist(err) {
+				t.Errorf("the original chunk must be removed after compression, got %v", err)
+			}
+
+			chunks, err := srv.ListChunks()
+			if err != nil {
+				t.Fatalf("ListChunks() failed: %v", err)
+			}
+			if len(chunks) != 1 {
+				t.Fatalf("ListChunks() = %+v, want one chunk", chunks)
+			}
+			ch := chunks[0]
+			if ch.Name != "moscow-chunk1" || !ch.Complete || !ch.Compressed || ch.Size != uint64(len(want)) {
+				t.Errorf("ListChunks() = %+v, want complete compressed moscow-chunk1 of size %d", ch, len(want))
+			}
+			if ch.CompressedSize == 0 || ch.CompressedSize >= ch.Size {
+				t.Errorf("CompressedSize = %d, want less than %d", ch.CompressedSize, ch.Size)
+			}
+
+			var b bytes.Buffer
+			for off := 0; off < len(want); {
+				before := b.Len()
+				if err := srv.Recv("moscow-chunk1", uint(off), uint(len(want)), &b); err != nil {
+					t.Fatalf("Recv(%d) failed: %v", off, err)
+				}
+				off += b.Len() - before
+			}
+			if !bytes.Equal(b.Bytes(), want) {
+				t.Errorf("Recv() returned different contents after compression")
+			}
+
+			off, err := srv.MessageOffset("moscow-chunk1", 20000)
+			if err != nil {
+				t.Fatalf("MessageOffset() failed: %v", err)
+			}
+			wantOff := 0
+			for i := 0; i < 20000; i++ {
+				wantOff += bytes.IndexByte(want[wantOff:], '\n') + 1
+			}
+			if off != uint64(wantOff) {
+				t.Errorf("MessageOffset() = %d, want %d", off, wantOff)
+			}
+		})
+	}
+}
+
+func TestReplicateCompressedChunk(t *testing.T) {
+	srcDir := getTempDir(t)
+	want := testCompressedContents()
+	if err := os.WriteFile(srcDir+"/moscow-chunk1", want, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	testCreateFile(t, srcDir+"/moscow-chunk1"+sealSuffix)
+
+	src := testNewOnDiskWithConfig(t, srcDir, config.Category{Compression: config.CompressionGzip})
+	if err := src.compressSealed(); err != nil {
+		t.Fatalf("compressSealed() failed: %v", err)
+	}
+
+	// the chunk was sealed before the metadata was recorded
+	meta, _, err := src.computeMeta("moscow-chunk1")
+	if err != nil {
+		t.Fatalf("computeMeta() failed: %v", err)
+	}
+	if err := src.writeMeta("moscow-chunk1", meta); err != nil {
+		t.Fatalf("writeMeta() failed: %v", err)
+	}
+	srcChunks, err := src.ListChunks()
+	if err != nil || len(srcChunks) != 1 || srcChunks[0].Checksum == "" {
+		t.Fatalf("ListChunks() = %+v, %v; want one chunk with the checksum", srcChunks, err)
+	}
+
+	dst := testNewOnDisk(t, getTempDir(t))
+	for {
+		size, err := dst.CompressedPartSize("moscow-chunk1")
+		if err != nil {
+			t.Fatalf("CompressedPartSize() failed: %v", err)
+		}
+		var b bytes.Buffer
+		if err := src.RecvCompressed("moscow-chunk1", uint64(size), 64*1024, &b); err != nil {
+			t.Fatalf("RecvCompressed() failed: %v", err)
+		}
+		if b.Len() == 0 {
+			break
+		}
+		if err := dst.WriteCompressedDirectly("moscow-chunk1", b.Bytes()); err != nil {
+			t.Fatalf("WriteCompressedDirectly() failed: %v", err)
+		}
+	}
+	if err := dst.SealCompressedDirectly("moscow-chunk1", srcChunks[0].ChunkMeta); err != nil {
+		t.Fatalf("SealCompressedDirectly() failed: %v", err)
+	}
+
+	chunks, err := dst.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	if len(chunks) != 1 || !chunks[0].Complete || !chunks[0].Compressed || chunks[0].Size != uint64(len(want)) {
+		t.Fatalf("ListChunks() = %+v, want complete compressed chunk of size %d", chunks, len(want))
+	}
+
+	var b bytes.Buffer
+	if err := dst.Recv("moscow-chunk1", 0, uint(len(want)), &b); err != nil {
+		t.Fatalf("Recv() failed: %v", err)
+	}
+	if !bytes.HasPrefix(want, b.Bytes()) || b.Len() == 0 {
+		t.Errorf("Recv() returned different contents on the replica")
+	}
+
+	if err := dst.Ack("moscow-chunk1", uint64(len(want))); err != nil {
+		t.Errorf("Ack() failed: %v", err)
+	}
+	if chunks, _ := dst.ListChunks(); len(chunks) != 0 {
+		t.Errorf("ListChunks() = %+v after Ack, want none", chunks)
+	}
+}
+
+func TestCompressDeletedChunk(t *testing.T) {
+	dir := getTempDir(t)
+	if err := os.WriteFile(dir+"/moscow-chunk1", testCompressedContents(), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	testCreateFile(t, dir+"/moscow-chunk1"+sealSuffix)
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Compression: config.CompressionGzip})
+
+	// the retention policy deletes the chunk while it is compressed
+	tmpFilename := srv.compressedFilename("moscow-chunk1") + partSuffix
+	testCreateFile(t, tmpFilename)
+	if err := srv.deleteChunk("moscow-chunk1"); err != nil {
+		t.Fatalf("deleteChunk() failed: %v", err)
+	}
+	ok, err := srv.commitCompressed("moscow-chunk1", tmpFilename)
+	if err != nil || ok {
+		t.Fatalf("commitCompressed() = %v, %v, want false for the deleted chunk", ok, err)
+	}
+	if got := testChunkNames(t, srv); len(got) != 0 {
+		t.Errorf("ListChunks() = %v, want the deleted chunk to stay deleted", got)
+	}
+}
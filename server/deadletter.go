@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// errVisibilityTimeout is the last error of the messages that were
+// not acknowledged in time, e.g. because the consumer crashed on them.
+const errVisibilityTimeout = "visibility timeout expired"
+
+// DeadLetter returns the category that receives the messages that failed
+// MaxDeliveries times, empty if there is none.
+func (c *OnDisk) DeadLetter() string {
+	return c.deadLetter
+}
+
+// MaxDeliveries returns how many times a message can fail before it is
+// moved to the DeadLetter category, zero means no limit.
+func (c *OnDisk) MaxDeliveries() int {
+	return c.maxDeliveries
+}
+
+// deadLetterMessage adds the headers that record where and why m failed.
+func (c *OnDisk) deadLetterMessage(m protocol.Message, chunk string, off uint64, attempts int, lastErr string) protocol.Message {
+	headers := make([]protocol.Header, 0, len(m.Headers)+5)
+	headers = append(headers, m.Headers...)
+	headers = append(headers,
+		protocol.Header{Name: protocol.HeaderDeadLetterCategory, Value: []byte(c.category)},
+		protocol.Header{Name: protocol.HeaderDeadLetterChunk, Value: []byte(chunk)},
+		protocol.Header{Name: protocol.HeaderDeadLetterOffset, Value: []byte(strconv.FormatUint(off, 10))},
+		protocol.Header{Name: protocol.HeaderDeadLetterAttempts, Value: []byte(strconv.Itoa(attempts))},
+		protocol.Header{Name: protocol.HeaderDeadLetterError, Value: []byte(lastErr)},
+	)
+	m.Headers = headers
+	// the dead-letter category stamps the time it received the message
+	m.Time = time.Time{}
+	return m
+}
+
+func writeDeadLetters(ctx context.Context, dl *OnDisk, msgs []protocol.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, m := range msgs {
+		buf = protocol.AppendMessage(buf, m)
+	}
+	if err := dl.Send(ctx, buf); err != nil {
+		return fmt.Errorf("writing to the dead-letter category %q: %v", dl.category, err)
+	}
+	return nil
+}
+
+// MoveDeadLetters moves the messages in flight that were delivered
+// MaxDeliveries times and were not acknowledged to the dead-letter
+// category dl. It returns the number of moved messages.
+func (c *OnDisk) MoveDeadLetters(ctx context.Context, dl *OnDisk, now time.Time) (int, error) {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	var dead []*inFlight
+	for _, f := range c.inFlight {
+		if c.exhausted(f) && !f.Visible.After(now) {
+			dead = append(dead, f)
+		}
+	}
+	if len(dead) == 0 {
+		return 0, nil
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		if dead[i].Chunk != dead[j].Chunk {
+			return dead[i].Chunk < dead[j].Chunk
+		}
+		return dead[i].Off < dead[j].Off
+	})
+
+	msgs := make([]protocol.Message, 0, len(dead))
+	for _, f := range dead {
+		m, err := c.messageAt(f.Chunk, f.Off)
+		if err != nil {
+			return 0, err
+		}
+		lastErr := f.LastError
+		if lastErr == "" {
+			lastErr = errVisibilityTimeout
+		}
+		msgs = append(msgs, c.deadLetterMessage(m, f.Chunk, f.Off, f.Attempts, lastErr))
+	}
+	// the messages are removed after they are written so that they
+	// are not lost, at worst they are moved twice
+	if err := writeDeadLetters(ctx, dl, msgs); err != nil {
+		return 0, err
+	}
+
+	chunks := make(map[string]bool)
+	for _, f := range dead {
+		delete(c.inFlight, msgPos{chunk: f.Chunk, off: f.Off})
+		chunks[f.Chunk] = true
+	}
+	if err := c.saveDeliveries(); err != nil {
+		return 0, err
+	}
+	for chunk := range chunks {
+		if err := c.deleteAcked(chunk); err != nil {
+			return 0, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// failuresSuffix is the suffix of the JSON file with the failures of the
+// messages of the chunk that were read with /read, the messages categories
+// count them in deliveriesFilename instead.
+const failuresSuffix = ".failures"
+
+// messageFailures is how many times the consumers of the group failed
+// to process the message at Off.
+type messageFailures struct {
+	Group    string `json:"group,omitempty"`
+	Off      uint64 `json:"off"`
+	Attempts int    `json:"attempts"`
+}
+
+func (c *OnDisk) failuresFilename(chunk string) string {
+	return c.chunkFilename(chunk) + failuresSuffix
+}
+
+func (c *OnDisk) readFailures(chunk string) ([]messageFailures, error) {
+	b, err := os.ReadFile(c.failuresFilename(chunk))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []messageFailures
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("parsing failures of %q: %v", chunk, err)
+	}
+	return res, nil
+}
+
+// writeFailures must be called with failuresMu held.
+func (c *OnDisk) writeFailures(chunk string, failures []messageFailures) error {
+	// the chunk could be deleted in the meantime
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+	if _, exists, err := c.ChunkSize(chunk); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("stat %q: %w", chunk, os.ErrNotExist)
+	}
+
+	if len(failures) == 0 {
+		if err := os.Remove(c.failuresFilename(chunk)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(c.failuresFilename(chunk), b); err != nil {
+		return fmt.Errorf("writing failures of %q: %v", chunk, err)
+	}
+	return nil
+}
+
+// FailMessage records that a consumer of the group failed to process the
+// message of the chunk at off, which /read returned. Once the message failed
+// MaxDeliveries times it is moved to the dead-letter category dl and the
+// consumers continue after it. It returns the number of failures so far
+// and whether the message was moved.
+func (c *OnDisk) FailMessage(ctx context.Context, dl *OnDisk, group, chunk string, off uint64, lastErr string) (int, bool, error) {
+	if err := checkChunkName(chunk); err != nil {
+		return 0, false, err
+	}
+
+	c.failuresMu.Lock()
+	defer c.failuresMu.Unlock()
+
+	failures, err := c.readFailures(chunk)
+	if err != nil {
+		return 0, false, err
+	}
+	idx := -1
+	for i, f := range failures {
+		if f.Group == group && f.Off == off {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		// also makes sure that there is a message at off
+		if _, err := c.batchMessageAt(chunk, off); err != nil {
+			return 0, false, err
+		}
+		failures = append(failures, messageFailures{Group: group, Off: off})
+		idx = len(failures) - 1
+	}
+	failures[idx].Attempts++
+	attempts := failures[idx].Attempts
+
+	moved := dl != nil && c.maxDeliveries > 0 && attempts >= c.maxDeliveries
+	if moved {
+		m, err := c.batchMessageAt(chunk, off)
+		if err != nil {
+			return 0, false, err
+		}
+		// the failures are forgotten after the message is written so that
+		// it is not lost, at worst it is moved twice
+		if err := writeDeadLetters(ctx, dl, []protocol.Message{c.deadLetterMessage(m, chunk, off, attempts, lastErr)}); err != nil {
+			return 0, false, err
+		}
+		failures = append(failures[:idx], failures[idx+1:]...)
+	}
+	if err := c.writeFailures(chunk, failures); err != nil {
+		return 0, false, err
+	}
+	return attempts, moved, nil
+}
+
+// batchMessageAt reads the message of the chunk at off in both formats,
+// the messages of the newline categories only have the value.
+func (c *OnDisk) batchMessageAt(chunk string, off uint64) (protocol.Message, error) {
+	if c.format == protocol.FormatFramed {
+		return c.messageAt(chunk, off)
+	}
+
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	defer h.Release()
+
+	if off >= uint64(size) {
+		return protocol.Message{}, fmt.Errorf("reading %q at offset %d: %w", chunk, off, io.ErrUnexpectedEOF)
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(h, int64(off), size-int64(off))).ReadBytes('\n')
+	if err != nil {
+		return protocol.Message{}, fmt.Errorf("reading %q at offset %d: %v", chunk, off, err)
+	}
+	if off > 0 {
+		// the offset must point to the beginning of a message
+		prev := make([]byte, 1)
+		if _, err := h.ReadAt(prev, int64(off)-1); err != nil {
+			return protocol.Message{}, fmt.Errorf("reading %q at offset %d: %v", chunk, off-1, err)
+		}
+		if prev[0] != '\n' {
+			return protocol.Message{}, fmt.Errorf("offset %d of %q is in the middle of a message", off, chunk)
+		}
+	}
+	return protocol.Message{Value: line[:len(line)-1]}, nil
+}
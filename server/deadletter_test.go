@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+func testNewDeadLetter(t *testing.T) *OnDisk {
+	t.Helper()
+
+	dl, err := NewOnDisk(getTempDir(t), "failed", "moscow", config.Category{Format: protocol.FormatFramed}, &nilHooks{})
+	if err != nil {
+		t.Fatalf("NewOnDisk failed: %v", err)
+	}
+	t.Cleanup(func() { dl.Close() })
+	return dl
+}
+
+// testDeadLetters returns the messages of the dead-letter category.
+func testDeadLetters(t *testing.T, dl *OnDisk) []protocol.Message {
+	t.Helper()
+
+	chunks, err := dl.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	var res []protocol.Message
+	for _, ch := range chunks {
+		err := dl.forEachMessage(ch.Name, func(m protocol.Message, rec []byte, off int64) error {
+			res = append(res, m)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("reading %q failed: %v", ch.Name, err)
+		}
+	}
+	return res
+}
+
+func testHeader(m protocol.Message, name string) string {
+	v, _ := m.Header(name)
+	return string(v)
+}
+
+func TestMoveDeadLetters(t *testing.T) {
+	dir := getTempDir(t)
+	now := time.Now()
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", now, testMsg("", "1"), testMsg("", "poison"))
+
+	cfg := testMessagesConfig
+	cfg.MaxDeliveries = 2
+	cfg.DeadLetter = "failed"
+	srv := testNewOnDiskWithConfig(t, dir, cfg)
+	dl := testNewDeadLetter(t)
+
+	msgs := testReceive(t, srv, 10, now)
+	if err := srv.AckMessage(msgs[0].Chunk, msgs[0].Off); err != nil {
+		t.Fatalf("AckMessage() failed: %v", err)
+	}
+	poison := msgs[1]
+	if err := srv.NackMessage(poison.Chunk, poison.Off, 0, "first", now); err != nil {
+		t.Fatalf("NackMessage() failed: %v", err)
+	}
+	if got, want := testReceivedValues(testReceive(t, srv, 10, now)), []string{"poison#2"}; !equalStrings(got, want) {
+		t.Fatalf("Receive() = %v, want %v", got, want)
+	}
+	if err := srv.NackMessage(poison.Chunk, poison.Off, time.Hour, "parse error", now); err != nil {
+		t.Fatalf("NackMessage() failed: %v", err)
+	}
+
+	// the message is not delivered a third time
+	if got := testReceive(t, srv, 10, now); len(got) != 0 {
+		t.Fatalf("Receive() = %v, want no messages", testReceivedValues(got))
+	}
+	moved, err := srv.MoveDeadLetters(context.Background(), dl, now)
+	if err != nil || moved != 1 {
+		t.Fatalf("MoveDeadLetters() = %v, %v, want 1 message moved", moved, err)
+	}
+
+	dead := testDeadLetters(t, dl)
+	if len(dead) != 1 {
+		t.Fatalf("dead letters = %+v, want one message", dead)
+	}
+	for name, want := range map[string]string{
+		protocol.HeaderDeadLetterCategory: "numbers",
+		protocol.HeaderDeadLetterChunk:    "moscow-chunk1",
+		protocol.HeaderDeadLetterOffset:   strconv.FormatUint(poison.Off, 10),
+		protocol.HeaderDeadLetterAttempts: "2",
+		protocol.HeaderDeadLetterError:    "parse error",
+	} {
+		if got := testHeader(dead[0], name); got != want {
+			t.Errorf("header %q = %q, want %q", name, got, want)
+		}
+	}
+	if got, want := string(dead[0].Value), "poison"; got != want {
+		t.Errorf("dead letter value = %q, want %q", got, want)
+	}
+
+	// all messages of the chunk are either acknowledged or moved
+	if got := testChunkNames(t, srv); len(got) != 0 {
+		t.Errorf("ListChunks() = %v, want the chunk to be deleted", got)
+	}
+}
+
+func TestFailMessage(t *testing.T) {
+	dir := getTempDir(t)
+	path := filepath.Join(dir, "moscow-chunk1")
+	if err := os.WriteFile(path, []byte("10\n200\n3000\n"), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	testCreateFile(t, path+sealSuffix)
+
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{MaxDeliveries: 3, DeadLetter: "failed"})
+	dl := testNewDeadLetter(t)
+	fail := func(group string, off uint64) (int, bool) {
+		t.Helper()
+		attempts, moved, err := srv.FailMessage(context.Background(), dl, group, "moscow-chunk1", off, "timeout")
+		if err != nil {
+			t.Fatalf("FailMessage(%q, %d) failed: %v", group, off, err)
+		}
+		return attempts, moved
+	}
+
+	for i := 1; i < 3; i++ {
+		if attempts, moved := fail("billing", 3); attempts != i || moved {
+			t.Fatalf("FailMessage() = %d, %v; want %d, false", attempts, moved, i)
+		}
+	}
+	// the groups fail the message independently
+	if attempts, moved := fail("audit", 3); attempts != 1 || moved {
+		t.Errorf("FailMessage(audit) = %d, %v; want 1, false", attempts, moved)
+	}
+	if len(testDeadLetters(t, dl)) != 0 {
+		t.Fatalf("the message was moved before it failed 3 times")
+	}
+
+	// the failures survive restarts
+	srv.Close()
+	srv = testNewOnDiskWithConfig(t, dir, config.Category{MaxDeliveries: 3, DeadLetter: "failed"})
+	if attempts, moved := fail("billing", 3); attempts != 3 || !moved {
+		t.Fatalf("FailMessage() = %d, %v; want 3, true", attempts, moved)
+	}
+
+	dead := testDeadLetters(t, dl)
+	if len(dead) != 1 {
+		t.Fatalf("dead letters = %+v, want one message", dead)
+	}
+	if got, want := string(dead[0].Value), "200"; got != want {
+		t.Errorf("dead letter value = %q, want %q", got, want)
+	}
+	for name, want := range map[string]string{
+		protocol.HeaderDeadLetterOffset:   "3",
+		protocol.HeaderDeadLetterAttempts: "3",
+		protocol.HeaderDeadLetterError:    "timeout",
+	} {
+		if got := testHeader(dead[0], name); got != want {
+			t.Errorf("dead letter header %q = %q, want %q", name, got, want)
+		}
+	}
+
+	// the message is counted from scratch if it fails again
+	if attempts, _ := fail("billing", 3); attempts != 1 {
+		t.Errorf("FailMessage() after the move = %d attempts, want 1", attempts)
+	}
+	if _, _, err := srv.FailMessage(context.Background(), dl, "billing", "moscow-chunk1", 4, "timeout"); err == nil {
+		t.Errorf("FailMessage() in the middle of a message = nil, want an error")
+	}
+
+	if err := srv.deleteChunk("moscow-chunk1"); err != nil {
+		t.Fatalf("deleteChunk() failed: %v", err)
+	}
+	if _, err := os.Stat(path + failuresSuffix); !os.IsNotExist(err) {
+		t.Errorf("the failures must be deleted with the chunk, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// delayedFilename is the file in the category directory with the batches
+// that were written with a delivery time in the future. Every batch is
+// a record with the delivery time in Unix nanoseconds followed by the batch.
+const delayedFilename = "delayed"
+
+// delayCheckInterval is how often the due batches are released.
+const delayCheckInterval = 100 * time.Millisecond
+
+// maxDelayBackoff is the longest wait before the due batches are released
+// again after the release failed because the replicas were not in sync.
+const maxDelayBackoff = 10 * time.Second
+
+// ErrDelayedAcks means that the delayed write asked for replicas. The delayed
+// batches are only stored by the instance that received them until they are
+// due, so they cannot be confirmed by the replicas.
+var ErrDelayedAcks = errors.New("the delayed messages are not replicated until they are due, they cannot be written with acks")
+
+// delayedBatch is the batch that is appended to the chunks at the time.
+type delayedBatch struct {
+	at    time.Time
+	batch []byte
+}
+
+func (c *OnDisk) delayedFilename() string {
+	return filepath.Join(c.dirname, delayedFilename)
+}
+
+func appendDelayed(dst []byte, d delayedBatch) []byte {
+	payload := make([]byte, 8, 8+len(d.batch))
+	binary.BigEndian.PutUint64(payload, uint64(d.at.UnixNano()))
+	return protocol.AppendRecord(dst, 0, append(payload, d.batch...))
+}
+
+// loadDelayed reads the batches that were not released before the restart.
+func (c *OnDisk) loadDelayed() error {
+	fp, err := os.Open(c.delayedFilename())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	rr := protocol.NewRecordReader(fp)
+	for {
+		rec, _, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if errors.Is(err, protocol.ErrShortRecord) {
+			// the write of the last batch was interrupted and was not acknowledged
+			log.Printf("ignoring the incomplete delayed batch of category %q", c.category)
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading %q: %v", delayedFilename, err)
+		}
+		if len(rec.Payload) < 8 {
+			return fmt.Errorf("reading %q: %w", delayedFilename, protocol.ErrCorruptRecord)
+		}
+		c.delayed = append(c.delayed, delayedBatch{
+			at:    time.Unix(0, int64(binary.BigEndian.Uint64(rec.Payload))),
+			batch: append([]byte(nil), rec.Payload[8:]...),
+		})
+	}
+	// the file is in the order of the writes
+	sort.SliceStable(c.delayed, func(i, j int) bool { return c.delayed[i].at.Before(c.delayed[j].at) })
+	return nil
+}
+
+// SendAt writes msg like SendReplicated, but the messages are only appended
+// to the chunks, and so become visible to the consumers and the replicas,
+// at the time at. Until then they are kept in the delayed file of this
+// instance only, so they are lost with its disk, and it fails with
+// ErrDelayedAcks unless acks is AcksLeader.
+func (c *OnDisk) SendAt(ctx context.Context, msg []byte, at time.Time, acks config.Acks) error {
+	if !at.After(time.Now()) {
+		return c.SendReplicated(ctx, msg, acks)
+	}
+	if acks != config.AcksLeader {
+		return fmt.Errorf("%w: acks %v", ErrDelayedAcks, acks)
+	}
+	if _, err := c.countBatch(msg); err != nil {
+		return err
+	}
+
+	c.delayMu.Lock()
+	defer c.delayMu.Unlock()
+
+	d := delayedBatch{at: at, batch: append([]byte(nil), msg...)}
+	fp, err := os.OpenFile(c.delayedFilename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err := fp.Write(appendDelayed(nil, d)); err != nil {
+		return fmt.Errorf("writing the delayed batch: %v", err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("writing the delayed batch: %v", err)
+	}
+
+	// c.delayed is kept in the order of the delivery times
+	i := sort.Search(len(c.delayed), func(i int) bool { return c.delayed[i].at.After(at) })
+	c.delayed = append(c.delayed, delayedBatch{})
+	copy(c.delayed[i+1:], c.delayed[i:])
+	c.delayed[i] = d
+	return nil
+}
+
+// delayLoop releases the delayed batches once they are due.
+func (c *OnDisk) delayLoop() {
+	ticker := time.NewTicker(delayCheckInterval)
+	defer ticker.Stop()
+
+	var failures int
+	var retryAt time.Time
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		if now.Before(retryAt) {
+			continue
+		}
+		err := c.releaseDelayed(now)
+		if errors.Is(err, ErrNotEnoughReplicas) {
+			// the replicas are not back yet, every attempt would wait for them
+			failures++
+			retryAt = now.Add(delayBackoff(failures))
+		} else {
+			failures = 0
+		}
+		if err != nil {
+			log.Printf("releasing the delayed messages of category %q failed: %v", c.category, err)
+		}
+	}
+}
+
+// delayBackoff returns how long to wait before releasing the due batches
+// again after the release failed that many times in a row.
+func delayBackoff(failures int) time.Duration {
+	d := delayCheckInterval
+	for i := 1; i < failures && d < maxDelayBackoff; i++ {
+		d *= 2
+	}
+	if d > maxDelayBackoff {
+		d = maxDelayBackoff
+	}
+	return d
+}
+
+// releaseDelayed appends the delayed batches that are due at now to the
+// chunks in the order of their delivery times with the acks of the category.
+// The batches are sent without delayMu held, so SendAt is not blocked while
+// the release waits for the replicas. A batch can be appended twice if the
+// instance crashes before the delayed file is rewritten. releaseDelayed
+// must not be called concurrently, delayLoop is the only caller.
+func (c *OnDisk) releaseDelayed(now time.Time) error {
+	c.delayMu.Lock()
+	var due []delayedBatch
+	for _, d := range c.delayed {
+		if d.at.After(now) {
+			break
+		}
+		due = append(due, d)
+	}
+	c.delayMu.Unlock()
+
+	var released int
+	var sendErr error
+	for _, d := range due {
+		written, err := c.sendReplicated(context.Background(), d.batch, c.acks)
+		if written {
+			// the replicas can still catch up, the batch must not be written twice
+			released++
+		}
+		if sendErr = err; sendErr != nil {
+			break
+		}
+	}
+	if released == 0 {
+		return sendErr
+	}
+
+	c.delayMu.Lock()
+	defer c.delayMu.Unlock()
+
+	// SendAt only adds the batches that are due after now, so the released
+	// ones are still the first ones
+	c.delayed = append(c.delayed[:0], c.delayed[released:]...)
+	var b []byte
+	for _, d := range c.delayed {
+		b = appendDelayed(b, d)
+	}
+	if err := writeFileAtomically(c.delayedFilename(), b); err != nil {
+		return fmt.Errorf("rewriting the delayed batches: %v", err)
+	}
+	return sendErr
+}
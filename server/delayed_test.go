@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+func testChunkContents(t *testing.T, dir string, srv *OnDisk) string {
+	t.Helper()
+
+	var res string
+	for _, name := range testChunkNames(t, srv) {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("ReadFile(%q) failed: %v", name, err)
+		}
+		res += string(b)
+	}
+	return res
+}
+
+func TestSendAt(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDisk(t, dir)
+	at := time.Now().Add(time.Hour)
+
+	if err := srv.SendAt(context.Background(), []byte("later2\n"), at.Add(time.Minute), config.AcksLeader); err != nil {
+		t.Fatalf("SendAt() failed: %v", err)
+	}
+	if err := srv.SendAt(context.Background(), []byte("later1\n"), at, config.AcksLeader); err != nil {
+		t.Fatalf("SendAt() failed: %v", err)
+	}
+	if err := srv.SendAt(context.Background(), []byte("now\n"), time.Now().Add(-time.Second), config.AcksLeader); err != nil {
+		t.Fatalf("SendAt() in the past failed: %v", err)
+	}
+
+	if got, want := testChunkContents(t, dir, srv), "now\n"; got != want {
+		t.Fatalf("chunk contents = %q, want %q before the delivery time", got, want)
+	}
+
+	if err := srv.releaseDelayed(at); err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	if got, want := testChunkContents(t, dir, srv), "now\nlater1\n"; got != want {
+		t.Fatalf("chunk contents = %q, want %q", got, want)
+	}
+
+	if err := srv.releaseDelayed(at.Add(time.Hour)); err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	if got, want := testChunkContents(t, dir, srv), "now\nlater1\nlater2\n"; got != want {
+		t.Errorf("chunk contents = %q, want %q", got, want)
+	}
+}
+
+func TestDelayedSurviveRestart(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDisk(t, dir)
+	at := time.Now().Add(time.Hour)
+
+	for _, msg := range []string{"1\n", "2\n"} {
+		if err := srv.SendAt(context.Background(), []byte(msg), at, config.AcksLeader); err != nil {
+			t.Fatalf("SendAt() failed: %v", err)
+		}
+	}
+	srv.Close()
+
+	srv = testNewOnDisk(t, dir)
+	if got := testChunkContents(t, dir, srv); got != "" {
+		t.Fatalf("chunk contents = %q, want nothing before the delivery time", got)
+	}
+	if err := srv.releaseDelayed(at); err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	srv.Close()
+
+	// the released batches are not delivered again
+	srv = testNewOnDisk(t, dir)
+	if err := srv.releaseDelayed(at.Add(time.Hour)); err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	if got, want := testChunkContents(t, dir, srv), "1\n2\n"; got != want {
+		t.Errorf("chunk contents = %q, want %q", got, want)
+	}
+}
+
+func TestSendAtWithAcks(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDisk(t, dir)
+
+	if err := srv.SendAt(context.Background(), []byte("later\n"), time.Now().Add(time.Hour), config.Acks(1)); !errors.Is(err, ErrDelayedAcks) {
+		t.Errorf("SendAt() with acks = %v, want ErrDelayedAcks", err)
+	}
+	if _, err := os.Stat(srv.delayedFilename()); !os.IsNotExist(err) {
+		t.Errorf("the rejected batch must not be stored, got %v", err)
+	}
+}
+
+func TestReleaseDelayedNothingDue(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDisk(t, dir)
+	at := time.Now().Add(time.Hour)
+
+	if err := srv.SendAt(context.Background(), []byte("later\n"), at, config.AcksLeader); err != nil {
+		t.Fatalf("SendAt() failed: %v", err)
+	}
+	// the file is only rewritten when a batch is released
+	if err := os.Remove(srv.delayedFilename()); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if err := srv.releaseDelayed(at.Add(-time.Second)); err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	if _, err := os.Stat(srv.delayedFilename()); !os.IsNotExist(err) {
+		t.Errorf("releaseDelayed() rewrote the delayed file with nothing due, got %v", err)
+	}
+}
+
+func TestReleaseDelayedDoesNotBlockSendAt(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Acks: 1})
+	srv.ConfirmReplicated("replica", "", 0, time.Now())
+	at := time.Now().Add(time.Hour)
+
+	if err := srv.SendAt(context.Background(), []byte("due\n"), at, config.AcksLeader); err != nil {
+		t.Fatalf("SendAt() failed: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.releaseDelayed(at) }()
+
+	// the release waits for the replica to confirm the batch
+	var chunk string
+	for chunk == "" {
+		srv.replicaMu.Lock()
+		for w := range srv.replicaWaiters {
+			chunk = w.chunk
+		}
+		srv.replicaMu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	sendCh := make(chan error, 1)
+	go func() {
+		sendCh <- srv.SendAt(context.Background(), []byte("later\n"), at.Add(time.Hour), config.AcksLeader)
+	}()
+	select {
+	case err := <-sendCh:
+		if err != nil {
+			t.Fatalf("SendAt() failed: %v", err)
+		}
+	case <-time.After(replicaAckTimeout / 2):
+		t.Fatalf("SendAt() is blocked by the release of the due batches")
+	}
+
+	srv.ConfirmReplicated("replica", chunk, 1<<20, time.Now())
+	if err := <-errCh; err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	if got, want := testChunkContents(t, dir, srv), "due\n"; got != want {
+		t.Errorf("chunk contents = %q, want %q", got, want)
+	}
+
+	// only the released batch is removed from the delayed file
+	srv.Close()
+	srv = testNewOnDisk(t, dir)
+	if err := srv.releaseDelayed(at.Add(2 * time.Hour)); err != nil {
+		t.Fatalf("releaseDelayed() failed: %v", err)
+	}
+	if got, want := testChunkContents(t, dir, srv), "due\nlater\n"; got != want {
+		t.Errorf("chunk contents = %q, want %q", got, want)
+	}
+}
+
+func TestReleaseDelayedNotEnoughReplicas(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Acks: 1})
+	at := time.Now().Add(time.Hour)
+
+	if err := srv.SendAt(context.Background(), []byte("due\n"), at, config.AcksLeader); err != nil {
+		t.Fatalf("SendAt() failed: %v", err)
+	}
+	if err := srv.releaseDelayed(at); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("releaseDelayed() = %v, want ErrNotEnoughReplicas without replicas", err)
+	}
+	if got := testChunkContents(t, dir, srv); got != "" {
+		t.Errorf("chunk contents = %q, want the batch to stay delayed", got)
+	}
+	if len(srv.delayed) != 1 {
+		t.Errorf("%d delayed batches, want the batch to be released again", len(srv.delayed))
+	}
+}
+
+func TestDelayBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, delayCheckInterval},
+		{2, 2 * delayCheckInterval},
+		{3, 4 * delayCheckInterval},
+		{100, maxDelayBackoff},
+	}
+	for _, tt := range tests {
+		if got := delayBackoff(tt.failures); got != tt.want {
+			t.Errorf("delayBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
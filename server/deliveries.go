@@ -0,0 +1,393 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// deliveriesFilename is the file in the category directory with the state
+// of the per-message deliveries of the messages categories.
+const deliveriesFilename = "deliveries.json"
+
+// ErrNotInFlight means that the message was not delivered or was
+// already acknowledged.
+var ErrNotInFlight = errors.New("the message is not in flight")
+
+// msgPos identifies the message by its chunk and offset.
+type msgPos struct {
+	chunk string
+	off   uint64
+}
+
+// inFlight is the delivered message that was not acknowledged yet.
+type inFlight struct {
+	Chunk string `json:"chunk"`
+	Off   uint64 `json:"off"`
+	// Visible is when the message is delivered again
+	// unless it is acknowledged before.
+	Visible  time.Time `json:"visible"`
+	Attempts int       `json:"attempts"`
+	// LastError is the reason of the failure of the last delivery
+	// reported by the consumer.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// deliveryState is what is stored in deliveriesFilename.
+type deliveryState struct {
+	// Chunk and Off are the position of the first message of this instance
+	// that was never delivered, an empty Chunk means the first chunk.
+	Chunk    string      `json:"chunk"`
+	Off      uint64      `json:"off"`
+	InFlight []*inFlight `json:"inFlight"`
+}
+
+func (c *OnDisk) deliveriesFilename() string {
+	return filepath.Join(c.dirname, deliveriesFilename)
+}
+
+// loadDeliveries reads the state of the deliveries written before the restart.
+func (c *OnDisk) loadDeliveries() error {
+	c.inFlight = make(map[msgPos]*inFlight)
+
+	b, err := os.ReadFile(c.deliveriesFilename())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var st deliveryState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("parsing %q: %v", deliveriesFilename, err)
+	}
+	c.cursor = msgPos{chunk: st.Chunk, off: st.Off}
+	for _, f := range st.InFlight {
+		c.inFlight[msgPos{chunk: f.Chunk, off: f.Off}] = f
+	}
+	return nil
+}
+
+// saveDeliveries persists the state of the deliveries.
+// It must be called with deliveryMu held.
+func (c *OnDisk) saveDeliveries() error {
+	st := deliveryState{
+		Chunk:    c.cursor.chunk,
+		Off:      c.cursor.off,
+		InFlight: make([]*inFlight, 0, len(c.inFlight)),
+	}
+	for _, f := range c.inFlight {
+		st.InFlight = append(st.InFlight, f)
+	}
+	sort.Slice(st.InFlight, func(i, j int) bool {
+		a, b := st.InFlight[i], st.InFlight[j]
+		if a.Chunk != b.Chunk {
+			return a.Chunk < b.Chunk
+		}
+		return a.Off < b.Off
+	})
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(c.deliveriesFilename(), b); err != nil {
+		return fmt.Errorf("writing deliveries: %v", err)
+	}
+	return nil
+}
+
+// ownChunkIdx returns the index of the chunk if it belongs to this instance.
+func (c *OnDisk) ownChunkIdx(chunk string) (uint64, bool) {
+	prefix := c.instanceName + "-"
+	if !strings.HasPrefix(chunk, prefix) {
+		return 0, false
+	}
+	m := filenameRegexp.FindStringSubmatch(strings.TrimPrefix(chunk, prefix))
+	if m == nil {
+		return 0, false
+	}
+	idx, err := strconv.ParseUint(m[1], 10, 64)
+	return idx, err == nil
+}
+
+// ownChunks returns the chunks of this instance in the order they were written.
+func (c *OnDisk) ownChunks() ([]protocol.Chunk, error) {
+	chunks, err := c.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	res := chunks[:0]
+	for _, ch := range chunks {
+		if _, ok := c.ownChunkIdx(ch.Name); ok {
+			res = append(res, ch)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, _ := c.ownChunkIdx(res[i].Name)
+		b, _ := c.ownChunkIdx(res[j].Name)
+		return a < b
+	})
+	return res, nil
+}
+
+// Receive delivers at most max messages that are visible at now, first the
+// ones whose visibility timeout has expired and then the ones that were never
+// delivered. The delivered messages are not visible for the visibility timeout
+// unless they are returned with NackMessage, and they are delivered again
+// unless they are acknowledged with AckMessage. Only the chunks of this
+// instance are delivered so that every message is tracked in one place.
+func (c *OnDisk) Receive(max int, visibility time.Duration, now time.Time) ([]protocol.ReceivedMessage, error) {
+	if c.mode != config.ModeMessages {
+		return nil, fmt.Errorf("category %q is not in the %q mode", c.category, config.ModeMessages)
+	}
+
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	res, changed, err := c.redeliver(max, visibility, now)
+	if err != nil {
+		return nil, err
+	}
+	delivered, err := c.deliverNew(max-len(res), visibility, now)
+	if err != nil {
+		return nil, err
+	}
+	res = append(res, delivered...)
+
+	if changed || len(res) > 0 {
+		if err := c.saveDeliveries(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// redeliver delivers the messages whose visibility timeout has expired.
+// It reports whether it forgot the messages of the deleted chunks.
+func (c *OnDisk) redeliver(max int, visibility time.Duration, now time.Time) (res []protocol.ReceivedMessage, changed bool, err error) {
+	var expired []*inFlight
+	for _, f := range c.inFlight {
+		if !f.Visible.After(now) {
+			expired = append(expired, f)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		a, b := expired[i], expired[j]
+		if !a.Visible.Equal(b.Visible) {
+			return a.Visible.Before(b.Visible)
+		}
+		if a.Chunk != b.Chunk {
+			return a.Chunk < b.Chunk
+		}
+		return a.Off < b.Off
+	})
+
+	for _, f := range expired {
+		if len(res) >= max {
+			break
+		}
+		if c.exhausted(f) {
+			// waits for MoveDeadLetters
+			continue
+		}
+		m, err := c.messageAt(f.Chunk, f.Off)
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted by the retention policy
+			delete(c.inFlight, msgPos{chunk: f.Chunk, off: f.Off})
+			changed = true
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		f.Attempts++
+		f.Visible = now.Add(visibility)
+		f.LastError = ""
+		res = append(res, protocol.ReceivedMessage{
+			Chunk:    f.Chunk,
+			Off:      f.Off,
+			Attempts: f.Attempts,
+			Message:  m,
+		})
+	}
+	return res, changed, nil
+}
+
+// deliverNew delivers at most max messages starting from the cursor.
+func (c *OnDisk) deliverNew(max int, visibility time.Duration, now time.Time) ([]protocol.ReceivedMessage, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	chunks, err := c.ownChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []protocol.ReceivedMessage
+	for _, ch := range chunks {
+		idx, _ := c.ownChunkIdx(ch.Name)
+		if cur, ok := c.ownChunkIdx(c.cursor.chunk); ok && idx < cur {
+			continue
+		} else if !ok || idx > cur {
+			// the cursor chunk was read completely or deleted
+			c.cursor = msgPos{chunk: ch.Name}
+		}
+
+		msgs, next, err := c.readMessages(ch.Name, c.cursor.off, max-len(res))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			c.inFlight[msgPos{chunk: m.Chunk, off: m.Off}] = &inFlight{
+				Chunk:    m.Chunk,
+				Off:      m.Off,
+				Visible:  now.Add(visibility),
+				Attempts: m.Attempts,
+			}
+		}
+		res = append(res, msgs...)
+		c.cursor.off = next
+
+		if len(res) >= max || !ch.Complete {
+			break
+		}
+	}
+	return res, nil
+}
+
+// readMessages reads at most max complete messages of the chunk starting
+// from off and returns the offset after the last one.
+func (c *OnDisk) readMessages(chunk string, off uint64, max int) ([]protocol.ReceivedMessage, uint64, error) {
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer h.Release()
+
+	n, err := c.completeLength(h.chunkReaderAt, size, int64(off), size-int64(off))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var res []protocol.ReceivedMessage
+	rr := protocol.NewRecordReader(io.NewSectionReader(h, int64(off), n))
+	for len(res) < max {
+		rec, sz, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("reading %q at offset %d: %v", chunk, off, err)
+		}
+		// the payload is reused by the next call
+		rec.Payload = append([]byte(nil), rec.Payload...)
+		m, err := protocol.DecodeMessage(rec)
+		if err != nil {
+			return nil, 0, fmt.Errorf("reading %q at offset %d: %v", chunk, off, err)
+		}
+		res = append(res, protocol.ReceivedMessage{Chunk: chunk, Off: off, Attempts: 1, Message: m})
+		off += uint64(sz)
+	}
+	return res, off, nil
+}
+
+// messageAt reads the message of the chunk at off.
+func (c *OnDisk) messageAt(chunk string, off uint64) (protocol.Message, error) {
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	defer h.Release()
+
+	rr := protocol.NewRecordReader(io.NewSectionReader(h, int64(off), size-int64(off)))
+	rec, _, err := rr.Next()
+	if err != nil {
+		return protocol.Message{}, fmt.Errorf("reading %q at offset %d: %v", chunk, off, err)
+	}
+	rec.Payload = append([]byte(nil), rec.Payload...)
+	return protocol.DecodeMessage(rec)
+}
+
+// AckMessage acknowledges the delivered message so that it is not delivered
+// again. The chunk is deleted once all its messages are acknowledged.
+func (c *OnDisk) AckMessage(chunk string, off uint64) error {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	pos := msgPos{chunk: chunk, off: off}
+	if _, ok := c.inFlight[pos]; !ok {
+		return fmt.Errorf("%w: %q at offset %d", ErrNotInFlight, chunk, off)
+	}
+	delete(c.inFlight, pos)
+	if err := c.saveDeliveries(); err != nil {
+		return err
+	}
+	return c.deleteAcked(chunk)
+}
+
+// NackMessage makes the delivered message visible again after delay,
+// e.g. at once when the consumer could not process it. lastErr is the
+// reason of the failure that is recorded in the dead-letter category
+// if the message fails too many times.
+func (c *OnDisk) NackMessage(chunk string, off uint64, delay time.Duration, lastErr string, now time.Time) error {
+	c.deliveryMu.Lock()
+	defer c.deliveryMu.Unlock()
+
+	f, ok := c.inFlight[msgPos{chunk: chunk, off: off}]
+	if !ok {
+		return fmt.Errorf("%w: %q at offset %d", ErrNotInFlight, chunk, off)
+	}
+	f.Visible = now.Add(delay)
+	f.LastError = lastErr
+	if c.exhausted(f) {
+		// there is no point in waiting to move it to the dead-letter category
+		f.Visible = now
+	}
+	return c.saveDeliveries()
+}
+
+// exhausted reports whether the message must not be delivered anymore.
+func (c *OnDisk) exhausted(f *inFlight) bool {
+	return c.maxDeliveries > 0 && f.Attempts >= c.maxDeliveries
+}
+
+// deleteAcked deletes the chunk if all its messages were delivered
+// and acknowledged. It must be called with deliveryMu held.
+func (c *OnDisk) deleteAcked(chunk string) error {
+	for pos := range c.inFlight {
+		if pos.chunk == chunk {
+			return nil
+		}
+	}
+
+	if chunk == c.cursor.chunk {
+		if !c.isSealed(chunk) {
+			return nil
+		}
+		size, exists, err := c.ChunkSize(chunk)
+		if err != nil || !exists || c.cursor.off < uint64(size) {
+			return err
+		}
+	} else {
+		idx, _ := c.ownChunkIdx(chunk)
+		if cur, ok := c.ownChunkIdx(c.cursor.chunk); !ok || idx > cur {
+			return nil
+		}
+	}
+
+	if err := c.deleteChunk(chunk); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting acknowledged chunk: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+var testMessagesConfig = config.Category{Format: protocol.FormatFramed, Mode: config.ModeMessages}
+
+func testReceive(t *testing.T, srv *OnDisk, max int, now time.Time) []protocol.ReceivedMessage {
+	t.Helper()
+
+	msgs, err := srv.Receive(max, time.Minute, now)
+	if err != nil {
+		t.Fatalf("Receive() failed: %v", err)
+	}
+	return msgs
+}
+
+// testReceivedValues returns the values of the messages with the attempts,
+// e.g. "1#2" for the second delivery of "1".
+func testReceivedValues(msgs []protocol.ReceivedMessage) []string {
+	var res []string
+	for _, m := range msgs {
+		res = append(res, string(m.Message.Value)+"#"+string(rune('0'+m.Attempts)))
+	}
+	return res
+}
+
+func TestReceive(t *testing.T) {
+	dir := getTempDir(t)
+	now := time.Now()
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", now, testMsg("", "1"), testMsg("", "2"))
+	testCreateMessagesChunk(t, dir, "moscow-chunk2", now, testMsg("", "3"))
+	// the replicas are delivered by their owners
+	testCreateMessagesChunk(t, dir, "kazan-chunk1", now, testMsg("", "kazan"))
+
+	srv := testNewOnDiskWithConfig(t, dir, testMessagesConfig)
+	msgs := testReceive(t, srv, 2, now)
+	if got, want := testReceivedValues(msgs), []string{"1#1", "2#1"}; !equalStrings(got, want) {
+		t.Fatalf("Receive() = %v, want %v", got, want)
+	}
+	if err := srv.NackMessage(msgs[0].Chunk, msgs[0].Off, 0, "", now); err != nil {
+		t.Fatalf("NackMessage() failed: %v", err)
+	}
+
+	// the nacked message is delivered again before the new ones
+	msgs = testReceive(t, srv, 10, now)
+	if got, want := testReceivedValues(msgs), []string{"1#2", "3#1"}; !equalStrings(got, want) {
+		t.Fatalf("Receive() after nack = %v, want %v", got, want)
+	}
+	if err := srv.AckMessage(msgs[0].Chunk, msgs[0].Off); err != nil {
+		t.Fatalf("AckMessage() failed: %v", err)
+	}
+
+	// "2" is delivered again once its visibility timeout expires
+	later := now.Add(time.Minute + time.Second)
+	got := testReceivedValues(testReceive(t, srv, 1, later))
+	if want := []string{"2#2"}; !equalStrings(got, want) {
+		t.Fatalf("Receive() after the visibility timeout = %v, want %v", got, want)
+	}
+}
+
+func TestAckMessageDeletesChunk(t *testing.T) {
+	dir := getTempDir(t)
+	now := time.Now()
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", now, testMsg("", "1"), testMsg("", "2"))
+
+	srv := testNewOnDiskWithConfig(t, dir, testMessagesConfig)
+	msgs := testReceive(t, srv, 10, now)
+	if len(msgs) != 2 {
+		t.Fatalf("Receive() = %v, want two messages", testReceivedValues(msgs))
+	}
+
+	if err := srv.AckMessage(msgs[0].Chunk, msgs[0].Off); err != nil {
+		t.Fatalf("AckMessage() failed: %v", err)
+	}
+	if err := srv.AckMessage(msgs[0].Chunk, msgs[0].Off); !errors.Is(err, ErrNotInFlight) {
+		t.Errorf("AckMessage() twice = %v, want ErrNotInFlight", err)
+	}
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk1"}; !equalStrings(got, want) {
+		t.Fatalf("ListChunks() = %v, want %v while a message is in flight", got, want)
+	}
+
+	if err := srv.AckMessage(msgs[1].Chunk, msgs[1].Off); err != nil {
+		t.Fatalf("AckMessage() failed: %v", err)
+	}
+	if got := testChunkNames(t, srv); len(got) != 0 {
+		t.Errorf("ListChunks() = %v, want the acknowledged chunk to be deleted", got)
+	}
+}
+
+func TestDeliveriesSurviveRestart(t *testing.T) {
+	dir := getTempDir(t)
+	now := time.Now()
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", now, testMsg("", "1"), testMsg("", "2"), testMsg("", "3"))
+
+	srv := testNewOnDiskWithConfig(t, dir, testMessagesConfig)
+	msgs := testReceive(t, srv, 2, now)
+	if err := srv.AckMessage(msgs[0].Chunk, msgs[0].Off); err != nil {
+		t.Fatalf("AckMessage() failed: %v", err)
+	}
+	srv.Close()
+
+	srv = testNewOnDiskWithConfig(t, dir, testMessagesConfig)
+	// "2" is still invisible, "1" is acknowledged
+	got := testReceivedValues(testReceive(t, srv, 10, now))
+	if want := []string{"3#1"}; !equalStrings(got, want) {
+		t.Fatalf("Receive() after restart = %v, want %v", got, want)
+	}
+	got = testReceivedValues(testReceive(t, srv, 10, now.Add(2*time.Minute)))
+	if want := []string{"2#2", "3#2"}; !equalStrings(got, want) {
+		t.Errorf("Receive() after the visibility timeout = %v, want %v", got, want)
+	}
+}
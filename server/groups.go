@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// DeleteConsumed deletes the complete chunks that every consumer group has
+// read, groups contains the committed offsets of all registered groups.
+// Nothing is deleted when there are no groups or in the log categories,
+// the pubsub categories are read by the groups only, so the slowest
+// of them defines what is kept besides the retention policy.
+// It returns the names of the deleted chunks.
+func (c *OnDisk) DeleteConsumed(groups map[string]protocol.GroupOffsets) ([]string, error) {
+	if len(groups) == 0 || (!c.mode.DeletesOnAck() && c.mode != config.ModePubSub) {
+		return nil, nil
+	}
+
+	chunks, err := c.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, ch := range chunks {
+		if !ch.Complete || !consumedByAll(groups, ch.Name) {
+			continue
+		}
+		if err := c.deleteChunk(ch.Name); errors.Is(err, os.ErrNotExist) {
+			// deleted concurrently, e.g. by the commit of another group
+			continue
+		} else if err != nil {
+			return deleted, fmt.Errorf("deleting consumed chunk: %v", err)
+		}
+		deleted = append(deleted, ch.Name)
+	}
+	return deleted, nil
+}
+
+func consumedByAll(groups map[string]protocol.GroupOffsets, chunk string) bool {
+	for _, offsets := range groups {
+		if !offsets[chunk].Done {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+func TestDeleteConsumed(t *testing.T) {
+	dir := getTempDir(t)
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", time.Now(), testMsg("", "1"))
+	testCreateMessagesChunk(t, dir, "moscow-chunk2", time.Now(), testMsg("", "2"))
+
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed})
+
+	deleted, err := srv.DeleteConsumed(nil)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("DeleteConsumed(no groups) = %v, %v, want nothing deleted", deleted, err)
+	}
+
+	groups := map[string]protocol.GroupOffsets{
+		"billing": {
+			"moscow-chunk1": {Off: 10, Done: true},
+			"moscow-chunk2": {Off: 10, Done: true},
+		},
+		"search": {
+			"moscow-chunk1": {Off: 10, Done: true},
+			"moscow-chunk2": {Off: 4},
+		},
+		// the group that has not read anything yet
+		"stats": {},
+	}
+	deleted, err = srv.DeleteConsumed(groups)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("DeleteConsumed() = %v, %v, want nothing deleted while stats has not read the chunks", deleted, err)
+	}
+
+	groups["stats"] = protocol.GroupOffsets{"moscow-chunk1": {Off: 10, Done: true}}
+	deleted, err = srv.DeleteConsumed(groups)
+	if err != nil {
+		t.Fatalf("DeleteConsumed() failed: %v", err)
+	}
+	if want := []string{"moscow-chunk1"}; !equalStrings(deleted, want) {
+		t.Errorf("DeleteConsumed() = %v, want %v", deleted, want)
+	}
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk2"}; !equalStrings(got, want) {
+		t.Errorf("ListChunks() = %v, want %v", got, want)
+	}
+}
+
+func TestDeleteConsumedKeepsLogChunks(t *testing.T) {
+	dir := getTempDir(t)
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", time.Now(), testMsg("", "1"))
+
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed, Mode: config.ModeLog})
+	groups := map[string]protocol.GroupOffsets{
+		"billing": {"moscow-chunk1": {Off: 10, Done: true}},
+	}
+	deleted, err := srv.DeleteConsumed(groups)
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("DeleteConsumed() = %v, %v, want nothing deleted in the log mode", deleted, err)
+	}
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk1"}; !equalStrings(got, want) {
+		t.Errorf("ListChunks() = %v, want %v", got, want)
+	}
+}
+
+func TestDeleteConsumedPubSub(t *testing.T) {
+	dir := getTempDir(t)
+	testCreateMessagesChunk(t, dir, "moscow-chunk1", time.Now(), testMsg("", "1"))
+	testCreateMessagesChunk(t, dir, "moscow-chunk2", time.Now(), testMsg("", "2"))
+
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed, Mode: config.ModePubSub})
+	if err := srv.Ack("moscow-chunk1", 10); err != nil {
+		t.Fatalf("Ack() failed: %v", err)
+	}
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk1", "moscow-chunk2"}; !equalStrings(got, want) {
+		t.Fatalf("ListChunks() after Ack = %v, want %v", got, want)
+	}
+
+	// billing is the slowest subscriber
+	groups := map[string]protocol.GroupOffsets{
+		"analytics": {
+			"moscow-chunk1": {Off: 10, Done: true},
+			"moscow-chunk2": {Off: 10, Done: true},
+		},
+		"billing": {
+			"moscow-chunk1": {Off: 10, Done: true},
+		},
+	}
+	deleted, err := srv.DeleteConsumed(groups)
+	if err != nil {
+		t.Fatalf("DeleteConsumed() failed: %v", err)
+	}
+	if want := []string{"moscow-chunk1"}; !equalStrings(deleted, want) {
+		t.Errorf("DeleteConsumed() = %v, want %v", deleted, want)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"container/list"
+	"io"
+	"log"
+	"sync"
+)
+
+// maxOpenChunks is the number of chunk files that are kept open for reading.
+// The least recently used ones are closed once nobody reads from them.
+const maxOpenChunks = 256
+
+// chunkReaderAt is an open chunk, either the raw file or the compressed one.
+type chunkReaderAt interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the current size of the uncompressed contents.
+	Size() (int64, error)
+}
+
+// chunkHandle is a reference-counted open chunk. The underlying file is
+// closed only after the handle was forgotten or evicted and the last
+// reader released it, so Ack or compression never close a file that is
+// still being read from.
+type chunkHandle struct {
+	chunkReaderAt
+
+	cache *handleCache
+	key   string
+	refs  int
+	// stale is set when the handle was removed from the cache,
+	// the file is closed by the last release.
+	stale bool
+	elem  *list.Element
+}
+
+// Release returns the handle to the cache. The handle must not be used afterwards.
+func (h *chunkHandle) Release() {
+	h.cache.release(h)
+}
+
+// handleCache keeps the open chunks. The handles that are not in use
+// are evicted in LRU order once there are more than maxOpen of them.
+type handleCache struct {
+	maxOpen int
+
+	mu      sync.Mutex
+	handles map[string]*chunkHandle
+	// lru contains all cached handles, the most recently used ones first.
+	lru *list.List
+}
+
+func newHandleCache(maxOpen int) *handleCache {
+	return &handleCache{
+		maxOpen: maxOpen,
+		handles: make(map[string]*chunkHandle),
+		lru:     list.New(),
+	}
+}
+
+// acquire returns the handle of the key opening it with open if needed.
+// Every successful acquire must be followed by Release.
+func (hc *handleCache) acquire(key string, open func() (chunkReaderAt, error)) (*chunkHandle, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if h, ok := hc.handles[key]; ok {
+		h.refs++
+		hc.lru.MoveToFront(h.elem)
+		return h, nil
+	}
+
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &chunkHandle{
+		chunkReaderAt: r,
+		cache:         hc,
+		key:           key,
+		refs:          1,
+	}
+	h.elem = hc.lru.PushFront(h)
+	hc.handles[key] = h
+	hc.evict()
+	return h, nil
+}
+
+func (hc *handleCache) release(h *chunkHandle) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	h.refs--
+	if h.refs < 0 {
+		panic("chunk handle " + h.key + " released twice")
+	}
+	if h.refs == 0 && h.stale {
+		hc.closeHandle(h)
+		return
+	}
+	hc.evict()
+}
+
+// forget removes the key from the cache, e.g. when the chunk is deleted.
+// The file stays open until the current readers release it.
+func (hc *handleCache) forget(key string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	h, ok := hc.handles[key]
+	if !ok {
+		return
+	}
+	hc.remove(h)
+	if h.refs == 0 {
+		hc.closeHandle(h)
+	}
+}
+
+// closeAll forgets all handles.
+func (hc *handleCache) closeAll() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for _, h := range hc.handles {
+		hc.remove(h)
+		if h.refs == 0 {
+			hc.closeHandle(h)
+		}
+	}
+}
+
+// evict closes the least recently used handles that are not in use
+// until there are at most maxOpen open handles.
+// It must be called with mu held.
+func (hc *handleCache) evict() {
+	for e := hc.lru.Back(); e != nil && len(hc.handles) > hc.maxOpen; {
+		h := e.Value.(*chunkHandle)
+		e = e.Prev()
+		if h.refs > 0 {
+			continue
+		}
+		hc.remove(h)
+		hc.closeHandle(h)
+	}
+}
+
+// remove must be called with mu held.
+func (hc *handleCache) remove(h *chunkHandle) {
+	hc.lru.Remove(h.elem)
+	delete(hc.handles, h.key)
+	h.stale = true
+}
+
+// closeHandle must be called with mu held.
+func (hc *handleCache) closeHandle(h *chunkHandle) {
+	if err := h.Close(); err != nil {
+		log.Printf("closing chunk %q failed: %v", h.key, err)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type fakeChunk struct {
+	closed bool
+}
+
+func (f *fakeChunk) ReadAt(p []byte, off int64) (int, error) { return 0, nil }
+func (f *fakeChunk) Size() (int64, error)                    { return 0, nil }
+func (f *fakeChunk) Close() error {
+	if f.closed {
+		panic("closed twice")
+	}
+	f.closed = true
+	return nil
+}
+
+func testAcquire(t *testing.T, hc *handleCache, key string, opened map[string]*fakeChunk) *chunkHandle {
+	t.Helper()
+
+	h, err := hc.acquire(key, func() (chunkReaderAt, error) {
+		f := &fakeChunk{}
+		opened[key] = f
+		return f, nil
+	})
+	if err != nil {
+		t.Fatalf("acquire(%q) failed: %v", key, err)
+	}
+	return h
+}
+
+func TestHandleCacheForget(t *testing.T) {
+	hc := newHandleCache(10)
+	opened := make(map[string]*fakeChunk)
+
+	h := testAcquire(t, hc, "moscow-chunk1", opened)
+	f := opened["moscow-chunk1"]
+
+	hc.forget("moscow-chunk1")
+	if f.closed {
+		t.Fatalf("the chunk must stay open while it is being read")
+	}
+
+	// the forgotten chunk is opened again for the new readers
+	h2 := testAcquire(t, hc, "moscow-chunk1", opened)
+	if opened["moscow-chunk1"] == f {
+		t.Errorf("acquire() returned the forgotten handle")
+	}
+
+	h.Release()
+	if !f.closed {
+		t.Errorf("the forgotten chunk must be closed by the last release")
+	}
+	h2.Release()
+	if opened["moscow-chunk1"].closed {
+		t.Errorf("the cached chunk must stay open after release")
+	}
+}
+
+func TestHandleCacheEviction(t *testing.T) {
+	hc := newHandleCache(2)
+	opened := make(map[string]*fakeChunk)
+
+	busy := testAcquire(t, hc, "chunk1", opened)
+	testAcquire(t, hc, "chunk2", opened).Release()
+	testAcquire(t, hc, "chunk3", opened).Release()
+	testAcquire(t, hc, "chunk4", opened).Release()
+
+	if opened["chunk1"].closed {
+		t.Errorf("the chunk in use must not be evicted")
+	}
+	if !opened["chunk2"].closed || !opened["chunk3"].closed {
+		t.Errorf("the least recently used chunks must be evicted")
+	}
+	if opened["chunk4"].closed {
+		t.Errorf("the most recently used chunk must not be evicted")
+	}
+	busy.Release()
+}
+
+func TestRecvDuringAck(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDisk(t, dir)
+
+	const chunks = 20
+	for i := 0; i < chunks; i++ {
+		if err := srv.Send(context.Background(), bytes.Repeat([]byte("message\n"), 1000)); err != nil {
+			t.Fatalf("Send() failed: %v", err)
+		}
+		srv.writeMu.Lock()
+		if err := srv.rollLastChunk(); err != nil {
+			t.Fatalf("rollLastChunk() failed: %v", err)
+		}
+		srv.writeMu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, chunks)
+	for i := 0; i < chunks; i++ {
+		chunk := fmt.Sprintf("moscow-chunk%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			var b bytes.Buffer
+			err := srv.Recv(chunk, 0, 1024*1024, &b)
+			// the chunk may already be gone, but a started read must succeed
+			if err == nil && b.Len() != 0 && b.Len() != 8000 {
+				err = fmt.Errorf("Recv(%q) returned %d bytes, want 8000", chunk, b.Len())
+			}
+			if err != nil && !bytes.Contains([]byte(err.Error()), []byte("no such file")) {
+				errCh <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := srv.Ack(chunk, 8000); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// indexSuffix is the suffix of the sparse index file of the chunk that maps
+// message sequence numbers and write times to the byte offsets in the chunk.
+const indexSuffix = ".index"
+
+// indexIntervalBytes and indexIntervalTime are the minimum distance
+// between two index entries: the index is both sparse enough and precise
+// enough to look up the messages of the newline categories by time.
+const (
+	indexIntervalBytes = 4 * 1024
+	indexIntervalTime  = 100 * time.Millisecond
+)
+
+// indexEntrySize is the size of the encoded indexEntry.
+const indexEntrySize = 24
+
+// indexEntry says that the message with the sequence number Seq (starting
+// from 0 for each chunk) starts at Offset and was written at Time.
+type indexEntry struct {
+	Seq    uint64
+	Offset uint64
+	Time   int64
+}
+
+func (c *OnDisk) indexFilename(chunk string) string {
+	return filepath.Join(c.dirname, chunk+indexSuffix)
+}
+
+// writeIndexEntry appends the entry to the index of the active chunk.
+// It must be called with writeMu held.
+func (c *OnDisk) writeIndexEntry(e indexEntry) error {
+	if c.indexFp == nil {
+		fp, err := os.OpenFile(c.indexFilename(c.lastChunk), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		c.indexFp = fp
+	}
+
+	var buf [indexEntrySize]byte
+	binary.BigEndian.PutUint64(buf[0:8], e.Seq)
+	binary.BigEndian.PutUint64(buf[8:16], e.Offset)
+	binary.BigEndian.PutUint64(buf[16:24], uint64(e.Time))
+	_, err := c.indexFp.Write(buf[:])
+	return err
+}
+
+// closeIndex closes the index of the active chunk.
+// It must be called with writeMu held.
+func (c *OnDisk) closeIndex() {
+	if c.indexFp == nil {
+		return
+	}
+	c.indexFp.Close()
+	c.indexFp = nil
+}
+
+// readIndex returns the index entries of the chunk.
+// Chunks without an index, e.g. replicas downloaded before they were
+// indexed, have no entries.
+func (c *OnDisk) readIndex(chunk string) ([]indexEntry, error) {
+	b, err := os.ReadFile(c.indexFilename(chunk))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the last entry could be written partially
+	res := make([]indexEntry, 0, len(b)/indexEntrySize)
+	for off := 0; off+indexEntrySize <= len(b); off += indexEntrySize {
+		res = append(res, indexEntry{
+			Seq:    binary.BigEndian.Uint64(b[off : off+8]),
+			Offset: binary.BigEndian.Uint64(b[off+8 : off+16]),
+			Time:   int64(binary.BigEndian.Uint64(b[off+16 : off+24])),
+		})
+	}
+	return res, nil
+}
+
+// recoverIndex drops the index entries that point past the end of
+// the recovered chunk and returns the number of messages in the chunk.
+func (c *OnDisk) recoverIndex(chunk string, r io.ReaderAt, size int64) (msgs uint64, err error) {
+	entries, err := c.readIndex(chunk)
+	if err != nil {
+		return 0, fmt.Errorf("reading index: %v", err)
+	}
+
+	valid := entries
+	for len(valid) > 0 && valid[len(valid)-1].Offset >= uint64(size) {
+		valid = valid[:len(valid)-1]
+	}
+	if len(valid) != len(entries) {
+		log.Printf("recovery: dropping %d index entries of chunk %q", len(entries)-len(valid), chunk)
+	}
+	if len(entries) > 0 {
+		if err := os.Truncate(c.indexFilename(chunk), int64(len(valid)*indexEntrySize)); err != nil {
+			return 0, fmt.Errorf("truncating index: %v", err)
+		}
+	}
+
+	var last indexEntry
+	if len(valid) > 0 {
+		last = valid[len(valid)-1]
+	}
+	c.lastIndexOff = last.Offset
+
+	n, err := c.countMessages(io.NewSectionReader(r, int64(last.Offset), size-int64(last.Offset)))
+	if err != nil {
+		return 0, err
+	}
+	return last.Seq + n, nil
+}
+
+// countMessages returns the number of complete messages in r.
+func (c *OnDisk) countMessages(r io.Reader) (uint64, error) {
+	if c.format == protocol.FormatFramed {
+		rr := protocol.NewRecordReader(r)
+		var n uint64
+		for {
+			_, _, err := rr.Next()
+			if err == io.EOF {
+				return n, nil
+			} else if err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	var n uint64
+	for {
+		cnt, err := r.Read(buf)
+		n += uint64(bytes.Count(buf[:cnt], []byte{'\n'}))
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// skipMessages returns the offset of the message that is skip
+// messages after the one at off, or the end of r if there are less messages.
+func (c *OnDisk) skipMessages(r io.ReaderAt, size int64, off int64, skip uint64) (int64, error) {
+	if skip == 0 {
+		return off, nil
+	}
+
+	if c.format == protocol.FormatFramed {
+		rr := protocol.NewRecordReader(io.NewSectionReader(r, off, size-off))
+		for ; skip > 0; skip-- {
+			_, n, err := rr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+			off += int64(n)
+		}
+		return off, nil
+	}
+
+	buf := make([]byte, 64*1024)
+	for off < size {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		for i, b := range buf[:n] {
+			if b != '\n' {
+				continue
+			}
+			skip--
+			if skip == 0 {
+				return off + int64(i) + 1, nil
+			}
+		}
+		off += int64(n)
+	}
+	return size, nil
+}
+
+// MessageOffset returns the offset of the message number seq (starting from 0)
+// in the chunk. The size of the chunk is returned if it has less messages.
+func (c *OnDisk) MessageOffset(chunk string, seq uint64) (uint64, error) {
+	chunk = filepath.Clean(chunk)
+	entries, err := c.readIndex(chunk)
+	if err != nil {
+		return 0, fmt.Errorf("reading index of %q: %v", chunk, err)
+	}
+
+	var start indexEntry
+	for _, e := range entries {
+		if e.Seq > seq {
+			break
+		}
+		start = e
+	}
+
+	fp, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Release()
+
+	off, err := c.skipMessages(fp, size, int64(start.Offset), seq-start.Seq)
+	if err != nil {
+		return 0, fmt.Errorf("scanning %q: %v", chunk, err)
+	}
+	return uint64(off), nil
+}
+
+// TimeOffset returns the offset in the chunk from which all messages written
+// at or after t can be read. The messages of the newline categories are only
+// timestamped at the index entries, so a few earlier messages can be returned
+// too. The framed messages carry their own time, so the offset is exact.
+func (c *OnDisk) TimeOffset(chunk string, t time.Time) (uint64, error) {
+	chunk = filepath.Clean(chunk)
+	if _, exists, err := c.ChunkSize(chunk); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, fmt.Errorf("stat %q: %w", chunk, os.ErrNotExist)
+	}
+
+	entries, err := c.readIndex(chunk)
+	if err != nil {
+		return 0, fmt.Errorf("reading index of %q: %v", chunk, err)
+	}
+
+	var off uint64
+	for _, e := range entries {
+		if e.Time >= t.UnixNano() {
+			break
+		}
+		off = e.Offset
+	}
+	if c.format != protocol.FormatFramed {
+		return off, nil
+	}
+
+	fp, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Release()
+
+	exact, err := skipBefore(fp, size, int64(off), t)
+	if err != nil {
+		return 0, fmt.Errorf("scanning %q: %v", chunk, err)
+	}
+	return uint64(exact), nil
+}
+
+// skipBefore returns the offset of the first framed message at or after off
+// that was written at or after t. The messages without the time are never
+// skipped.
+func skipBefore(r io.ReaderAt, size int64, off int64, t time.Time) (int64, error) {
+	rr := protocol.NewRecordReader(io.NewSectionReader(r, off, size-off))
+	for {
+		rec, n, err := rr.Next()
+		if err == io.EOF {
+			return off, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("reading record at offset %d: %v", off, err)
+		}
+
+		m, err := protocol.DecodeMessage(rec)
+		if err != nil {
+			return 0, fmt.Errorf("reading record at offset %d: %v", off, err)
+		}
+		if m.Time.IsZero() || !m.Time.Before(t) {
+			return off, nil
+		}
+		off += int64(n)
+	}
+}
+
+// indexBatch adds the index entry for the batch of messages that was
+// written at off at the time now if it is far enough from the previous one
+// either in bytes or in time. It must be called with writeMu held.
+func (c *OnDisk) indexBatch(off uint64, now time.Time) {
+	if off != 0 && off-c.lastIndexOff < indexIntervalBytes && now.Sub(c.lastIndexTime) < indexIntervalTime {
+		return
+	}
+
+	err := c.writeIndexEntry(indexEntry{
+		Seq:    c.lastChunkMsgs,
+		Offset: off,
+		Time:   now.UnixNano(),
+	})
+	if err != nil {
+		// the index is only used to speed up the seeks, so a missing
+		// entry just makes them scan a bit more
+		log.Printf("writing index entry for chunk %q failed: %v", c.lastChunk, err)
+		return
+	}
+	c.lastIndexOff = off
+	c.lastIndexTime = now
+}
+
+// indexReplicated adds the index entries for the contents that were appended
+// at off to the replicated chunk. The messages of the newline categories are
+// indexed with the time they were replicated at, which is never earlier than
+// the time they were written at on the owner, so the seeks by time do not
+// skip any message. The framed messages are indexed with their own time.
+func (c *OnDisk) indexReplicated(chunk string, off uint64, contents []byte, now time.Time) error {
+	fp, err := os.OpenFile(c.indexFilename(chunk), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	// the last entry could be written partially
+	entries := fi.Size() / indexEntrySize
+	var last indexEntry
+	if entries > 0 {
+		var buf [indexEntrySize]byte
+		if _, err := fp.ReadAt(buf[:], (entries-1)*indexEntrySize); err != nil {
+			return err
+		}
+		last = indexEntry{
+			Seq:    binary.BigEndian.Uint64(buf[0:8]),
+			Offset: binary.BigEndian.Uint64(buf[8:16]),
+			Time:   int64(binary.BigEndian.Uint64(buf[16:24])),
+		}
+	}
+	if last.Offset > off {
+		// the index does not match the chunk, start over
+		entries, last = 0, indexEntry{}
+	}
+
+	seq := last.Seq
+	if off > last.Offset {
+		chunkFp, err := os.Open(c.chunkFilename(chunk))
+		if err != nil {
+			return err
+		}
+		n, err := c.countMessages(io.NewSectionReader(chunkFp, int64(last.Offset), int64(off-last.Offset)))
+		chunkFp.Close()
+		if err != nil {
+			return fmt.Errorf("counting messages: %v", err)
+		}
+		seq += n
+	}
+
+	var buf []byte
+	lastOff := last.Offset
+	rr := protocol.NewRecordReader(bytes.NewReader(contents))
+	for pos := 0; pos < len(contents); seq++ {
+		msgOff := off + uint64(pos)
+		var n int
+		msgTime := now
+		if c.format == protocol.FormatFramed {
+			rec, recLen, err := rr.Next()
+			if err != nil {
+				return fmt.Errorf("reading record at offset %d: %v", msgOff, err)
+			}
+			if m, err := protocol.DecodeMessage(rec); err == nil && !m.Time.IsZero() {
+				msgTime = m.Time
+			}
+			n = recLen
+		} else {
+			n = bytes.IndexByte(contents[pos:], '\n') + 1
+			if n == 0 {
+				n = len(contents) - pos
+			}
+		}
+		pos += n
+
+		if msgOff != 0 && (entries > 0 || len(buf) > 0) && msgOff-lastOff < indexIntervalBytes {
+			continue
+		}
+		var e [indexEntrySize]byte
+		binary.BigEndian.PutUint64(e[0:8], seq)
+		binary.BigEndian.PutUint64(e[8:16], msgOff)
+		binary.BigEndian.PutUint64(e[16:24], uint64(msgTime.UnixNano()))
+		buf = append(buf, e[:]...)
+		lastOff = msgOff
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if err := fp.Truncate(entries * indexEntrySize); err != nil {
+		return err
+	}
+	_, err = fp.WriteAt(buf, entries*indexEntrySize)
+	return err
+}
+
+// indexSealedReplica builds the index of the replicated chunk that was
+// downloaded without one, e.g. before the replicas were indexed.
+func (c *OnDisk) indexSealedReplica(chunk string) error {
+	if _, err := os.Stat(c.indexFilename(chunk)); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return err
+	}
+	defer h.Release()
+	contents := make([]byte, size)
+	if _, err := h.ReadAt(contents, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return c.indexReplicated(chunk, 0, contents, time.Now())
+}
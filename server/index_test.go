@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// testSendNumbers sends the messages "0".."n-1" in batches of batchSize messages
+// and returns the offsets of every message.
+func testSendNumbers(t *testing.T, srv *OnDisk, n, batchSize int) []uint64 {
+	t.Helper()
+
+	var offsets []uint64
+	var size uint64
+	for i := 0; i < n; i += batchSize {
+		// the framed messages are stored with the time
+		var batch, stored []byte
+		for j := i; j < i+batchSize && j < n; j++ {
+			offsets = append(offsets, size+uint64(len(stored)))
+			msg := fmt.Sprintf("%08d", j)
+			if srv.Format() == protocol.FormatFramed {
+				batch = protocol.AppendRecord(batch, 0, []byte(msg))
+				stored = protocol.AppendMessage(stored, protocol.Message{Value: []byte(msg), Time: time.Now()})
+			} else {
+				batch = append(batch, msg+"\n"...)
+				stored = batch
+			}
+		}
+		if err := srv.Send(context.Background(), batch); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		size += uint64(len(stored))
+	}
+	return offsets
+}
+
+func TestMessageOffset(t *testing.T) {
+	for _, format := range []protocol.Format{protocol.FormatNewline, protocol.FormatFramed} {
+		t.Run(format.String(), func(t *testing.T) {
+			srv := testNewOnDiskWithConfig(t, getTempDir(t), config.Category{Format: format})
+			offsets := testSendNumbers(t, srv, 5000, 100)
+
+			entries, err := srv.readIndex(srv.lastChunk)
+			if err != nil {
+				t.Fatalf("readIndex() = %v, want no errors", err)
+			}
+			if len(entries) < 2 {
+				t.Fatalf("len(index entries) = %d, want at least 2", len(entries))
+			}
+
+			for _, seq := range []uint64{0, 1, 99, 100, 2345, 4999} {
+				got, err := srv.MessageOffset(srv.lastChunk, seq)
+				if err != nil {
+					t.Fatalf("MessageOffset(%d) = %v, want no errors", seq, err)
+				}
+				if want := offsets[seq]; got != want {
+					t.Errorf("MessageOffset(%d) = %d, want %d", seq, got, want)
+				}
+			}
+
+			got, err := srv.MessageOffset(srv.lastChunk, 5000)
+			if err != nil {
+				t.Fatalf("MessageOffset(5000) = %v, want no errors", err)
+			}
+			if want := srv.lastChunkSize; got != want {
+				t.Errorf("MessageOffset(past the end) = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestTimeOffset(t *testing.T) {
+	srv := testNewOnDisk(t, getTempDir(t))
+
+	// every batch is bigger than the index interval and gets its own entry
+	testSendNumbers(t, srv, 1000, 1000)
+	testSendNumbers(t, srv, 1000, 1000)
+	middle := time.Now()
+	time.Sleep(time.Millisecond)
+	testSendNumbers(t, srv, 1000, 1000)
+
+	// only the start of every indexed batch is timestamped,
+	// so the last batch that started before `middle` is included too
+	got, err := srv.TimeOffset(srv.lastChunk, middle)
+	if err != nil {
+		t.Fatalf("TimeOffset() = %v, want no errors", err)
+	}
+	if want := uint64(1000 * 9); got != want {
+		t.Errorf("TimeOffset(middle) = %d, want %d", got, want)
+	}
+
+	got, err = srv.TimeOffset(srv.lastChunk, middle.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("TimeOffset() = %v, want no errors", err)
+	}
+	if got != 0 {
+		t.Errorf("TimeOffset(before the first message) = %d, want 0", got)
+	}
+}
+
+func TestRecoveryRestoresMessageCount(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDisk(t, dir)
+	testSendNumbers(t, srv, 3000, 100)
+	chunk := srv.lastChunk
+	srv.Close()
+
+	// simulate a torn write at the end of the chunk
+	fp, err := os.OpenFile(filepath.Join(dir, chunk), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	fp.WriteString("0000")
+	fp.Close()
+
+	srv = testNewOnDisk(t, dir)
+	if got, want := srv.lastChunkMsgs, uint64(3000); got != want {
+		t.Fatalf("messages after recovery = %d, want %d", got, want)
+	}
+	offsets := testSendNumbers(t, srv, 1, 1)
+
+	got, err := srv.MessageOffset(chunk, 3000)
+	if err != nil {
+		t.Fatalf("MessageOffset() = %v, want no errors", err)
+	}
+	if want := uint64(3000*9) + offsets[0]; got != want {
+		t.Errorf("MessageOffset(3000) = %d, want %d", got, want)
+	}
+}
+
+func TestReplicaSeek(t *testing.T) {
+	for _, format := range []protocol.Format{protocol.FormatNewline, protocol.FormatFramed} {
+		t.Run(format.String(), func(t *testing.T) {
+			cfg := config.Category{Format: format}
+			src := testNewOnDiskWithConfig(t, getTempDir(t), cfg)
+			offsets := testSendNumbers(t, src, 2000, 100)
+			middle := time.Now()
+			time.Sleep(time.Millisecond)
+			base := src.lastChunkSize
+			for _, off := range testSendNumbers(t, src, 2000, 100) {
+				offsets = append(offsets, base+off)
+			}
+			chunk := src.lastChunk
+
+			dir := getTempDir(t)
+			dst := testNewOnDiskWithConfig(t, dir, cfg)
+			for {
+				size, _, err := dst.ChunkSize(chunk)
+				if err != nil {
+					t.Fatalf("ChunkSize() failed: %v", err)
+				}
+				var b bytes.Buffer
+				if err := src.Recv(chunk, uint(size), 10000, &b); err != nil {
+					t.Fatalf("Recv() failed: %v", err)
+				}
+				if b.Len() == 0 {
+					break
+				}
+				if err := dst.WriteDirectly(chunk, b.Bytes()); err != nil {
+					t.Fatalf("WriteDirectly() failed: %v", err)
+				}
+			}
+
+			check := func(t *testing.T) {
+				entries, err := dst.readIndex(chunk)
+				if err != nil || len(entries) < 2 {
+					t.Fatalf("readIndex() = %d entries, %v; want the replica to be indexed", len(entries), err)
+				}
+				for _, seq := range []uint64{0, 1, 99, 100, 2345, 3999} {
+					got, err := dst.MessageOffset(chunk, seq)
+					if err != nil {
+						t.Fatalf("MessageOffset(%d) = %v, want no errors", seq, err)
+					}
+					if want := offsets[seq]; got != want {
+						t.Errorf("MessageOffset(%d) = %d, want %d", seq, got, want)
+					}
+				}
+
+				got, err := dst.TimeOffset(chunk, middle)
+				if err != nil {
+					t.Fatalf("TimeOffset() = %v, want no errors", err)
+				}
+				want, err := src.TimeOffset(chunk, middle)
+				if err != nil {
+					t.Fatalf("TimeOffset() on the owner = %v, want no errors", err)
+				}
+				// the newline messages are timestamped when they are replicated
+				if got > want || (format == protocol.FormatFramed && got != want) {
+					t.Errorf("TimeOffset(middle) = %d, the owner returns %d", got, want)
+				}
+				if got, err := dst.TimeOffset(chunk, time.Now()); err != nil || got == 0 {
+					t.Errorf("TimeOffset(now) = %d, %v; want the index to skip the old messages", got, err)
+				}
+			}
+
+			t.Run("downloaded", check)
+
+			// the chunk was downloaded before the replicas were indexed
+			if err := os.Remove(filepath.Join(dir, chunk+indexSuffix)); err != nil {
+				t.Fatalf("Remove() failed: %v", err)
+			}
+			if err := dst.SealDirectly(chunk, protocol.ChunkMeta{}); err != nil {
+				t.Fatalf("SealDirectly() failed: %v", err)
+			}
+			t.Run("sealed", check)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// metaSuffix is the suffix of the JSON file with protocol.ChunkMeta of the
+// complete chunk. The metadata of the active chunk is kept in memory.
+const metaSuffix = ".meta"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errChecksumMismatch means that the replicated chunk differs from the source.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+func formatChecksum(crc uint32) string {
+	return fmt.Sprintf("%08x", crc)
+}
+
+func (c *OnDisk) metaFilename(chunk string) string {
+	return c.chunkFilename(chunk) + metaSuffix
+}
+
+// chunkOwner returns the instance that created the chunk.
+func chunkOwner(chunk string) string {
+	return chunk[:strings.LastIndex(chunk, "-chunk")]
+}
+
+// writeMeta atomically writes the metadata of the complete chunk.
+func (c *OnDisk) writeMeta(chunk string, meta protocol.ChunkMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(c.metaFilename(chunk), b); err != nil {
+		return fmt.Errorf("writing metadata of %q: %v", chunk, err)
+	}
+
+	c.metaMu.Lock()
+	c.metas[chunk] = &meta
+	c.metaMu.Unlock()
+	return nil
+}
+
+// readMeta returns the metadata of the complete chunk, nil if there is none.
+// The metadata never changes once written, so it is cached.
+func (c *OnDisk) readMeta(chunk string) (*protocol.ChunkMeta, error) {
+	c.metaMu.Lock()
+	meta, ok := c.metas[chunk]
+	c.metaMu.Unlock()
+	if ok {
+		return meta, nil
+	}
+
+	b, err := os.ReadFile(c.metaFilename(chunk))
+	if errors.Is(err, os.ErrNotExist) {
+		// the chunks sealed before the metadata was introduced
+		meta = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		meta = &protocol.ChunkMeta{}
+		if err := json.Unmarshal(b, meta); err != nil {
+			return nil, fmt.Errorf("parsing metadata of %q: %v", chunk, err)
+		}
+	}
+
+	c.metaMu.Lock()
+	c.metas[chunk] = meta
+	c.metaMu.Unlock()
+	return meta, nil
+}
+
+func (c *OnDisk) forgetMeta(chunk string) {
+	c.metaMu.Lock()
+	delete(c.metas, chunk)
+	c.metaMu.Unlock()
+}
+
+// activeMeta returns the metadata of the active chunk.
+// It must be called with writeMu held.
+func (c *OnDisk) activeMeta() protocol.ChunkMeta {
+	return protocol.ChunkMeta{
+		Messages:  c.lastChunkMsgs,
+		FirstTime: c.lastChunkFirstTime,
+		LastTime:  c.lastChunkLastTime,
+		Checksum:  formatChecksum(c.lastChunkCRC),
+		Owner:     c.instanceName,
+		Created:   c.lastChunkCreated,
+	}
+}
+
+// scanMeta computes the metadata of the chunk contents in r: the number of
+// messages, the checksum and, for the framed categories, the times of the
+// first and the last message. It also returns the raw checksum.
+func (c *OnDisk) scanMeta(r io.ReaderAt, size int64) (protocol.ChunkMeta, uint32, error) {
+	var meta protocol.ChunkMeta
+	crc := crc32.New(crcTable)
+	sr := io.NewSectionReader(r, 0, size)
+
+	if c.format != protocol.FormatFramed {
+		msgs, err := c.countMessages(io.TeeReader(sr, crc))
+		if err != nil {
+			return meta, 0, err
+		}
+		meta.Messages = msgs
+		meta.Checksum = formatChecksum(crc.Sum32())
+		return meta, crc.Sum32(), nil
+	}
+
+	rr := protocol.NewRecordReader(io.TeeReader(sr, crc))
+	for {
+		rec, _, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return meta, 0, err
+		}
+		m, err := protocol.DecodeMessage(rec)
+		if err != nil {
+			return meta, 0, err
+		}
+		meta.Messages++
+		if meta.FirstTime.IsZero() {
+			meta.FirstTime = m.Time
+		}
+		if !m.Time.IsZero() {
+			meta.LastTime = m.Time
+		}
+	}
+	meta.Checksum = formatChecksum(crc.Sum32())
+	return meta, crc.Sum32(), nil
+}
+
+// computeMeta computes the metadata of the chunk that was written without
+// it being tracked, e.g. before the restart. The times of the newline
+// messages come from the index and the modification time of the chunk.
+func (c *OnDisk) computeMeta(chunk string) (protocol.ChunkMeta, uint32, error) {
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return protocol.ChunkMeta{}, 0, err
+	}
+	defer h.Release()
+
+	meta, crc, err := c.scanMeta(h, size)
+	if err != nil {
+		return protocol.ChunkMeta{}, 0, fmt.Errorf("scanning %q: %v", chunk, err)
+	}
+
+	modTime, err := c.chunkModTime(chunk)
+	if err != nil {
+		return protocol.ChunkMeta{}, 0, err
+	}
+	if meta.FirstTime.IsZero() {
+		entries, err := c.readIndex(chunk)
+		if err != nil {
+			return protocol.ChunkMeta{}, 0, err
+		}
+		if len(entries) > 0 {
+			meta.FirstTime = time.Unix(0, entries[0].Time)
+		}
+	}
+	if meta.LastTime.IsZero() && meta.Messages > 0 {
+		meta.LastTime = modTime
+	}
+	meta.Owner = chunkOwner(chunk)
+	meta.Created = meta.FirstTime
+	if meta.Created.IsZero() {
+		meta.Created = modTime
+	}
+	return meta, crc, nil
+}
+
+// verifyChecksum checks that the contents in r match the metadata
+// of the source chunk, if it has a checksum.
+func (c *OnDisk) verifyChecksum(r io.ReaderAt, size int64, want protocol.ChunkMeta) error {
+	if want.Checksum == "" {
+		return nil
+	}
+	got, _, err := c.scanMeta(r, size)
+	if err != nil {
+		return err
+	}
+	if got.Checksum != want.Checksum {
+		return fmt.Errorf("%w: got %s, want %s", errChecksumMismatch, got.Checksum, want.Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+func testListedChunk(t *testing.T, srv *OnDisk, chunk string) protocol.Chunk {
+	t.Helper()
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	for _, ch := range chunks {
+		if ch.Name == chunk {
+			return ch
+		}
+	}
+	t.Fatalf("ListChunks() = %+v, want %q", chunks, chunk)
+	return protocol.Chunk{}
+}
+
+func TestChunkMeta(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed})
+
+	before := time.Now()
+	testSendNumbers(t, srv, 3, 2)
+	after := time.Now()
+	chunk := srv.lastChunk
+
+	active := testListedChunk(t, srv, chunk)
+	if active.Messages != 3 || active.Owner != "moscow" || active.Checksum != "" {
+		t.Errorf("metadata of the active chunk = %+v, want 3 messages of moscow without the checksum", active.ChunkMeta)
+	}
+	if active.FirstTime.Before(before) || active.LastTime.After(after) || active.LastTime.Before(active.FirstTime) {
+		t.Errorf("times of the active chunk = %v..%v, want between %v and %v", active.FirstTime, active.LastTime, before, after)
+	}
+
+	srv.writeMu.Lock()
+	err := srv.rollLastChunk()
+	srv.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("rollLastChunk() failed: %v", err)
+	}
+
+	contents, err := os.ReadFile(srv.chunkFilename(chunk))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	sealed := testListedChunk(t, srv, chunk)
+	if want := formatChecksum(crc32.Checksum(contents, crcTable)); sealed.Checksum != want {
+		t.Errorf("checksum of the sealed chunk = %q, want %q", sealed.Checksum, want)
+	}
+	if sealed.Messages != 3 || !sealed.FirstTime.Equal(active.FirstTime) || !sealed.LastTime.Equal(active.LastTime) {
+		t.Errorf("metadata of the sealed chunk = %+v, want %+v with the checksum", sealed.ChunkMeta, active.ChunkMeta)
+	}
+
+	// the metadata of the sealed chunks survives restarts
+	srv.Close()
+	srv = testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed})
+	if got := testListedChunk(t, srv, chunk); got.Checksum != sealed.Checksum || got.Messages != 3 || !got.Created.Equal(sealed.Created) {
+		t.Errorf("metadata after the restart = %+v, want %+v", got.ChunkMeta, sealed.ChunkMeta)
+	}
+
+	// the metadata of the recovered active chunk is computed from its contents
+	testSendNumbers(t, srv, 5, 5)
+	chunk = srv.lastChunk
+	srv.Close()
+	srv = testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed})
+	testSendNumbers(t, srv, 1, 1)
+	srv.writeMu.Lock()
+	err = srv.rollLastChunk()
+	srv.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("rollLastChunk() failed: %v", err)
+	}
+	contents, err = os.ReadFile(srv.chunkFilename(chunk))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	recovered := testListedChunk(t, srv, chunk)
+	if want := formatChecksum(crc32.Checksum(contents, crcTable)); recovered.Checksum != want || recovered.Messages != 6 {
+		t.Errorf("metadata of the recovered chunk = %+v, want 6 messages with checksum %q", recovered.ChunkMeta, want)
+	}
+}
+
+func TestSealDirectlyVerifiesChecksum(t *testing.T) {
+	src := testNewOnDiskWithConfig(t, getTempDir(t), config.Category{Format: protocol.FormatFramed})
+	if err := src.Send(context.Background(), protocol.AppendMessage(nil, protocol.Message{Value: []byte("hello")})); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	chunk := src.lastChunk
+	src.writeMu.Lock()
+	err := src.rollLastChunk()
+	src.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("rollLastChunk() failed: %v", err)
+	}
+	source := testListedChunk(t, src, chunk)
+	contents, err := os.ReadFile(src.chunkFilename(chunk))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+
+	dst := testNewOnDiskWithConfig(t, getTempDir(t), config.Category{Format: protocol.FormatFramed})
+	corrupted := protocol.AppendMessage(nil, protocol.Message{Value: []byte("HELLO"), Time: time.Now()})
+	if err := dst.WriteDirectly(chunk, corrupted); err != nil {
+		t.Fatalf("WriteDirectly() failed: %v", err)
+	}
+	if err := dst.SealDirectly(chunk, source.ChunkMeta); !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("SealDirectly() of a different chunk = %v, want %v", err, errChecksumMismatch)
+	}
+	if _, exists, _ := dst.ChunkSize(chunk); exists {
+		t.Errorf("the chunk that does not match the source must be removed")
+	}
+
+	if err := dst.WriteDirectly(chunk, contents); err != nil {
+		t.Fatalf("WriteDirectly() failed: %v", err)
+	}
+	if err := dst.SealDirectly(chunk, source.ChunkMeta); err != nil {
+		t.Fatalf("SealDirectly() = %v, want no errors", err)
+	}
+	got := testListedChunk(t, dst, chunk)
+	if !got.Complete || got.Checksum != source.Checksum || got.Owner != "moscow" || got.Messages != 1 {
+		t.Errorf("replicated chunk = %+v, want complete with the metadata %+v", got, source.ChunkMeta)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package server
+
+import "os"
+
+// mmapChunk reads the chunk from the file on the platforms without mmap.
+func mmapChunk(fp *os.File) (chunkReaderAt, error) {
+	return rawChunk{fp}, nil
+}
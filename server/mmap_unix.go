@@ -0,0 +1,62 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package server
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmappedChunk is a sealed chunk that is mapped into memory.
+type mmappedChunk struct {
+	fp   *os.File
+	data []byte
+}
+
+// mmapChunk maps the sealed chunk into memory. Empty chunks
+// can not be mapped and are read from the file instead.
+func mmapChunk(fp *os.File) (chunkReaderAt, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 || int64(int(fi.Size())) != fi.Size() {
+		return rawChunk{fp}, nil
+	}
+
+	data, err := syscall.Mmap(int(fp.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return rawChunk{fp}, nil
+	}
+	return &mmappedChunk{fp: fp, data: data}, nil
+}
+
+func (m *mmappedChunk) Bytes() []byte {
+	return m.data
+}
+
+func (m *mmappedChunk) Size() (int64, error) {
+	return int64(len(m.data)), nil
+}
+
+func (m *mmappedChunk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmappedChunk) Close() error {
+	err := syscall.Munmap(m.data)
+	if cerr := m.fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// scanBufSize is the size of the window used to look for message
+// boundaries in the chunks that are not memory-mapped.
+const scanBufSize = 64 * 1024
+
+var scanBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, scanBufSize)
+		return &b
+	},
+}
+
+// mappedChunk is implemented by the chunks whose contents are memory-mapped.
+type mappedChunk interface {
+	Bytes() []byte
+}
+
+// completeLength returns the length of the longest part of the chunk
+// starting at off that only contains complete messages and is not bigger
+// than maxSize. off must be at a message boundary.
+//
+// The framed records are not checksummed here, they were validated when
+// written and the clients and the replicas validate what they receive.
+func (c *OnDisk) completeLength(r io.ReaderAt, size int64, off int64, maxSize int64) (int64, error) {
+	end := off + maxSize
+	if end > size {
+		end = size
+	}
+	if off >= end {
+		return 0, nil
+	}
+
+	var data []byte
+	if m, ok := r.(mappedChunk); ok {
+		data = m.Bytes()
+	}
+
+	if c.format == protocol.FormatFramed {
+		if data != nil {
+			return framedLengthMapped(data[off:end])
+		}
+		return framedLength(r, off, end)
+	}
+
+	if data != nil {
+		return int64(bytes.LastIndexByte(data[off:end], '\n') + 1), nil
+	}
+	last, err := lastNewline(r, off, end)
+	if err != nil {
+		return 0, err
+	}
+	return last - off, nil
+}
+
+func framedLengthMapped(data []byte) (int64, error) {
+	var n int
+	for len(data)-n >= protocol.RecordHeaderSize {
+		size, err := protocol.RecordSize(data[n:])
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", n, err)
+		}
+		if n+size > len(data) {
+			break
+		}
+		n += size
+	}
+	return int64(n), nil
+}
+
+// framedLength walks the record headers between off and end reading
+// them in windows of scanBufSize.
+func framedLength(r io.ReaderAt, off int64, end int64) (int64, error) {
+	bufp := scanBufPool.Get().(*[]byte)
+	defer scanBufPool.Put(bufp)
+	buf := *bufp
+
+	pos := off
+	// the window buf[:n] contains the contents of the chunk at winOff
+	var winOff int64
+	var n int
+	for end-pos >= protocol.RecordHeaderSize {
+		if pos < winOff || pos+protocol.RecordHeaderSize > winOff+int64(n) {
+			winOff = pos
+			var err error
+			n, err = r.ReadAt(buf[:minInt64(int64(len(buf)), end-pos)], pos)
+			if n < protocol.RecordHeaderSize {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		}
+
+		size, err := protocol.RecordSize(buf[pos-winOff:])
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", pos, err)
+		}
+		if pos+int64(size) > end {
+			break
+		}
+		pos += int64(size)
+	}
+	return pos - off, nil
+}
+
+// lastNewline returns the position right after the last newline
+// between start and end, or start if there are none.
+func lastNewline(r io.ReaderAt, start int64, end int64) (int64, error) {
+	bufp := scanBufPool.Get().(*[]byte)
+	defer scanBufPool.Put(bufp)
+	buf := *bufp
+
+	for end > start {
+		from := end - int64(len(buf))
+		if from < start {
+			from = start
+		}
+		n, err := r.ReadAt(buf[:end-from], from)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return from + int64(i) + 1, nil
+		}
+		end = from
+	}
+	return start, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 256*1024)
+		return &b
+	},
+}
+
+// Recv writes the complete messages of the chunk starting at off,
+// at most maxSize bytes, to w.
+func (c *OnDisk) Recv(chunk string, off uint, maxSize uint, w io.Writer) error {
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return err
+	}
+	defer h.Release()
+
+	n, err := c.completeLength(h.chunkReaderAt, size, int64(off), int64(maxSize))
+	if err != nil || n == 0 {
+		return err
+	}
+
+	if m, ok := h.chunkReaderAt.(mappedChunk); ok {
+		_, err := w.Write(m.Bytes()[off : int64(off)+n])
+		return err
+	}
+
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+	_, err = io.CopyBuffer(w, io.NewSectionReader(h, int64(off), n), *bufp)
+	return err
+}
+
+// RecvStream returns the reader of the complete messages of the chunk
+// starting at off, at most maxSize bytes, and the number of bytes it
+// returns. The reader must be closed. The uncompressed chunks are sent
+// with sendfile when the reader is copied to a TCP connection.
+func (c *OnDisk) RecvStream(chunk string, off uint64, maxSize uint64) (io.ReadCloser, int64, error) {
+	h, size, err := c.chunkReader(chunk)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, err := c.completeLength(h.chunkReaderAt, size, int64(off), int64(maxSize))
+	if err != nil {
+		h.Release()
+		return nil, 0, err
+	}
+
+	if _, ok := h.chunkReaderAt.(*compressedChunk); ok || n == 0 {
+		return &handleStream{Reader: io.NewSectionReader(h, int64(off), n), h: h}, n, nil
+	}
+
+	// sendfile needs a descriptor positioned at off which can not be
+	// shared, the handle keeps the chunk alive while it is opened
+	defer h.Release()
+	fp, err := os.Open(c.chunkFilename(chunk))
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := fp.Seek(int64(off), io.SeekStart); err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	return &fileStream{fp: fp, lr: io.LimitedReader{R: fp, N: n}}, n, nil
+}
+
+// handleStream reads from the chunk handle and releases it when closed.
+type handleStream struct {
+	io.Reader
+	h *chunkHandle
+}
+
+func (s *handleStream) Close() error {
+	s.h.Release()
+	return nil
+}
+
+// fileStream reads a range of the chunk file. Like the big file reader
+// of fasthttp it hands *io.LimitedReader over *os.File to io.ReaderFrom
+// which is what triggers sendfile in net.TCPConn.
+type fileStream struct {
+	fp *os.File
+	lr io.LimitedReader
+}
+
+func (s *fileStream) Read(p []byte) (int, error) {
+	return s.lr.Read(p)
+}
+
+func (s *fileStream) WriteTo(w io.Writer) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(&s.lr)
+	}
+
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+	return io.CopyBuffer(w, &s.lr, *bufp)
+}
+
+func (s *fileStream) Close() error {
+	return s.fp.Close()
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+// inSyncTimeout is how long a replica is considered in sync after it
+// reported its progress. The replicas report it on every poll of the chunks
+// they download from this instance, and they keep polling the active chunk,
+// so the in-sync set is kept per category across the chunks.
+const inSyncTimeout = 10 * time.Second
+
+// replicaAckTimeout is how long a write waits for the replicas.
+const replicaAckTimeout = 5 * time.Second
+
+// ErrNotEnoughReplicas means that the write was not stored by as many
+// replicas as its acks setting requires.
+var ErrNotEnoughReplicas = errors.New("not enough in-sync replicas")
+
+// replicaProgress is the last position a replica reported.
+type replicaProgress struct {
+	chunk string
+	off   uint64
+	seen  time.Time
+}
+
+// replicaWaiter is a write that waits for the replicas to store
+// its chunk up to end.
+type replicaWaiter struct {
+	chunk     string
+	end       uint64
+	confirmed map[string]bool
+	// notifyCh receives a value when a new replica confirms the write.
+	notifyCh chan struct{}
+}
+
+// Acks returns the acks setting of the category.
+func (c *OnDisk) Acks() config.Acks {
+	return c.acks
+}
+
+// ConfirmReplicated records that the instance stores the first off bytes
+// of the chunk of this instance.
+func (c *OnDisk) ConfirmReplicated(instance, chunk string, off uint64, now time.Time) {
+	c.replicaMu.Lock()
+	defer c.replicaMu.Unlock()
+
+	c.replicas[instance] = replicaProgress{chunk: chunk, off: off, seen: now}
+	for w := range c.replicaWaiters {
+		if w.chunk == chunk && off >= w.end && !w.confirmed[instance] {
+			w.confirmed[instance] = true
+			select {
+			case w.notifyCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// inSyncReplicas returns the replicas that reported their progress recently.
+// Must be called with replicaMu held.
+func (c *OnDisk) inSyncReplicas(now time.Time) []string {
+	var res []string
+	for instance, p := range c.replicas {
+		if now.Sub(p.seen) < inSyncTimeout {
+			res = append(res, instance)
+		}
+	}
+	return res
+}
+
+// requiredReplicas returns how many replicas must confirm the write.
+func requiredReplicas(acks config.Acks, inSync int) int {
+	if acks != config.AcksAll {
+		return int(acks)
+	}
+	if inSync == 0 {
+		return 1
+	}
+	return inSync
+}
+
+// SendReplicated writes msg like Send and waits until acks replicas store it.
+// It fails at once with ErrNotEnoughReplicas if fewer replicas are in sync,
+// and after replicaAckTimeout if they do not confirm the write. In the latter
+// case the messages are written by this instance and will be consumed anyway.
+func (c *OnDisk) SendReplicated(ctx context.Context, msg []byte, acks config.Acks) error {
+	_, err := c.sendReplicated(ctx, msg, acks)
+	return err
+}
+
+// sendReplicated is SendReplicated that also reports whether msg was written.
+func (c *OnDisk) sendReplicated(ctx context.Context, msg []byte, acks config.Acks) (bool, error) {
+	if acks == config.AcksLeader {
+		_, err := c.send(ctx, msg)
+		return err == nil, err
+	}
+	if err := c.checkInSync(ctx, acks, time.Now()); err != nil {
+		return false, err
+	}
+
+	pos, err := c.send(ctx, msg)
+	if err != nil {
+		return false, err
+	}
+	return true, c.waitForReplicas(ctx, pos, acks)
+}
+
+// checkInSync fails before anything is written if fewer replicas are
+// in sync than acks requires.
+func (c *OnDisk) checkInSync(ctx context.Context, acks config.Acks, now time.Time) error {
+	c.replicaMu.Lock()
+	inSync := len(c.inSyncReplicas(now))
+	c.replicaMu.Unlock()
+	if inSync >= requiredReplicas(acks, inSync) {
+		return nil
+	}
+	return fmt.Errorf("%w: %d in sync, acks %v", ErrNotEnoughReplicas, inSync, acks)
+}
+
+// openFollowedChunk creates the active chunk of the category with acks
+// if there is none. The replicas only report their progress, and so stay
+// in sync, while they follow a chunk that is not complete, so there must
+// be one before the first write. It must be called with writeMu held.
+func (c *OnDisk) openFollowedChunk(ctx context.Context) error {
+	if c.acks == config.AcksLeader || c.lastChunk != "" {
+		return nil
+	}
+	return c.openLastChunk(ctx)
+}
+
+// waitForReplicas blocks until the replicas required by acks store
+// the chunk of pos up to its end.
+func (c *OnDisk) waitForReplicas(ctx context.Context, pos writePos, acks config.Acks) error {
+	w := &replicaWaiter{
+		chunk:     pos.chunk,
+		end:       pos.end,
+		confirmed: make(map[string]bool),
+		notifyCh:  make(chan struct{}, 1),
+	}
+	c.replicaMu.Lock()
+	// the replicas that were faster than the registration
+	for instance, p := range c.replicas {
+		if p.chunk == pos.chunk && p.off >= pos.end {
+			w.confirmed[instance] = true
+		}
+	}
+	c.replicaWaiters[w] = struct{}{}
+	c.replicaMu.Unlock()
+
+	defer func() {
+		c.replicaMu.Lock()
+		delete(c.replicaWaiters, w)
+		c.replicaMu.Unlock()
+	}()
+
+	timer := time.NewTimer(replicaAckTimeout)
+	defer timer.Stop()
+
+	for {
+		c.replicaMu.Lock()
+		confirmed := len(w.confirmed)
+		inSync := c.inSyncReplicas(time.Now())
+		done := confirmed >= requiredReplicas(acks, len(inSync))
+		if done && acks == config.AcksAll {
+			for _, instance := range inSync {
+				done = done && w.confirmed[instance]
+			}
+		}
+		c.replicaMu.Unlock()
+		if done {
+			return nil
+		}
+
+		select {
+		case <-w.notifyCh:
+			continue
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		return fmt.Errorf("%w: %d of %d replicas stored the write to %q (acks %v), it is only guaranteed to be stored by %q",
+			ErrNotEnoughReplicas, confirmed, requiredReplicas(acks, len(inSync)), pos.chunk, acks, c.instanceName)
+	}
+}
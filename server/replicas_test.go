@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+// testConfirmLater confirms everything written to the chunk
+// on behalf of the instance after a while.
+func testConfirmLater(srv *OnDisk, instance, chunk string) {
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		srv.ConfirmReplicated(instance, chunk, 1<<40, time.Now())
+	}()
+}
+
+func TestSendReplicated(t *testing.T) {
+	srv := testNewOnDisk(t, getTempDir(t))
+	// kazan follows the chunk
+	srv.ConfirmReplicated("kazan", "moscow-chunk0", 0, time.Now())
+
+	testConfirmLater(srv, "kazan", "moscow-chunk0")
+	if err := srv.SendReplicated(context.Background(), []byte("1\n"), 1); err != nil {
+		t.Fatalf("SendReplicated(acks 1) = %v, want no errors", err)
+	}
+
+	testConfirmLater(srv, "kazan", "moscow-chunk0")
+	if err := srv.SendReplicated(context.Background(), []byte("2\n"), config.AcksAll); err != nil {
+		t.Fatalf("SendReplicated(acks all) = %v, want no errors", err)
+	}
+}
+
+func TestSendReplicatedNotConfirmed(t *testing.T) {
+	srv := testNewOnDisk(t, getTempDir(t))
+	// kazan stores the first message only
+	srv.ConfirmReplicated("kazan", "moscow-chunk0", 2, time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.SendReplicated(ctx, []byte("1\n"), 1); err != nil {
+		t.Fatalf("SendReplicated() = %v, want no errors", err)
+	}
+	err := srv.SendReplicated(ctx, []byte("2\n"), 1)
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Errorf("SendReplicated() = %v, want ErrNotEnoughReplicas", err)
+	}
+}
+
+func TestSendReplicatedInSync(t *testing.T) {
+	srv := testNewOnDisk(t, getTempDir(t))
+	if err := srv.Send(context.Background(), []byte("1\n")); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	srv.ConfirmReplicated("kazan", "moscow-chunk0", 2, time.Now())
+	srv.ConfirmReplicated("samara", "moscow-chunk0", 2, time.Now().Add(-time.Minute))
+
+	err := srv.SendReplicated(context.Background(), []byte("2\n"), 2)
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("SendReplicated(acks 2) = %v, want ErrNotEnoughReplicas with one replica in sync", err)
+	}
+	if got, want := testChunkContents(t, srv.dirname, srv), "1\n"; got != want {
+		t.Errorf("chunk contents = %q, want %q without the rejected write", got, want)
+	}
+}
+
+func TestSendReplicatedNoReplicas(t *testing.T) {
+	dir := getTempDir(t)
+	hooks := &recordingHooks{}
+	srv, err := NewOnDisk(dir, "numbers", "moscow", config.Category{}, hooks)
+	if err != nil {
+		t.Fatalf("NewOnDisk failed: %v", err)
+	}
+	defer srv.Close()
+
+	err = srv.SendReplicated(context.Background(), []byte("1\n"), 1)
+	if !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("SendReplicated(acks 1) = %v, want ErrNotEnoughReplicas without replicas", err)
+	}
+	// the rejected write has no side effects
+	if got := testChunkNames(t, srv); len(got) != 0 {
+		t.Errorf("ListChunks() = %v, want no chunks after the rejected write", got)
+	}
+	if len(hooks.created) != 0 {
+		t.Errorf("BeforeCreatingChunk() called for %v, want no calls", hooks.created)
+	}
+}
+
+func TestFollowedChunk(t *testing.T) {
+	dir := getTempDir(t)
+	hooks := &recordingHooks{}
+	srv, err := NewOnDisk(dir, "numbers", "moscow", config.Category{Acks: 1, MaxChunkAge: config.Duration(time.Hour)}, hooks)
+	if err != nil {
+		t.Fatalf("NewOnDisk failed: %v", err)
+	}
+	defer srv.Close()
+
+	// the replicas can start following the empty chunk
+	want := []string{"moscow-chunk0"}
+	if got := testChunkNames(t, srv); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListChunks() = %v, want %v", got, want)
+	}
+	if err := srv.SendReplicated(context.Background(), []byte("1\n"), 1); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Fatalf("SendReplicated(acks 1) = %v, want ErrNotEnoughReplicas without replicas", err)
+	}
+	if got := testChunkNames(t, srv); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListChunks() = %v, want %v after the rejected write", got, want)
+	}
+	if !reflect.DeepEqual(hooks.created, want) {
+		t.Errorf("BeforeCreatingChunk() called for %v, want %v", hooks.created, want)
+	}
+
+	// the next chunk is there for the replicas once the active one is sealed
+	if err := srv.Send(context.Background(), []byte("1\n")); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if err := srv.sealExpiredChunk(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("sealExpiredChunk() failed: %v", err)
+	}
+	want = []string{"moscow-chunk0", "moscow-chunk1"}
+	if got := testChunkNames(t, srv); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListChunks() = %v, want %v after the rollover", got, want)
+	}
+	srv.Close()
+
+	// the empty chunk is recovered after a restart instead of creating another one
+	srv, err = NewOnDisk(dir, "numbers", "moscow", config.Category{Acks: 1}, hooks)
+	if err != nil {
+		t.Fatalf("NewOnDisk failed: %v", err)
+	}
+	defer srv.Close()
+	if got := testChunkNames(t, srv); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListChunks() = %v, want %v after the restart", got, want)
+	}
+}
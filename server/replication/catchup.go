@@ -0,0 +1,153 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// catchUpInterval is the minimum time between two chunks that the catch-up
+// adds to the replication queue, so that a new instance does not start
+// downloading everything at once.
+const catchUpInterval = 100 * time.Millisecond
+
+// CatchUp adds the chunks that this instance should store but does not have
+// to its replication queue, e.g. when it joined the cluster after they were
+// created or came back empty after a disk replacement. The chunks are listed
+// on their owners: every chunk of a category without a replication factor
+// and the chunks that were placed on this instance otherwise. It is called
+// on start and every time the instance registers again, the calls that
+// overlap run one after another.
+func (c *Client) CatchUp(ctx context.Context) error {
+	c.catchUpMu.Lock()
+	defer c.catchUpMu.Unlock()
+
+	peers, err := c.st.ListPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("getting peers from etcd: %v", err)
+	}
+	queue, err := c.st.ReplicationQueue(ctx, c.instanceName)
+	if err != nil {
+		return fmt.Errorf("getting the replication queue: %v", err)
+	}
+	queued := make(map[Chunk]bool, len(queue))
+	for _, ch := range queue {
+		queued[ch] = true
+	}
+
+	ticker := time.NewTicker(catchUpInterval)
+	defer ticker.Stop()
+
+	var added int
+	for _, p := range peers {
+		if p.InstanceName == c.instanceName {
+			continue
+		}
+		missing, err := c.missingChunks(ctx, p)
+		if err != nil {
+			// the other peers can still be caught up with
+			log.Printf("could not catch up with peer %q: %v", p.InstanceName, err)
+			continue
+		}
+		for _, ch := range missing {
+			if queued[ch] {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			if err := c.st.AddChunkToReplicationQueue(ctx, c.instanceName, ch); err != nil {
+				return fmt.Errorf("could not write to replication queue: %w", err)
+			}
+			added++
+		}
+	}
+	log.Printf("catch-up added %d chunks to the replication queue", added)
+	return nil
+}
+
+// missingChunks returns the chunks owned by the peer that this instance
+// should store but does not have completely.
+func (c *Client) missingChunks(ctx context.Context, p Peer) ([]Chunk, error) {
+	addr := "http://" + p.ListenAddr
+	categories, err := c.listCategories(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Chunk
+	for _, category := range categories {
+		chunks, err := c.c.ListChunks(category, addr)
+		if err != nil {
+			return nil, fmt.Errorf("listing chunks of %q: %v", category, err)
+		}
+		for _, info := range chunks {
+			// the replicas of the other instances are copied from their owners
+			if !strings.HasPrefix(info.Name, p.InstanceName+"-") {
+				continue
+			}
+			ch := Chunk{Owner: p.InstanceName, Category: category, FileName: info.Name}
+			placed, err := c.placedHere(ctx, ch)
+			if err != nil {
+				return nil, err
+			}
+			if !placed {
+				continue
+			}
+			size, exists, err := c.wr.Stat(category, info.Name)
+			if err != nil {
+				return nil, fmt.Errorf("getting file stat: %v", err)
+			}
+			if exists && uint64(size) >= info.Size {
+				// the replica that crashed before the seal is queued again,
+				// the download seals it without copying anything
+				sealed, err := c.wr.Sealed(category, info.Name)
+				if err != nil {
+					return nil, fmt.Errorf("getting the seal of %q: %v", info.Name, err)
+				}
+				if sealed || !info.Complete {
+					continue
+				}
+			}
+			res = append(res, ch)
+		}
+	}
+	return res, nil
+}
+
+// placedHere reports whether this instance should store the chunk.
+func (c *Client) placedHere(ctx context.Context, ch Chunk) (bool, error) {
+	if c.cfg.Category(ch.Category).ReplicationFactor <= 0 {
+		return true, nil
+	}
+	instances, err := c.st.ChunkReplicas(ctx, ch.Category, ch.FileName)
+	if err != nil {
+		return false, err
+	}
+	// the chunks created before the replicas were recorded are stored by everyone
+	return instances == nil || containsString(instances, c.instanceName), nil
+}
+
+func (c *Client) listCategories(addr string) ([]string, error) {
+	listURL := addr + "/listCategories"
+	resp, err := c.httpCl.Get(listURL)
+	if err != nil {
+		return nil, fmt.Errorf("list categories %q: %v", listURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list categories %q: http code %d", listURL, resp.StatusCode)
+	}
+	var res []string
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("list categories %q: %v", listURL, err)
+	}
+	return res, nil
+}
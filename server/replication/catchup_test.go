@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// testSizes is the DirectWriter that only knows the sizes of the chunks
+// and which of them are sealed.
+type testSizes struct {
+	DirectWriter
+	sizes  map[string]int64
+	sealed map[string]bool
+}
+
+func (w testSizes) Stat(category, fileName string) (int64, bool, error) {
+	size, ok := w.sizes[category+"/"+fileName]
+	return size, ok, nil
+}
+
+func (w testSizes) Sealed(category, fileName string) (bool, error) {
+	return w.sealed[category+"/"+fileName], nil
+}
+
+// testPeerServer lists the chunks of the categories like the web server.
+func testPeerServer(t *testing.T, chunks map[string][]protocol.Chunk) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/listCategories":
+			var res []string
+			for category := range chunks {
+				res = append(res, category)
+			}
+			sort.Strings(res)
+			json.NewEncoder(w).Encode(res)
+		case "/listChunks":
+			json.NewEncoder(w).Encode(chunks[r.URL.Query().Get("category")])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCatchUp(t *testing.T) {
+	st, _ := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := testPeerServer(t, map[string][]protocol.Chunk{
+		"events": {
+			{Name: "kazan-chunk0", Size: 10},
+			{Name: "kazan-chunk1", Size: 10, Complete: true},
+			{Name: "kazan-chunk2", Size: 10},
+			// downloaded completely but not sealed before a crash
+			{Name: "kazan-chunk3", Size: 10, Complete: true},
+			// the owner writes to it, the replica follows it
+			{Name: "kazan-chunk4", Size: 10},
+			// a replica of another instance
+			{Name: "samara-chunk0", Size: 10},
+		},
+		"numbers": {
+			{Name: "kazan-chunk0", Size: 10},
+			{Name: "kazan-chunk1", Size: 10},
+			// created before the replicas were recorded
+			{Name: "kazan-chunk2", Size: 10},
+			{Name: "kazan-chunk3", Size: 10},
+		},
+	})
+	if err := st.put(ctx, "peers/kazan", strings.TrimPrefix(srv.URL, "http://")); err != nil {
+		t.Fatalf("registering kazan failed: %v", err)
+	}
+	testRegister(t, st, "moscow")
+	for chunk, instances := range map[string][]string{
+		"kazan-chunk0": {"kazan", "moscow"},
+		"kazan-chunk1": {"kazan", "samara"},
+		"kazan-chunk3": {"kazan", "moscow"},
+	} {
+		if err := st.SetChunkReplicas(ctx, "numbers", chunk, instances); err != nil {
+			t.Fatalf("SetChunkReplicas(%q) failed: %v", chunk, err)
+		}
+	}
+	queued := Chunk{Owner: "kazan", Category: "numbers", FileName: "kazan-chunk3"}
+	if err := st.AddChunkToReplicationQueue(ctx, "moscow", queued); err != nil {
+		t.Fatalf("AddChunkToReplicationQueue() failed: %v", err)
+	}
+
+	cfg := &config.Config{Categories: map[string]config.Category{"numbers": {ReplicationFactor: 2}}}
+	wr := testSizes{sizes: map[string]int64{
+		"events/kazan-chunk1": 10,
+		"events/kazan-chunk2": 5,
+		"events/kazan-chunk3": 10,
+		"events/kazan-chunk4": 10,
+	}, sealed: map[string]bool{
+		"events/kazan-chunk1": true,
+	}}
+	cl := NewClient(st, wr, "moscow", cfg)
+
+	missing, err := cl.missingChunks(ctx, Peer{InstanceName: "kazan", ListenAddr: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatalf("missingChunks() failed: %v", err)
+	}
+	want := []Chunk{
+		{Owner: "kazan", Category: "events", FileName: "kazan-chunk0"},
+		{Owner: "kazan", Category: "events", FileName: "kazan-chunk2"},
+		{Owner: "kazan", Category: "events", FileName: "kazan-chunk3"},
+		{Owner: "kazan", Category: "numbers", FileName: "kazan-chunk0"},
+		{Owner: "kazan", Category: "numbers", FileName: "kazan-chunk2"},
+		queued,
+	}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("missingChunks() = %+v, want %+v", missing, want)
+	}
+
+	if err := cl.CatchUp(ctx); err != nil {
+		t.Fatalf("CatchUp() failed: %v", err)
+	}
+	got := testQueue(t, st, "moscow")
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].Category+"/"+got[i].FileName < got[j].Category+"/"+got[j].FileName
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("the queue after CatchUp() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPlacedHere(t *testing.T) {
+	st, _ := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := st.SetChunkReplicas(ctx, "numbers", "kazan-chunk0", []string{"kazan", "samara"}); err != nil {
+		t.Fatalf("SetChunkReplicas() failed: %v", err)
+	}
+	if err := st.SetChunkReplicas(ctx, "numbers", "kazan-chunk1", []string{"kazan", "moscow"}); err != nil {
+		t.Fatalf("SetChunkReplicas() failed: %v", err)
+	}
+	cfg := &config.Config{Categories: map[string]config.Category{"numbers": {ReplicationFactor: 2}}}
+	cl := NewClient(st, nil, "moscow", cfg)
+
+	testCases := []struct {
+		category, chunk string
+		want            bool
+	}{
+		{"numbers", "kazan-chunk0", false},
+		{"numbers", "kazan-chunk1", true},
+		{"numbers", "kazan-chunk2", true},
+		// every instance stores the categories without a replication factor
+		{"events", "kazan-chunk0", true},
+	}
+	for _, tc := range testCases {
+		got, err := cl.placedHere(ctx, Chunk{Owner: "kazan", Category: tc.category, FileName: tc.chunk})
+		if err != nil || got != tc.want {
+			t.Errorf("placedHere(%s/%s) = %v, %v; want %v", tc.category, tc.chunk, got, err, tc.want)
+		}
+	}
+}
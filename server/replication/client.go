@@ -10,9 +10,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/yyancy/go-queue/client"
+	"github.com/yyancy/go-queue/config"
 	"github.com/yyancy/go-queue/protocol"
 )
 
@@ -24,6 +26,8 @@ const batchSize = 4 * 1024 * 1024 // 4 MiB
 
 var errNotFound = errors.New("chunk not found")
 var errisNotComplete = errors.New("chunk is not complete")
+var errMoreData = errors.New("chunk has more data to download")
+var errPeerDeparted = errors.New("peer has departed")
 
 // Client describles the client-side state of replication and continiously
 // downloads new chunks from other servers
@@ -31,56 +35,64 @@ type Client struct {
 	st           *State
 	wr           DirectWriter
 	instanceName string
+	cfg          *config.Config
 	httpCl       *http.Client
 	c            *client.Client
+
+	workers int
+	limiter bandwidthLimiter
+
+	catchUpMu sync.Mutex
 }
 
 // DirectWriter writes to underlying storage directly for replication purposes.
 type DirectWriter interface {
 	Stat(category, fileName string) (size int64, exists bool, err error)
+	// Sealed reports whether the chunk is complete on this instance.
+	Sealed(category, fileName string) (bool, error)
+	// WriteDirect appends the contents to the chunk and syncs them to disk.
 	WriteDirect(category, fileName string, contents []byte) error
+	// Seal marks the chunk as complete once it has been fully downloaded
+	// and its contents match the metadata of the source.
+	Seal(category, fileName string, source protocol.ChunkMeta) error
+
+	// StatCompressed, WriteCompressed and SealCompressed do the same
+	// for chunks that are copied in the compressed form.
+	StatCompressed(category, fileName string) (size int64, err error)
+	WriteCompressed(category, fileName string, contents []byte) error
+	SealCompressed(category, fileName string, source protocol.ChunkMeta) error
+
+	// Replace records that the chunk is the output of the compaction
+	// that replaced the provided chunks.
+	Replace(category, fileName string, replaced []string) error
 }
 
-func NewClient(st *State, wr DirectWriter, instanceName string) *Client {
+func NewClient(st *State, wr DirectWriter, instanceName string, cfg *config.Config) *Client {
 	c, _ := client.NewClient(nil)
 	return &Client{
 		st:           st,
 		wr:           wr,
 		instanceName: instanceName,
+		cfg:          cfg,
 		httpCl: &http.Client{
 			Timeout: defaultClientTimeout,
 		},
-		c: c,
+		c:       c,
+		workers: defaultDownloadWorkers,
 	}
 }
 
+// Loop downloads the chunks in the replication queue of the instance
+// with the download workers until ctx is done.
 func (c *Client) Loop(ctx context.Context) {
-	for ch := range c.st.WatchReplicationQueue(ctx, c.instanceName) {
-		log.Printf("chunk is %v", ch)
-		c.downloadChunk(ch)
-
-		// TODO handle errors
-		if err := c.st.DeleteChunkFromReplicationQueue(ctx, c.instanceName, ch); err != nil {
-			log.Printf("could not delete chunk %+v from the replication queue: %v", ch, err)
-		}
+	q := newDownloadQueue()
+	for i := 0; i < c.workers; i++ {
+		go c.downloadWorker(ctx, q)
 	}
-}
 
-func (c *Client) downloadChunk(ch Chunk) {
-	log.Printf("downloading chunk %v", ch)
-
-	for {
-		err := c.downloadChunkIteration(ch)
-		if err == errisNotComplete {
-			// log.Printf("got an err which chunk is not complete while downloading chunk %+v: %v", ch, err)
-			time.Sleep(pollInterval)
-			continue
-		} else if err != nil {
-			log.Printf("got an error while downloading chunk %+v: %v", ch, err)
-			time.Sleep(retryTimeout)
-			continue
-		}
-		return
+	for ch := range c.st.WatchReplicationQueue(ctx, c.instanceName) {
+		log.Printf("downloading chunk %v", ch)
+		q.add(ch)
 	}
 }
 
@@ -92,7 +104,7 @@ func (c *Client) downloadChunkIteration(curCh Chunk) error {
 
 	addr, err := c.listenAddrForChunk(curCh)
 	if err != nil {
-		return fmt.Errorf("getting listen address: %v", err)
+		return fmt.Errorf("getting listen address: %w", err)
 	}
 	info, err := c.getChunkInfo(addr, curCh)
 	if err == errNotFound {
@@ -101,26 +113,92 @@ func (c *Client) downloadChunkIteration(curCh Chunk) error {
 	} else if err != nil {
 		return err
 	}
+	if size == 0 && info.Compressed && info.Complete {
+		return c.downloadCompressedIteration(addr, curCh, info)
+	}
 	if uint64(size) >= info.Size {
 		if !info.Complete {
+			// the replica stays in sync while it waits for new data
+			c.reportProgress(addr, curCh, size)
 			return errisNotComplete
 		}
-		return nil
+		if err := c.wr.Seal(curCh.Category, curCh.FileName, info.ChunkMeta); err != nil {
+			return fmt.Errorf("sealing chunk %+v: %v", curCh, err)
+		}
+		return c.replace(curCh, info)
 	}
 
-	buf, err := c.downloadPart(addr, curCh, size)
+	// the bandwidth is reserved for what the owner has before the request,
+	// the owner does not return more than that
+	maxSize := c.partSize(info.Size - uint64(size))
+	c.limiter.reserve(maxSize)
+	buf, err := c.downloadPart(addr, curCh, size, maxSize)
+	c.limiter.release(maxSize - len(buf))
 	if err != nil {
 		return fmt.Errorf("downloading chunk %+v: %v", curCh, err)
 	}
+	if len(buf) == 0 {
+		c.reportProgress(addr, curCh, size)
+		return errisNotComplete
+	}
 
 	if err := c.wr.WriteDirect(curCh.Category, curCh.FileName, buf); err != nil {
 		return fmt.Errorf("writing chunk %+v: %v", curCh, err)
 	}
+	// WriteDirect has synced the data, so the owner can acknowledge the writes
+	c.reportProgress(addr, curCh, size+int64(len(buf)))
+	if uint64(size)+uint64(len(buf)) < info.Size {
+		return errMoreData
+	}
 	if !info.Complete {
 		return errisNotComplete
 	}
-	return nil
+	// the next iteration seals the chunk after making sure that
+	// nothing was appended in the meantime
+	return errMoreData
+
+}
 
+// downloadCompressedIteration copies the compressed chunk as-is
+// which saves bandwidth for compressible categories.
+func (c *Client) downloadCompressedIteration(addr string, curCh Chunk, info protocol.Chunk) error {
+	size, err := c.wr.StatCompressed(curCh.Category, curCh.FileName)
+	if err != nil {
+		return fmt.Errorf("getting compressed file stat: %v", err)
+	}
+	if uint64(size) >= info.CompressedSize {
+		if err := c.wr.SealCompressed(curCh.Category, curCh.FileName, info.ChunkMeta); err != nil {
+			return fmt.Errorf("sealing compressed chunk %+v: %v", curCh, err)
+		}
+		return c.replace(curCh, info)
+	}
+
+	maxSize := c.partSize(info.CompressedSize - uint64(size))
+	c.limiter.reserve(maxSize)
+	buf, err := c.downloadCompressedPart(addr, curCh, size, maxSize)
+	c.limiter.release(maxSize - len(buf))
+	if err != nil {
+		return fmt.Errorf("downloading compressed chunk %+v: %v", curCh, err)
+	}
+	if len(buf) == 0 {
+		return fmt.Errorf("compressed chunk %+v is shorter than expected", curCh)
+	}
+	if err := c.wr.WriteCompressed(curCh.Category, curCh.FileName, buf); err != nil {
+		return fmt.Errorf("writing compressed chunk %+v: %v", curCh, err)
+	}
+	return errMoreData
+}
+
+// replace hides the chunks that the downloaded chunk replaced
+// on the owner once the downloaded chunk is complete.
+func (c *Client) replace(curCh Chunk, info protocol.Chunk) error {
+	if len(info.Replaces) == 0 {
+		return nil
+	}
+	if err := c.wr.Replace(curCh.Category, curCh.FileName, info.Replaces); err != nil {
+		return fmt.Errorf("replacing chunks %v with %+v: %v", info.Replaces, curCh, err)
+	}
+	return nil
 }
 
 func (c *Client) listenAddrForChunk(ch Chunk) (string, error) {
@@ -141,11 +219,41 @@ func (c *Client) listenAddrForChunk(ch Chunk) (string, error) {
 		}
 	}
 	if addr == "" {
-		return "", fmt.Errorf("could not find peer %q", ch.Owner)
+		return "", fmt.Errorf("%w: could not find peer %q", errPeerDeparted, ch.Owner)
 	}
 	return "http://" + addr, nil
 }
 
+// reportProgress confirms the first size bytes of the chunk to the owner,
+// the writes to the owner can wait for the replicas.
+func (c *Client) reportProgress(addr string, ch Chunk, size int64) {
+	if err := c.confirmReplicated(addr, ch, size); err != nil {
+		log.Printf("could not confirm chunk %+v at %q: %v", ch, addr, err)
+	}
+}
+
+// confirmReplicated tells the owner of the chunk that this instance
+// stores its first size bytes.
+func (c *Client) confirmReplicated(addr string, ch Chunk, size int64) error {
+	u := url.Values{}
+	u.Add("off", strconv.FormatInt(size, 10))
+	u.Add("chunk", ch.FileName)
+	u.Add("category", ch.Category)
+	u.Add("instance", c.instanceName)
+	confirmURL := fmt.Sprintf("%s/replicated?%s", addr, u.Encode())
+	resp, err := c.httpCl.Get(confirmURL)
+	if err != nil {
+		return fmt.Errorf("confirm %q: %v", confirmURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("confirm %q: http code %d, %s", confirmURL, resp.StatusCode, b)
+	}
+	return nil
+}
+
 func (c *Client) getChunkInfo(addr string, curCh Chunk) (protocol.Chunk, error) {
 
 	chunks, err := c.c.ListChunks(curCh.Category, addr)
@@ -161,11 +269,10 @@ func (c *Client) getChunkInfo(addr string, curCh Chunk) (protocol.Chunk, error)
 	return protocol.Chunk{}, errNotFound
 }
 
-func (c *Client) downloadPart(addr string, ch Chunk, off int64) ([]byte, error) {
-
+func (c *Client) downloadPart(addr string, ch Chunk, off int64, maxSize int) ([]byte, error) {
 	u := url.Values{}
 	u.Add("off", strconv.Itoa(int(off)))
-	u.Add("maxSize", strconv.Itoa(batchSize))
+	u.Add("maxSize", strconv.Itoa(maxSize))
 	u.Add("chunk", ch.FileName)
 	u.Add("category", ch.Category)
 	readURL := fmt.Sprintf("%s/read?%s", addr, u.Encode())
@@ -180,5 +287,44 @@ func (c *Client) downloadPart(addr string, ch Chunk, off int64) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		// the error body must not end up in the replica as data
+		return nil, fmt.Errorf("read %q: http code %d, %s", readURL, resp.StatusCode, b.String())
+	}
+
+	format, err := protocol.ParseFormat(resp.Header.Get(protocol.FormatHeader))
+	if err != nil {
+		return nil, err
+	}
+	if format == protocol.FormatFramed {
+		// do not let a corrupted or truncated response end up in the replica
+		if err := protocol.ValidateRecords(b.Bytes()); err != nil {
+			return nil, fmt.Errorf("validating records: %w", err)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func (c *Client) downloadCompressedPart(addr string, ch Chunk, off int64, maxSize int) ([]byte, error) {
+	u := url.Values{}
+	u.Add("off", strconv.Itoa(int(off)))
+	u.Add("maxSize", strconv.Itoa(maxSize))
+	u.Add("chunk", ch.FileName)
+	u.Add("category", ch.Category)
+	readURL := fmt.Sprintf("%s/readCompressed?%s", addr, u.Encode())
+	resp, err := c.httpCl.Get(readURL)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %v", readURL, err)
+	}
+	defer resp.Body.Close()
+
+	var b bytes.Buffer
+	_, err = io.Copy(&b, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("read %q: http code %d, %s", readURL, resp.StatusCode, b.String())
+	}
 	return b.Bytes(), nil
 }
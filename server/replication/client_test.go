@@ -0,0 +1,202 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+	"github.com/yyancy/go-queue/server"
+)
+
+func testHTTPClient() *Client {
+	return &Client{instanceName: "kazan", httpCl: &http.Client{Timeout: defaultClientTimeout}}
+}
+
+func TestDownloadPartHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(protocol.FormatHeader, protocol.FormatNewline.String())
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found:chunk not found\n"))
+	}))
+	defer srv.Close()
+
+	b, err := testHTTPClient().downloadPart(srv.URL, Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk0"}, 0, batchSize)
+	if err == nil {
+		t.Errorf("downloadPart() = %q, want an error for http code 404", b)
+	}
+}
+
+type testHooks struct{}
+
+func (testHooks) BeforeCreatingChunk(ctx context.Context, category, filename string) error {
+	return nil
+}
+
+func (testHooks) AfterDeletingChunk(ctx context.Context, category, filename string) error {
+	return nil
+}
+
+func testNewOnDisk(t *testing.T, instance string) *server.OnDisk {
+	t.Helper()
+	return testNewOnDiskWithConfig(t, instance, config.Category{})
+}
+
+func testNewOnDiskWithConfig(t *testing.T, instance string, cfg config.Category) *server.OnDisk {
+	t.Helper()
+	dir, err := os.MkdirTemp(os.TempDir(), "replication")
+	if err != nil {
+		t.Fatalf("MkdirTemp() failed: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	srv, err := server.NewOnDisk(dir, "numbers", instance, cfg, testHooks{})
+	if err != nil {
+		t.Fatalf("NewOnDisk() failed: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// testReplica is the DirectWriter of the single category.
+type testReplica struct {
+	*server.OnDisk
+}
+
+func (r testReplica) Stat(category, fileName string) (int64, bool, error) {
+	return r.ChunkSize(fileName)
+}
+
+func (r testReplica) Sealed(category, fileName string) (bool, error) {
+	return r.ChunkSealed(fileName)
+}
+
+func (r testReplica) WriteDirect(category, fileName string, contents []byte) error {
+	return r.WriteDirectly(fileName, contents)
+}
+
+func (r testReplica) Seal(category, fileName string, source protocol.ChunkMeta) error {
+	return r.SealDirectly(fileName, source)
+}
+
+func (r testReplica) StatCompressed(category, fileName string) (int64, error) {
+	return r.CompressedPartSize(fileName)
+}
+
+func (r testReplica) WriteCompressed(category, fileName string, contents []byte) error {
+	return r.WriteCompressedDirectly(fileName, contents)
+}
+
+func (r testReplica) SealCompressed(category, fileName string, source protocol.ChunkMeta) error {
+	return r.SealCompressedDirectly(fileName, source)
+}
+
+func (r testReplica) Replace(category, fileName string, replaced []string) error {
+	return r.ReplaceDirectly(fileName, replaced)
+}
+
+// testOwnerServer serves the chunks of the owner like the web server.
+// check is called with the confirmed offset before it is recorded.
+func testOwnerServer(t *testing.T, owner *server.OnDisk, check func(chunk string, off uint64)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/listChunks":
+			chunks, err := owner.ListChunks()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(chunks)
+		case "/read":
+			off, _ := strconv.ParseUint(q.Get("off"), 10, 64)
+			maxSize, _ := strconv.ParseUint(q.Get("maxSize"), 10, 64)
+			w.Header().Set(protocol.FormatHeader, owner.Format().String())
+			if err := owner.Recv(q.Get("chunk"), uint(off), uint(maxSize), w); err != nil && err != io.EOF {
+				t.Errorf("Recv() failed: %v", err)
+			}
+		case "/replicated":
+			off, _ := strconv.ParseUint(q.Get("off"), 10, 64)
+			check(q.Get("chunk"), off)
+			owner.ConfirmReplicated(q.Get("instance"), q.Get("chunk"), off, time.Now())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestReplicatedWriteRoundTrip(t *testing.T) {
+	st, _ := testState(t)
+	// the owner creates the chunk for the replicas to follow
+	owner := testNewOnDiskWithConfig(t, "moscow", config.Category{Acks: 1})
+	replica := testNewOnDisk(t, "kazan")
+
+	srv := testOwnerServer(t, owner, func(chunk string, off uint64) {
+		// the replica confirms only what it has stored
+		if size, _, err := replica.ChunkSize(chunk); err != nil || uint64(size) < off {
+			t.Errorf("the replica confirmed %d bytes of %q, it has %d (%v)", off, chunk, size, err)
+		}
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := st.put(ctx, "peers/moscow", strings.TrimPrefix(srv.URL, "http://")); err != nil {
+		t.Fatalf("registering the owner failed: %v", err)
+	}
+
+	if err := owner.SendReplicated(ctx, []byte("1\n"), 1); !errors.Is(err, server.ErrNotEnoughReplicas) {
+		t.Fatalf("SendReplicated() without replicas = %v, want ErrNotEnoughReplicas", err)
+	}
+
+	cl := NewClient(st, testReplica{replica}, "kazan", &config.Config{})
+	ch := Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk0"}
+	go func() {
+		for ctx.Err() == nil {
+			err := cl.downloadChunkIteration(ch)
+			if err != nil && err != errMoreData && err != errisNotComplete {
+				t.Errorf("downloadChunkIteration() failed: %v", err)
+				return
+			}
+			if err != errMoreData {
+				time.Sleep(pollInterval)
+			}
+		}
+	}()
+
+	for _, msg := range []string{"1\n", "2\n"} {
+		var err error
+		for ctx.Err() == nil {
+			// the replica starts following the chunk
+			if err = owner.SendReplicated(ctx, []byte(msg), 1); !errors.Is(err, server.ErrNotEnoughReplicas) {
+				break
+			}
+			time.Sleep(pollInterval)
+		}
+		if err != nil {
+			t.Fatalf("SendReplicated(%q) failed: %v", msg, err)
+		}
+		// the write returns once the replica stores it
+		if size, _, err := replica.ChunkSize("moscow-chunk0"); err != nil || size < 2 {
+			t.Errorf("the replica has %d bytes (%v) after the write", size, err)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := replica.Recv("moscow-chunk0", 0, 100, &b); err != nil {
+		t.Fatalf("Recv() failed: %v", err)
+	}
+	if got, want := b.String(), "1\n2\n"; got != want {
+		t.Errorf("replica contents = %q, want %q", got, want)
+	}
+}
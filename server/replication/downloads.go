@@ -0,0 +1,231 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultDownloadWorkers is the default number of chunks
+// that are downloaded concurrently.
+const defaultDownloadWorkers = 4
+
+// downloadQueue is the queue of the chunks to download. A worker takes
+// a chunk, downloads the next part of it and puts it back: at the end of
+// the queue if there is more data, or after pollInterval if it has
+// downloaded everything the owner has written so far. So the chunks that
+// are still being written do not occupy the workers and the sealed ones
+// are downloaded in turns.
+type downloadQueue struct {
+	mu    sync.Mutex
+	ready []Chunk
+	// scheduled are the chunks that are being downloaded, ready or waiting
+	// for their next poll.
+	scheduled map[Chunk]bool
+	// requeued are the scheduled chunks that were added again, e.g. while
+	// a worker was finishing them. They are downloaded once more instead
+	// of being forgotten.
+	requeued map[Chunk]bool
+	// notifyCh receives a value when a chunk becomes ready.
+	notifyCh chan struct{}
+}
+
+func newDownloadQueue() *downloadQueue {
+	return &downloadQueue{
+		scheduled: make(map[Chunk]bool),
+		requeued:  make(map[Chunk]bool),
+		notifyCh:  make(chan struct{}, 1),
+	}
+}
+
+// add schedules the chunk. If it is scheduled already, it is scheduled
+// again once it is done.
+func (q *downloadQueue) add(ch Chunk) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.scheduled[ch] {
+		q.requeued[ch] = true
+		return
+	}
+	q.scheduled[ch] = true
+	q.pushLocked(ch)
+}
+
+// push puts the scheduled chunk at the end of the queue.
+func (q *downloadQueue) push(ch Chunk) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pushLocked(ch)
+}
+
+func (q *downloadQueue) pushLocked(ch Chunk) {
+	q.ready = append(q.ready, ch)
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// pushAfter puts the scheduled chunk at the end of the queue after d.
+func (q *downloadQueue) pushAfter(ch Chunk, d time.Duration) {
+	time.AfterFunc(d, func() { q.push(ch) })
+}
+
+// done forgets the chunk once it is downloaded,
+// unless it was added again in the meantime.
+func (q *downloadQueue) done(ch Chunk) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.requeued[ch] {
+		delete(q.requeued, ch)
+		q.pushLocked(ch)
+		return
+	}
+	delete(q.scheduled, ch)
+}
+
+// pop waits for the next ready chunk, false if ctx is done.
+func (q *downloadQueue) pop(ctx context.Context) (Chunk, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.ready) > 0 {
+			ch := q.ready[0]
+			q.ready = q.ready[1:]
+			if len(q.ready) > 0 {
+				// wake up the next worker
+				select {
+				case q.notifyCh <- struct{}{}:
+				default:
+				}
+			}
+			q.mu.Unlock()
+			return ch, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Chunk{}, false
+		case <-q.notifyCh:
+		}
+	}
+}
+
+// bandwidthLimiter limits the total download speed of all workers.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+
+	mu sync.Mutex
+	// next is when the downloads are within the limit again.
+	next time.Time
+}
+
+// reserve accounts for the n bytes that are about to be downloaded and
+// blocks until the downloads that reserved the bandwidth before are done
+// at the limited speed, so the download starts within the limit.
+func (l *bandwidthLimiter) reserve(n int) {
+	if l.bytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(l.duration(n))
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+// release gives back the n reserved bytes that were not downloaded,
+// e.g. because the response was shorter than expected.
+func (l *bandwidthLimiter) release(n int) {
+	if l.bytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next = l.next.Add(-l.duration(n))
+}
+
+// duration is how long n bytes take at the limited speed.
+func (l *bandwidthLimiter) duration(n int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(l.bytesPerSecond)
+}
+
+// SetDownloadLimits sets the number of chunks that are downloaded concurrently
+// and the total download speed in bytes per second, zero means no limit.
+// It must be called before Loop.
+func (c *Client) SetDownloadLimits(workers int, bytesPerSecond int64) {
+	if workers > 0 {
+		c.workers = workers
+	}
+	c.limiter.bytesPerSecond = bytesPerSecond
+}
+
+// batchSize is the maximum size of a downloaded part, at most a second
+// of the bandwidth limit so that the workers share it evenly.
+func (c *Client) batchSize() int {
+	if l := c.limiter.bytesPerSecond; l > 0 && l < batchSize {
+		return int(l)
+	}
+	return batchSize
+}
+
+// partSize is the size of the next part to download when the owner
+// has left bytes of the chunk that this instance does not have.
+func (c *Client) partSize(left uint64) int {
+	if n := c.batchSize(); uint64(n) < left {
+		return n
+	}
+	return int(left)
+}
+
+func (c *Client) downloadWorker(ctx context.Context, q *downloadQueue) {
+	for {
+		ch, ok := q.pop(ctx)
+		if !ok {
+			return
+		}
+
+		err := c.downloadChunkIteration(ch)
+		if err == errMoreData {
+			q.push(ch)
+			continue
+		} else if err == errisNotComplete {
+			q.pushAfter(ch, pollInterval)
+			continue
+		} else if errors.Is(err, errPeerDeparted) {
+			// the peer can register again, the chunk stays in the queue
+			// until the cleanup after the peer deletes it
+			queued, qErr := c.st.InReplicationQueue(ctx, c.instanceName, ch)
+			if qErr != nil || queued {
+				log.Printf("waiting for the owner of chunk %+v: %v", ch, err)
+				q.pushAfter(ch, retryTimeout)
+				continue
+			}
+			log.Printf("stopped downloading chunk %+v: %v", ch, err)
+			q.done(ch)
+			continue
+		} else if err != nil {
+			log.Printf("got an error while downloading chunk %+v: %v", ch, err)
+			q.pushAfter(ch, retryTimeout)
+			continue
+		}
+
+		// TODO handle errors
+		if err := c.st.DeleteChunkFromReplicationQueue(ctx, c.instanceName, ch); err != nil {
+			log.Printf("could not delete chunk %+v from the replication queue: %v", ch, err)
+		}
+		q.done(ch)
+	}
+}
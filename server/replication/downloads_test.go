@@ -0,0 +1,124 @@
+package replication
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testPop(t *testing.T, q *downloadQueue, want Chunk) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, ok := q.pop(ctx)
+	if !ok || got != want {
+		t.Fatalf("pop() = %+v, %v; want %+v", got, ok, want)
+	}
+}
+
+func testPopNothing(t *testing.T, q *downloadQueue) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if got, ok := q.pop(ctx); ok {
+		t.Fatalf("pop() = %+v, want nothing", got)
+	}
+}
+
+func TestDownloadQueue(t *testing.T) {
+	q := newDownloadQueue()
+	first := Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk0"}
+	second := Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk1"}
+
+	q.add(first)
+	q.add(second)
+	testPop(t, q, first)
+	// the chunks are downloaded in turns
+	q.push(first)
+	testPop(t, q, second)
+	q.done(second)
+	testPop(t, q, first)
+	testPopNothing(t, q)
+
+	q.pushAfter(first, 10*time.Millisecond)
+	testPop(t, q, first)
+	q.done(first)
+	testPopNothing(t, q)
+
+	// the chunk can be downloaded again once it is done
+	q.add(first)
+	testPop(t, q, first)
+}
+
+func TestDownloadQueueAddScheduled(t *testing.T) {
+	q := newDownloadQueue()
+	ch := Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk0"}
+
+	q.add(ch)
+	testPop(t, q, ch)
+	// the watch sees the chunk again while the worker finishes it
+	q.add(ch)
+	testPopNothing(t, q)
+	q.done(ch)
+	testPop(t, q, ch)
+
+	q.done(ch)
+	testPopNothing(t, q)
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := bandwidthLimiter{bytesPerSecond: 1000}
+
+	start := time.Now()
+	l.reserve(100)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("the first reserve() took %v, want no wait", d)
+	}
+
+	// the first download takes 100ms at the limited speed
+	start = time.Now()
+	l.reserve(100)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("the second reserve() took %v, want about 100ms", d)
+	}
+
+	// the second download was shorter than reserved
+	l.release(100)
+	start = time.Now()
+	l.reserve(100)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("reserve() after release() took %v, want no wait", d)
+	}
+}
+
+func TestBandwidthLimiterUnlimited(t *testing.T) {
+	var l bandwidthLimiter
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.reserve(batchSize)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("reserve() without a limit took %v, want no wait", d)
+	}
+}
+
+func TestPartSize(t *testing.T) {
+	c := &Client{}
+	c.SetDownloadLimits(0, 1000)
+
+	testCases := []struct {
+		left uint64
+		want int
+	}{
+		{left: 10, want: 10},
+		{left: 1000, want: 1000},
+		// a second of the bandwidth limit
+		{left: 1 << 40, want: 1000},
+	}
+	for _, tc := range testCases {
+		if got := c.partSize(tc.left); got != tc.want {
+			t.Errorf("partSize(%d) = %d, want %d", tc.left, got, tc.want)
+		}
+	}
+}
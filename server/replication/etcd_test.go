@@ -0,0 +1,310 @@
+package replication
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	netcontext "github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/Godeps/_workspace/src/google.golang.org/grpc"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/storage/storagepb"
+)
+
+// fakeEtcd is an in-memory etcd with the KV, lease and watch APIs that the
+// replication state uses. The leases expire only with expireLease.
+type fakeEtcd struct {
+	mu       sync.Mutex
+	rev      int64
+	kvs      map[string]*storagepb.KeyValue
+	leases   map[int64]int64
+	lastID   int64
+	history  []*storagepb.Event
+	watchers map[*fakeWatcher]struct{}
+	// grantedTTL, if set, is the TTL of the new leases,
+	// so that the clients renew them more often.
+	grantedTTL int64
+}
+
+type fakeWatcher struct {
+	key, end []byte
+	id       int64
+	stream   pb.Watch_WatchServer
+}
+
+// testState starts the fake etcd and returns the state connected to it.
+func testState(t *testing.T) (*State, *fakeEtcd) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	e := &fakeEtcd{
+		kvs:      make(map[string]*storagepb.KeyValue),
+		leases:   make(map[int64]int64),
+		watchers: make(map[*fakeWatcher]struct{}),
+	}
+	srv := grpc.NewServer()
+	pb.RegisterKVServer(srv, e)
+	pb.RegisterLeaseServer(srv, e)
+	pb.RegisterWatchServer(srv, e)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	st, err := NewState([]string{lis.Addr().String()}, "test")
+	if err != nil {
+		t.Fatalf("NewState() failed: %v", err)
+	}
+	t.Cleanup(func() { st.cl.Close() })
+	return st, e
+}
+
+func (e *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: e.rev}
+}
+
+func inRange(k, key, end []byte) bool {
+	if len(end) == 0 {
+		return bytes.Equal(k, key)
+	}
+	return bytes.Compare(k, key) >= 0 && (bytes.Equal(end, []byte{0}) || bytes.Compare(k, end) < 0)
+}
+
+func (e *fakeEtcd) rangeLocked(r *pb.RangeRequest) *pb.RangeResponse {
+	resp := &pb.RangeResponse{Header: e.header()}
+	for k, kv := range e.kvs {
+		if inRange([]byte(k), r.Key, r.RangeEnd) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0 })
+	return resp
+}
+
+func (e *fakeEtcd) putLocked(r *pb.PutRequest) (*pb.PutResponse, error) {
+	if _, ok := e.leases[r.Lease]; r.Lease != 0 && !ok {
+		return nil, errors.New("requested lease not found")
+	}
+	e.rev++
+	kv := &storagepb.KeyValue{Key: r.Key, Value: r.Value, Lease: r.Lease, CreateRevision: e.rev, ModRevision: e.rev, Version: 1}
+	if prev, ok := e.kvs[string(r.Key)]; ok {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	e.kvs[string(r.Key)] = kv
+	e.notifyLocked(&storagepb.Event{Type: storagepb.PUT, Kv: kv})
+	return &pb.PutResponse{Header: e.header()}, nil
+}
+
+func (e *fakeEtcd) deleteLocked(key, end []byte) *pb.DeleteRangeResponse {
+	var keys []string
+	for k := range e.kvs {
+		if inRange([]byte(k), key, end) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return &pb.DeleteRangeResponse{Header: e.header()}
+	}
+	sort.Strings(keys)
+	e.rev++
+	for _, k := range keys {
+		delete(e.kvs, k)
+		e.notifyLocked(&storagepb.Event{Type: storagepb.DELETE, Kv: &storagepb.KeyValue{Key: []byte(k), ModRevision: e.rev}})
+	}
+	return &pb.DeleteRangeResponse{Header: e.header(), Deleted: int64(len(keys))}
+}
+
+func (e *fakeEtcd) notifyLocked(ev *storagepb.Event) {
+	e.history = append(e.history, ev)
+	for w := range e.watchers {
+		if inRange(ev.Kv.Key, w.key, w.end) {
+			w.stream.Send(&pb.WatchResponse{Header: e.header(), WatchId: w.id, Events: []*storagepb.Event{ev}})
+		}
+	}
+}
+
+func (e *fakeEtcd) Range(ctx netcontext.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rangeLocked(r), nil
+}
+
+func (e *fakeEtcd) Put(ctx netcontext.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.putLocked(r)
+}
+
+func (e *fakeEtcd) DeleteRange(ctx netcontext.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.deleteLocked(r.Key, r.RangeEnd), nil
+}
+
+func (e *fakeEtcd) compareLocked(c *pb.Compare) bool {
+	var got, want int64
+	kv := e.kvs[string(c.Key)]
+	if kv == nil {
+		kv = &storagepb.KeyValue{}
+	}
+	switch u := c.TargetUnion.(type) {
+	case *pb.Compare_CreateRevision:
+		got, want = kv.CreateRevision, u.CreateRevision
+	case *pb.Compare_ModRevision:
+		got, want = kv.ModRevision, u.ModRevision
+	case *pb.Compare_Version:
+		got, want = kv.Version, u.Version
+	case *pb.Compare_Value:
+		got, want = int64(bytes.Compare(kv.Value, u.Value)), 0
+	}
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		return got == want
+	case pb.Compare_GREATER:
+		return got > want
+	case pb.Compare_LESS:
+		return got < want
+	}
+	return false
+}
+
+func (e *fakeEtcd) Txn(ctx netcontext.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	resp := &pb.TxnResponse{Succeeded: true}
+	for _, c := range r.Compare {
+		resp.Succeeded = resp.Succeeded && e.compareLocked(c)
+	}
+	ops := r.Success
+	if !resp.Succeeded {
+		ops = r.Failure
+	}
+	for _, op := range ops {
+		switch u := op.Request.(type) {
+		case *pb.RequestUnion_RequestRange:
+			resp.Responses = append(resp.Responses, &pb.ResponseUnion{
+				Response: &pb.ResponseUnion_ResponseRange{ResponseRange: e.rangeLocked(u.RequestRange)}})
+		case *pb.RequestUnion_RequestPut:
+			putResp, err := e.putLocked(u.RequestPut)
+			if err != nil {
+				return nil, err
+			}
+			resp.Responses = append(resp.Responses, &pb.ResponseUnion{
+				Response: &pb.ResponseUnion_ResponsePut{ResponsePut: putResp}})
+		case *pb.RequestUnion_RequestDeleteRange:
+			resp.Responses = append(resp.Responses, &pb.ResponseUnion{
+				Response: &pb.ResponseUnion_ResponseDeleteRange{ResponseDeleteRange: e.deleteLocked(u.RequestDeleteRange.Key, u.RequestDeleteRange.RangeEnd)}})
+		}
+	}
+	resp.Header = e.header()
+	return resp, nil
+}
+
+func (e *fakeEtcd) Compact(ctx netcontext.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	return &pb.CompactionResponse{}, nil
+}
+
+func (e *fakeEtcd) Hash(ctx netcontext.Context, r *pb.HashRequest) (*pb.HashResponse, error) {
+	return &pb.HashResponse{}, nil
+}
+
+func (e *fakeEtcd) LeaseCreate(ctx netcontext.Context, r *pb.LeaseCreateRequest) (*pb.LeaseCreateResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastID++
+	ttl := r.TTL
+	if e.grantedTTL > 0 {
+		ttl = e.grantedTTL
+	}
+	e.leases[e.lastID] = ttl
+	return &pb.LeaseCreateResponse{Header: e.header(), ID: e.lastID, TTL: ttl}, nil
+}
+
+func (e *fakeEtcd) LeaseRevoke(ctx netcontext.Context, r *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	e.expireLease(r.ID)
+	return &pb.LeaseRevokeResponse{}, nil
+}
+
+func (e *fakeEtcd) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		r, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		e.mu.Lock()
+		ttl, ok := e.leases[r.ID]
+		e.mu.Unlock()
+		if !ok {
+			// an expired lease is reported with zero TTL
+			ttl = 0
+		}
+		if err := stream.Send(&pb.LeaseKeepAliveResponse{ID: r.ID, TTL: ttl}); err != nil {
+			return err
+		}
+	}
+}
+
+// expireLease deletes the lease and the keys attached to it.
+func (e *fakeEtcd) expireLease(id int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.leases, id)
+	for k, kv := range e.kvs {
+		if kv.Lease == id {
+			e.deleteLocked([]byte(k), nil)
+		}
+	}
+}
+
+// leaseOf returns the lease attached to the key, zero if there is none.
+func (e *fakeEtcd) leaseOf(key string) int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if kv, ok := e.kvs[key]; ok {
+		return kv.Lease
+	}
+	return 0
+}
+
+func (e *fakeEtcd) Watch(stream pb.Watch_WatchServer) error {
+	var watchers []*fakeWatcher
+	defer func() {
+		e.mu.Lock()
+		for _, w := range watchers {
+			delete(e.watchers, w)
+		}
+		e.mu.Unlock()
+	}()
+
+	for id := int64(0); ; id++ {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		create, ok := r.RequestUnion.(*pb.WatchRequest_CreateRequest)
+		if !ok {
+			continue
+		}
+		w := &fakeWatcher{key: create.CreateRequest.Key, end: create.CreateRequest.RangeEnd, id: id, stream: stream}
+
+		e.mu.Lock()
+		stream.Send(&pb.WatchResponse{Header: e.header(), WatchId: id, Created: true})
+		for _, ev := range e.history {
+			if ev.Kv.ModRevision >= create.CreateRequest.StartRevision && inRange(ev.Kv.Key, w.key, w.end) {
+				stream.Send(&pb.WatchResponse{Header: e.header(), WatchId: id, Events: []*storagepb.Event{ev}})
+			}
+		}
+		e.watchers[w] = struct{}{}
+		watchers = append(watchers, w)
+		e.mu.Unlock()
+	}
+}
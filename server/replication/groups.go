@@ -0,0 +1,126 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// The consumer groups are registered under "groups/<category>/<group>",
+// the offsets they commit are stored under "offsets/<category>/<group>/<chunk>".
+
+// RegisterGroup registers the consumer group of the category so that the
+// chunks are not deleted until the group has read them.
+func (c *State) RegisterGroup(ctx context.Context, category, group string) error {
+	return c.put(ctx, "groups/"+category+"/"+group, time.Now().Format(time.RFC3339))
+}
+
+// CommitOffset stores the offset of the consumer group in the chunk.
+func (c *State) CommitOffset(ctx context.Context, category, group, chunk string, off protocol.Offset) error {
+	b, err := json.Marshal(off)
+	if err != nil {
+		return err
+	}
+	return c.put(ctx, "offsets/"+category+"/"+group+"/"+chunk, string(b))
+}
+
+// GroupOffsets returns the offsets committed by the consumer group.
+func (c *State) GroupOffsets(ctx context.Context, category, group string) (protocol.GroupOffsets, error) {
+	prefix := "offsets/" + category + "/" + group + "/"
+	resp, err := c.get(ctx, prefix, WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(protocol.GroupOffsets, len(resp))
+	for _, kv := range resp {
+		var off protocol.Offset
+		if err := json.Unmarshal([]byte(kv.Value), &off); err != nil {
+			return nil, fmt.Errorf("parsing offset %q: %v", kv.Key, err)
+		}
+		res[strings.TrimPrefix(kv.Key, c.prefix+prefix)] = off
+	}
+	return res, nil
+}
+
+// CategoryOffsets returns the offsets committed by all consumer groups
+// registered in the category, by group name.
+func (c *State) CategoryOffsets(ctx context.Context, category string) (map[string]protocol.GroupOffsets, error) {
+	groupsPrefix := "groups/" + category + "/"
+	groups, err := c.get(ctx, groupsPrefix, WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]protocol.GroupOffsets, len(groups))
+	for _, kv := range groups {
+		res[strings.TrimPrefix(kv.Key, c.prefix+groupsPrefix)] = protocol.GroupOffsets{}
+	}
+
+	offsetsPrefix := "offsets/" + category + "/"
+	offsets, err := c.get(ctx, offsetsPrefix, WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range offsets {
+		parts := strings.SplitN(strings.TrimPrefix(kv.Key, c.prefix+offsetsPrefix), "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected key %q, expected two parts after prefix %q", kv.Key, offsetsPrefix)
+		}
+		group, chunk := parts[0], parts[1]
+		if _, ok := res[group]; !ok {
+			// the offsets of the unregistered groups do not hold the chunks
+			continue
+		}
+		var off protocol.Offset
+		if err := json.Unmarshal([]byte(kv.Value), &off); err != nil {
+			return nil, fmt.Errorf("parsing offset %q: %v", kv.Key, err)
+		}
+		res[group][chunk] = off
+	}
+	return res, nil
+}
+
+// DeletedOffsetsTTL is how long the offsets in a deleted chunk are kept,
+// the other instances delete their copies of the chunk meanwhile.
+const DeletedOffsetsTTL = time.Hour
+
+// ExpireChunkOffsets deletes the offsets that the consumer groups committed
+// in the chunk after DeletedOffsetsTTL.
+func (c *State) ExpireChunkOffsets(ctx context.Context, category, chunk string) error {
+	groupsPrefix := "groups/" + category + "/"
+	groups, err := c.get(ctx, groupsPrefix, WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	var lease clientv3.LeaseID
+	for _, g := range groups {
+		group := strings.TrimPrefix(g.Key, c.prefix+groupsPrefix)
+		key := c.prefix + "offsets/" + category + "/" + group + "/" + chunk
+		resp, err := c.cl.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 || resp.Kvs[0].Lease != 0 {
+			// nothing was committed or the offset already expires
+			continue
+		}
+
+		if lease == 0 {
+			l, err := c.cl.Create(ctx, int64(DeletedOffsetsTTL/time.Second))
+			if err != nil {
+				return fmt.Errorf("creating lease: %w", err)
+			}
+			lease = clientv3.LeaseID(l.ID)
+		}
+		if _, err := c.cl.Put(ctx, key, string(resp.Kvs[0].Value), clientv3.WithLease(lease)); err != nil {
+			return fmt.Errorf("expiring offset %q: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package replication
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+func TestExpireChunkOffsets(t *testing.T) {
+	st, e := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, group := range []string{"billing", "audit"} {
+		if err := st.RegisterGroup(ctx, "numbers", group); err != nil {
+			t.Fatalf("RegisterGroup(%q) failed: %v", group, err)
+		}
+	}
+	for _, chunk := range []string{"moscow-chunk0", "moscow-chunk1"} {
+		if err := st.CommitOffset(ctx, "numbers", "billing", chunk, protocol.Offset{Off: 10, Done: true}); err != nil {
+			t.Fatalf("CommitOffset(%q) failed: %v", chunk, err)
+		}
+	}
+
+	if err := st.ExpireChunkOffsets(ctx, "numbers", "moscow-chunk0"); err != nil {
+		t.Fatalf("ExpireChunkOffsets() failed: %v", err)
+	}
+	// the other instances still see the offsets until they expire
+	offsets, err := st.GroupOffsets(ctx, "numbers", "billing")
+	if err != nil || len(offsets) != 2 {
+		t.Fatalf("GroupOffsets() = %+v, %v; want both chunks", offsets, err)
+	}
+
+	lease := e.leaseOf(st.prefix + "offsets/numbers/billing/moscow-chunk0")
+	if lease == 0 {
+		t.Fatalf("the offset in the deleted chunk has no lease")
+	}
+	if other := e.leaseOf(st.prefix + "offsets/numbers/billing/moscow-chunk1"); other != 0 {
+		t.Errorf("the offset in the other chunk has lease %d, want none", other)
+	}
+
+	e.expireLease(lease)
+	offsets, err = st.GroupOffsets(ctx, "numbers", "billing")
+	if _, ok := offsets["moscow-chunk0"]; err != nil || ok || len(offsets) != 1 {
+		t.Errorf("GroupOffsets() = %+v, %v after expiry; want only moscow-chunk1", offsets, err)
+	}
+}
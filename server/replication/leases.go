@@ -0,0 +1,93 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// ChunkLeaseTTL is how long a consumer holds the chunk without heartbeats.
+const ChunkLeaseTTL = 30 * time.Second
+
+// ErrLeased means that the chunk is leased to another consumer of the group.
+var ErrLeased = errors.New("chunk is leased to another consumer")
+
+// The chunk leases are stored under "leases/<category>/<group>/<chunk>"
+// with the consumer as the value and expire with the etcd lease.
+func (c *State) leaseKey(category, group, chunk string) string {
+	return c.prefix + "leases/" + category + "/" + group + "/" + chunk
+}
+
+// LeaseChunk leases the chunk to the consumer of the group for ChunkLeaseTTL.
+// If the consumer already holds the lease it is renewed, so it is also used
+// for the heartbeats. It returns ErrLeased if another consumer holds the lease.
+func (c *State) LeaseChunk(ctx context.Context, category, group, chunk, consumer string) error {
+	key := c.leaseKey(category, group, chunk)
+
+	resp, err := c.cl.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) > 0 {
+		kv := resp.Kvs[0]
+		if string(kv.Value) != consumer {
+			return fmt.Errorf("%w: %q holds %q", ErrLeased, string(kv.Value), chunk)
+		}
+		if _, err := c.cl.KeepAliveOnce(ctx, clientv3.LeaseID(kv.Lease)); err != nil {
+			return fmt.Errorf("renewing the lease of %q: %v", chunk, err)
+		}
+		return nil
+	}
+
+	lease, err := c.cl.Create(ctx, int64(ChunkLeaseTTL/time.Second))
+	if err != nil {
+		return fmt.Errorf("creating the lease of %q: %v", chunk, err)
+	}
+	txnResp, err := c.cl.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreatedRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, consumer, clientv3.WithLease(clientv3.LeaseID(lease.ID)))).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("leasing %q: %v", chunk, err)
+	}
+	if !txnResp.Succeeded {
+		// another consumer got the lease first
+		if _, err := c.cl.Revoke(ctx, clientv3.LeaseID(lease.ID)); err != nil {
+			return fmt.Errorf("revoking the unused lease: %v", err)
+		}
+		return fmt.Errorf("%w: %q", ErrLeased, chunk)
+	}
+	return nil
+}
+
+// ChunkLeaseHolder returns the consumer of the group that holds
+// the lease of the chunk, empty if there is none.
+func (c *State) ChunkLeaseHolder(ctx context.Context, category, group, chunk string) (string, error) {
+	resp, err := c.cl.Get(ctx, c.leaseKey(category, group, chunk))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// ReleaseChunk releases the lease of the chunk if the consumer holds it,
+// so that the chunk does not wait for ChunkLeaseTTL to be leased again.
+func (c *State) ReleaseChunk(ctx context.Context, category, group, chunk, consumer string) error {
+	resp, err := c.cl.Get(ctx, c.leaseKey(category, group, chunk))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 || string(resp.Kvs[0].Value) != consumer {
+		return nil
+	}
+	if _, err := c.cl.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+		return fmt.Errorf("releasing %q: %v", chunk, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseChunk(t *testing.T) {
+	st, e := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := st.LeaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "first"); err != nil {
+		t.Fatalf("LeaseChunk(first) failed: %v", err)
+	}
+	if holder, err := st.ChunkLeaseHolder(ctx, "numbers", "billing", "moscow-chunk0"); err != nil || holder != "first" {
+		t.Errorf("ChunkLeaseHolder() = %q, %v; want first", holder, err)
+	}
+
+	// the heartbeat of the holder renews the lease
+	if err := st.LeaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "first"); err != nil {
+		t.Errorf("LeaseChunk(first) again failed: %v", err)
+	}
+	if err := st.LeaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "second"); !errors.Is(err, ErrLeased) {
+		t.Errorf("LeaseChunk(second) = %v, want ErrLeased", err)
+	}
+	// the groups lease the chunks independently
+	if err := st.LeaseChunk(ctx, "numbers", "audit", "moscow-chunk0", "second"); err != nil {
+		t.Errorf("LeaseChunk(second) in another group failed: %v", err)
+	}
+
+	// the chunk passes to another consumer once the lease expires
+	e.expireLease(e.leaseOf(st.leaseKey("numbers", "billing", "moscow-chunk0")))
+	if holder, err := st.ChunkLeaseHolder(ctx, "numbers", "billing", "moscow-chunk0"); err != nil || holder != "" {
+		t.Errorf("ChunkLeaseHolder() = %q, %v after expiry; want none", holder, err)
+	}
+	if err := st.LeaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "second"); err != nil {
+		t.Errorf("LeaseChunk(second) after expiry failed: %v", err)
+	}
+}
+
+func TestReleaseChunk(t *testing.T) {
+	st, _ := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := st.LeaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "first"); err != nil {
+		t.Fatalf("LeaseChunk(first) failed: %v", err)
+	}
+
+	// only the holder releases the lease
+	if err := st.ReleaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "second"); err != nil {
+		t.Fatalf("ReleaseChunk(second) failed: %v", err)
+	}
+	if holder, err := st.ChunkLeaseHolder(ctx, "numbers", "billing", "moscow-chunk0"); err != nil || holder != "first" {
+		t.Errorf("ChunkLeaseHolder() = %q, %v; want first", holder, err)
+	}
+
+	if err := st.ReleaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "first"); err != nil {
+		t.Fatalf("ReleaseChunk(first) failed: %v", err)
+	}
+	if holder, err := st.ChunkLeaseHolder(ctx, "numbers", "billing", "moscow-chunk0"); err != nil || holder != "" {
+		t.Errorf("ChunkLeaseHolder() = %q, %v after release; want none", holder, err)
+	}
+	if err := st.LeaseChunk(ctx, "numbers", "billing", "moscow-chunk0", "second"); err != nil {
+		t.Errorf("LeaseChunk(second) after release failed: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/storage/storagepb"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// PeerTTL is how long a peer stays registered once it stops renewing
+// its registration, e.g. because it crashed or was shut down.
+const PeerTTL = 10 * time.Second
+
+// registerPeer puts the peer under "peers/" with a lease that is kept alive
+// in the background for as long as the process runs.
+func (c *State) registerPeer(ctx context.Context, p Peer) error {
+	lease, err := c.cl.Create(ctx, int64(PeerTTL/time.Second))
+	if err != nil {
+		return fmt.Errorf("creating the lease: %v", err)
+	}
+	if _, err := c.cl.Put(ctx, c.prefix+"peers/"+p.InstanceName, p.ListenAddr, clientv3.WithLease(clientv3.LeaseID(lease.ID))); err != nil {
+		return err
+	}
+	keepAliveCh, err := c.cl.KeepAlive(context.Background(), clientv3.LeaseID(lease.ID))
+	if err != nil {
+		return fmt.Errorf("keeping the lease alive: %v", err)
+	}
+	go c.keepPeerAlive(p, keepAliveCh)
+	return nil
+}
+
+// keepPeerAlive registers the peer again once its lease is lost,
+// e.g. when etcd was unavailable for longer than PeerTTL.
+func (c *State) keepPeerAlive(p Peer, keepAliveCh <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range keepAliveCh {
+	}
+
+	for {
+		log.Printf("the registration of peer %q has expired, registering again", p.InstanceName)
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		err := c.registerPeer(ctx, p)
+		cancel()
+		if err == nil {
+			c.mu.Lock()
+			for _, fn := range c.reregistered {
+				go fn()
+			}
+			c.mu.Unlock()
+			return
+		}
+		log.Printf("could not register peer %q: %v", p.InstanceName, err)
+		time.Sleep(PeerTTL / 2)
+	}
+}
+
+// OnReregistered calls fn in its own goroutine every time the peer is
+// registered again after its registration expired. The other instances
+// may have cleaned up after the peer in the meantime.
+func (c *State) OnReregistered(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reregistered = append(c.reregistered, fn)
+}
+
+// PeerEvent is a change of the cluster membership.
+type PeerEvent struct {
+	Peer Peer
+	// Departed is set when the peer has left the cluster,
+	// ListenAddr is empty then.
+	Departed bool
+}
+
+// WatchPeers returns the registered peers and then the changes of the
+// membership until ctx is done.
+func (c *State) WatchPeers(ctx context.Context) chan PeerEvent {
+	prefix := c.prefix + "peers/"
+	resCh := make(chan PeerEvent)
+
+	go func() {
+		defer close(resCh)
+
+		resp, err := c.cl.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			log.Printf("etcd list peers failed (THE MEMBERSHIP WILL NOT BE WATCHED): %v", err)
+			return
+		}
+		for _, kv := range resp.Kvs {
+			resCh <- PeerEvent{Peer: Peer{
+				InstanceName: strings.TrimPrefix(string(kv.Key), prefix),
+				ListenAddr:   string(kv.Value),
+			}}
+		}
+
+		// continue right after the listed revision so that no change is missed
+		for watchResp := range c.cl.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1)) {
+			if err := watchResp.Err(); err != nil {
+				log.Printf("etcd watch peers error: %v", err)
+			}
+			for _, ev := range watchResp.Events {
+				e := PeerEvent{Peer: Peer{InstanceName: strings.TrimPrefix(string(ev.Kv.Key), prefix)}}
+				if ev.Type == storagepb.PUT {
+					e.Peer.ListenAddr = string(ev.Kv.Value)
+				} else {
+					e.Departed = true
+				}
+				resCh <- e
+			}
+		}
+	}()
+	return resCh
+}
+
+// departedGracePeriod is how long a departed peer has to register again
+// before the other instances clean up after it. The lease of a live peer
+// expires if etcd is unavailable for longer than PeerTTL, and the peer
+// registers again within PeerTTL/2 after that.
+const departedGracePeriod = 2 * PeerTTL
+
+// DeleteReplicationQueue deletes the replication queue of the instance
+// unless it is registered, it returns false then.
+func (c *State) DeleteReplicationQueue(ctx context.Context, instanceName string) (bool, error) {
+	resp, err := c.cl.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreatedRevision(c.prefix+"peers/"+instanceName), "=", 0)).
+		Then(clientv3.OpDelete(c.prefix+"replication/"+instanceName+"/", clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// CleanupDeparted watches the membership and, once a peer departs and does
+// not come back within departedGracePeriod, deletes its replication queue,
+// gives its copies of the chunks of this instance to the other peers, so that
+// the categories with a replication factor keep the number of copies, and
+// stops downloading its chunks. It runs until ctx is done.
+func (s *Storage) CleanupDeparted(ctx context.Context) {
+	for e := range s.client.WatchPeers(ctx) {
+		if !e.Departed || e.Peer.InstanceName == s.currentInstance {
+			continue
+		}
+		log.Printf("peer %q has departed", e.Peer.InstanceName)
+		go func(departed string) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(departedGracePeriod):
+			}
+			if err := s.cleanupDeparted(ctx, departed); err != nil {
+				log.Printf("could not clean up after peer %q: %v", departed, err)
+			}
+		}(e.Peer.InstanceName)
+	}
+}
+
+func (s *Storage) cleanupDeparted(ctx context.Context, departed string) error {
+	// every instance does it, the deletion is idempotent and it is
+	// only done if the peer has not registered again in the meantime
+	deleted, err := s.client.DeleteReplicationQueue(ctx, departed)
+	if err != nil {
+		return fmt.Errorf("deleting the replication queue: %v", err)
+	}
+	if !deleted {
+		log.Printf("peer %q has registered again", departed)
+		return nil
+	}
+
+	peers, err := s.client.ListPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("getting peers from etcd: %v", err)
+	}
+	placements, err := s.client.ListChunkReplicas(ctx)
+	if err != nil {
+		return fmt.Errorf("listing chunk replicas: %v", err)
+	}
+	for _, p := range placements {
+		if len(p.Instances) == 0 || p.Instances[0] != s.currentInstance || !containsString(p.Instances, departed) {
+			continue
+		}
+		if err := s.reassign(ctx, peers, p); err != nil {
+			return err
+		}
+	}
+
+	// the chunks of the departed peer can not be downloaded anymore,
+	// the download workers stop once they are out of the queue
+	queue, err := s.client.ReplicationQueue(ctx, s.currentInstance)
+	if err != nil {
+		return fmt.Errorf("getting the replication queue: %v", err)
+	}
+	for _, ch := range queue {
+		if ch.Owner != departed {
+			continue
+		}
+		if err := s.client.DeleteChunkFromReplicationQueue(ctx, s.currentInstance, ch); err != nil {
+			return fmt.Errorf("deleting chunk %+v from the replication queue: %v", ch, err)
+		}
+	}
+	return nil
+}
+
+// reassign replaces the departed replicas of the chunk with the next peers
+// that the rendezvous hashing selects.
+func (s *Storage) reassign(ctx context.Context, peers []Peer, p ChunkPlacement) error {
+	copies := -1
+	if rf := s.cfg.Category(p.Category).ReplicationFactor; rf > 0 {
+		copies = rf - 1
+	}
+
+	instances := []string{s.currentInstance}
+	for _, target := range placeReplicas(peers, s.currentInstance, p.Category, p.FileName, copies) {
+		instances = append(instances, target.InstanceName)
+		if containsString(p.Instances, target.InstanceName) {
+			continue
+		}
+		log.Printf("replicating chunk %q of category %q to %q instead of a departed peer", p.FileName, p.Category, target.InstanceName)
+		if err := s.client.AddChunkToReplicationQueue(ctx, target.InstanceName, Chunk{
+			Owner:    s.currentInstance,
+			Category: p.Category,
+			FileName: p.FileName,
+		}); err != nil {
+			return fmt.Errorf("could not write to replication queue for %q (%q): %w", target.InstanceName, target.ListenAddr, err)
+		}
+	}
+	if err := s.client.SetChunkReplicas(ctx, p.Category, p.FileName, instances); err != nil {
+		return fmt.Errorf("recording replicas of %q: %w", p.FileName, err)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package replication
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+func testRegister(t *testing.T, st *State, names ...string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, name := range names {
+		if err := st.put(ctx, "peers/"+name, name+":8080"); err != nil {
+			t.Fatalf("registering %q failed: %v", name, err)
+		}
+	}
+}
+
+func testQueue(t *testing.T, st *State, instance string) []Chunk {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	queue, err := st.ReplicationQueue(ctx, instance)
+	if err != nil {
+		t.Fatalf("ReplicationQueue(%q) failed: %v", instance, err)
+	}
+	return queue
+}
+
+func TestCleanupDeparted(t *testing.T) {
+	st, _ := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// kazan has departed
+	testRegister(t, st, "moscow", "samara", "omsk", "perm")
+	cfg := &config.Config{Categories: map[string]config.Category{"numbers": {ReplicationFactor: 2}}}
+	s := NewStorage(st, "moscow", cfg)
+
+	own := Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk0"}
+	other := Chunk{Owner: "samara", Category: "numbers", FileName: "samara-chunk0"}
+	for _, p := range []ChunkPlacement{
+		{Category: own.Category, FileName: own.FileName, Instances: []string{"moscow", "kazan"}},
+		{Category: other.Category, FileName: other.FileName, Instances: []string{"samara", "kazan"}},
+	} {
+		if err := st.SetChunkReplicas(ctx, p.Category, p.FileName, p.Instances); err != nil {
+			t.Fatalf("SetChunkReplicas() failed: %v", err)
+		}
+	}
+	for _, ch := range []Chunk{own, other} {
+		if err := st.AddChunkToReplicationQueue(ctx, "kazan", ch); err != nil {
+			t.Fatalf("AddChunkToReplicationQueue() failed: %v", err)
+		}
+	}
+	fromKazan := Chunk{Owner: "kazan", Category: "numbers", FileName: "kazan-chunk0"}
+	for _, ch := range []Chunk{fromKazan, other} {
+		if err := st.AddChunkToReplicationQueue(ctx, "moscow", ch); err != nil {
+			t.Fatalf("AddChunkToReplicationQueue() failed: %v", err)
+		}
+	}
+
+	if err := s.cleanupDeparted(ctx, "kazan"); err != nil {
+		t.Fatalf("cleanupDeparted() failed: %v", err)
+	}
+
+	if queue := testQueue(t, st, "kazan"); len(queue) != 0 {
+		t.Errorf("the queue of kazan = %+v, want it deleted", queue)
+	}
+	if got, want := testQueue(t, st, "moscow"), []Chunk{other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the queue of moscow = %+v, want %+v without the chunks of kazan", got, want)
+	}
+
+	peers, err := st.ListPeers(ctx)
+	if err != nil {
+		t.Fatalf("ListPeers() failed: %v", err)
+	}
+	target := placeReplicas(peers, "moscow", "numbers", own.FileName, 1)[0].InstanceName
+	if got, want := testQueue(t, st, target), []Chunk{own}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the queue of %q = %+v, want %+v", target, got, want)
+	}
+	if got, err := st.ChunkReplicas(ctx, own.Category, own.FileName); err != nil || !reflect.DeepEqual(got, []string{"moscow", target}) {
+		t.Errorf("ChunkReplicas(%q) = %v, %v; want [moscow %s]", own.FileName, got, err, target)
+	}
+	// the owner of the chunk reassigns it
+	if got, err := st.ChunkReplicas(ctx, other.Category, other.FileName); err != nil || !reflect.DeepEqual(got, []string{"samara", "kazan"}) {
+		t.Errorf("ChunkReplicas(%q) = %v, %v; want it unchanged", other.FileName, got, err)
+	}
+}
+
+func TestCleanupDepartedRegisteredAgain(t *testing.T) {
+	st, _ := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// kazan came back during the grace period
+	testRegister(t, st, "moscow", "kazan", "samara")
+	cfg := &config.Config{Categories: map[string]config.Category{"numbers": {ReplicationFactor: 2}}}
+	s := NewStorage(st, "moscow", cfg)
+
+	own := Chunk{Owner: "moscow", Category: "numbers", FileName: "moscow-chunk0"}
+	if err := st.SetChunkReplicas(ctx, own.Category, own.FileName, []string{"moscow", "kazan"}); err != nil {
+		t.Fatalf("SetChunkReplicas() failed: %v", err)
+	}
+	if err := st.AddChunkToReplicationQueue(ctx, "kazan", own); err != nil {
+		t.Fatalf("AddChunkToReplicationQueue() failed: %v", err)
+	}
+	fromKazan := Chunk{Owner: "kazan", Category: "numbers", FileName: "kazan-chunk0"}
+	if err := st.AddChunkToReplicationQueue(ctx, "moscow", fromKazan); err != nil {
+		t.Fatalf("AddChunkToReplicationQueue() failed: %v", err)
+	}
+
+	if err := s.cleanupDeparted(ctx, "kazan"); err != nil {
+		t.Fatalf("cleanupDeparted() failed: %v", err)
+	}
+	if got, want := testQueue(t, st, "kazan"), []Chunk{own}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the queue of kazan = %+v, want %+v", got, want)
+	}
+	if got, want := testQueue(t, st, "moscow"), []Chunk{fromKazan}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the queue of moscow = %+v, want %+v", got, want)
+	}
+	if got, err := st.ChunkReplicas(ctx, own.Category, own.FileName); err != nil || !reflect.DeepEqual(got, []string{"moscow", "kazan"}) {
+		t.Errorf("ChunkReplicas() = %v, %v; want it unchanged", got, err)
+	}
+}
+
+func TestReregisterPeer(t *testing.T) {
+	st, e := testState(t)
+	// the lease is renewed every half a second
+	e.grantedTTL = 1
+	reregistered := make(chan struct{}, 1)
+	st.OnReregistered(func() { reregistered <- struct{}{} })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := st.RegisterNewPeer(ctx, Peer{InstanceName: "moscow", ListenAddr: "moscow:8080"}); err != nil {
+		t.Fatalf("RegisterNewPeer() failed: %v", err)
+	}
+
+	// etcd was unavailable for too long
+	lease := e.leaseOf(st.prefix + "peers/moscow")
+	e.expireLease(lease)
+
+	select {
+	case <-reregistered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the peer has not registered again")
+	}
+	if newLease := e.leaseOf(st.prefix + "peers/moscow"); newLease == 0 || newLease == lease {
+		t.Errorf("the peer is registered with lease %d, want a new one instead of %d", newLease, lease)
+	}
+}
@@ -0,0 +1,110 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// The instances that store a chunk are recorded under "replicas/<category>/<chunk>"
+// when the chunk is created, the owner goes first. The owner deletes the record
+// together with the chunk.
+
+// placeReplicas selects n peers besides the owner that store the copies of
+// the chunk with rendezvous hashing: every peer gets a score for the chunk and
+// the ones with the highest scores win. The selection only depends on the
+// chunk and the peers, and adding or removing a peer only moves the chunks
+// that it wins or loses. n < 0 selects all of them.
+func placeReplicas(peers []Peer, owner, category, chunk string, n int) []Peer {
+	res := make([]Peer, 0, len(peers))
+	for _, p := range peers {
+		if p.InstanceName != owner {
+			res = append(res, p)
+		}
+	}
+	if n < 0 || n >= len(res) {
+		return res
+	}
+
+	scores := make(map[string]uint64, len(res))
+	for _, p := range res {
+		h := fnv.New64a()
+		h.Write([]byte(category + "/" + chunk + "/" + p.InstanceName))
+		scores[p.InstanceName] = h.Sum64()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := scores[res[i].InstanceName], scores[res[j].InstanceName]
+		if a != b {
+			return a > b
+		}
+		return res[i].InstanceName < res[j].InstanceName
+	})
+	return res[:n]
+}
+
+// SetChunkReplicas records the instances that store the chunk.
+func (c *State) SetChunkReplicas(ctx context.Context, category, chunk string, instances []string) error {
+	b, err := json.Marshal(instances)
+	if err != nil {
+		return err
+	}
+	return c.put(ctx, "replicas/"+category+"/"+chunk, string(b))
+}
+
+// DeleteChunkReplicas deletes the record of the instances that store the chunk.
+func (c *State) DeleteChunkReplicas(ctx context.Context, category, chunk string) error {
+	_, err := c.cl.Delete(ctx, c.prefix+"replicas/"+category+"/"+chunk)
+	return err
+}
+
+// ChunkReplicas returns the instances that store the chunk, the owner first.
+// It returns nil for the chunks that were created before the replicas were
+// recorded, they are stored by every instance.
+func (c *State) ChunkReplicas(ctx context.Context, category, chunk string) ([]string, error) {
+	resp, err := c.get(ctx, "replicas/"+category+"/"+chunk)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) == 0 {
+		return nil, nil
+	}
+
+	var res []string
+	if err := json.Unmarshal([]byte(resp[0].Value), &res); err != nil {
+		return nil, fmt.Errorf("parsing replicas of chunk %q: %v", chunk, err)
+	}
+	return res, nil
+}
+
+// ChunkPlacement is the recorded set of instances that store the chunk.
+type ChunkPlacement struct {
+	Category  string
+	FileName  string
+	Instances []string
+}
+
+// ListChunkReplicas returns the recorded instances of all chunks.
+func (c *State) ListChunkReplicas(ctx context.Context) ([]ChunkPlacement, error) {
+	prefix := "replicas/"
+	resp, err := c.get(ctx, prefix, WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ChunkPlacement, 0, len(resp))
+	for _, kv := range resp {
+		parts := strings.SplitN(strings.TrimPrefix(kv.Key, c.prefix+prefix), "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected key %q, expected the category and the chunk", kv.Key)
+		}
+		p := ChunkPlacement{Category: parts[0], FileName: parts[1]}
+		if err := json.Unmarshal([]byte(kv.Value), &p.Instances); err != nil {
+			return nil, fmt.Errorf("parsing replicas %q: %v", kv.Key, err)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
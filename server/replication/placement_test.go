@@ -0,0 +1,157 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+func testPeers(names ...string) []Peer {
+	res := make([]Peer, 0, len(names))
+	for _, name := range names {
+		res = append(res, Peer{InstanceName: name, ListenAddr: name + ":8080"})
+	}
+	return res
+}
+
+func peerNames(peers []Peer) []string {
+	res := make([]string, 0, len(peers))
+	for _, p := range peers {
+		res = append(res, p.InstanceName)
+	}
+	return res
+}
+
+func TestPlaceReplicas(t *testing.T) {
+	peers := testPeers("moscow", "kazan", "samara", "omsk", "perm")
+	// the peers that win chunk0 of "numbers", computed once
+	two := peerNames(placeReplicas(peers, "moscow", "numbers", "moscow-chunk0", 2))
+	var withoutLoser []Peer
+	for i, p := range peers {
+		if i != 0 && !containsString(two, p.InstanceName) && withoutLoser == nil {
+			// the first peer that does not win the chunk departs
+			withoutLoser = append(append([]Peer{}, peers[:i]...), peers[i+1:]...)
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		peers []Peer
+		n     int
+		want  []string
+	}{
+		{
+			name:  "all peers",
+			peers: peers,
+			n:     -1,
+			want:  []string{"kazan", "samara", "omsk", "perm"},
+		},
+		{
+			name:  "more than peers",
+			peers: peers,
+			n:     10,
+			want:  []string{"kazan", "samara", "omsk", "perm"},
+		},
+		{
+			name:  "exactly the peers",
+			peers: peers,
+			n:     4,
+			want:  []string{"kazan", "samara", "omsk", "perm"},
+		},
+		{
+			name:  "none",
+			peers: peers,
+			n:     0,
+			want:  []string{},
+		},
+		{
+			name:  "only the owner",
+			peers: testPeers("moscow"),
+			n:     2,
+			want:  []string{},
+		},
+		{
+			name:  "same order of peers",
+			peers: testPeers("perm", "omsk", "samara", "kazan", "moscow"),
+			n:     2,
+			want:  two,
+		},
+		{
+			name:  "a peer that did not win departed",
+			peers: withoutLoser,
+			n:     2,
+			want:  two,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := peerNames(placeReplicas(tc.peers, "moscow", "numbers", "moscow-chunk0", tc.n))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("placeReplicas(n=%d) = %v, want %v", tc.n, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlaceReplicasSpreadsChunks(t *testing.T) {
+	peers := testPeers("moscow", "kazan", "samara", "omsk", "perm")
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		chunk := fmt.Sprintf("moscow-chunk%d", i)
+		got := placeReplicas(peers, "moscow", "numbers", chunk, 2)
+		if len(got) != 2 {
+			t.Fatalf("placeReplicas(%q) = %v, want 2 peers", chunk, peerNames(got))
+		}
+		for _, p := range got {
+			if p.InstanceName == "moscow" {
+				t.Fatalf("placeReplicas(%q) = %v, want the owner excluded", chunk, peerNames(got))
+			}
+			counts[p.InstanceName]++
+		}
+
+		// adding a peer only moves the chunks that it wins
+		more := placeReplicas(append(testPeers("vladimir"), peers...), "moscow", "numbers", chunk, 2)
+		for _, p := range more {
+			if p.InstanceName != "vladimir" && !containsString(peerNames(got), p.InstanceName) {
+				t.Errorf("placeReplicas(%q) = %v with a new peer, was %v", chunk, peerNames(more), peerNames(got))
+			}
+		}
+	}
+	for _, name := range []string{"kazan", "samara", "omsk", "perm"} {
+		// 200 copies on average
+		if counts[name] < 100 {
+			t.Errorf("peer %q stores %d of 800 copies, want them spread evenly: %v", name, counts[name], counts)
+		}
+	}
+}
+
+func TestDeleteChunkReplicas(t *testing.T) {
+	st, _ := testState(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s := NewStorage(st, "moscow", &config.Config{})
+	for _, chunk := range []string{"moscow-chunk0", "kazan-chunk0"} {
+		if err := st.SetChunkReplicas(ctx, "numbers", chunk, []string{"moscow", "kazan"}); err != nil {
+			t.Fatalf("SetChunkReplicas(%q) failed: %v", chunk, err)
+		}
+		if err := s.AfterDeletingChunk(ctx, "numbers", chunk); err != nil {
+			t.Fatalf("AfterDeletingChunk(%q) failed: %v", chunk, err)
+		}
+	}
+
+	// only the owner deletes the record
+	placements, err := st.ListChunkReplicas(ctx)
+	if err != nil {
+		t.Fatalf("ListChunkReplicas() failed: %v", err)
+	}
+	want := []ChunkPlacement{{Category: "numbers", FileName: "kazan-chunk0", Instances: []string{"moscow", "kazan"}}}
+	if !reflect.DeepEqual(placements, want) {
+		t.Errorf("ListChunkReplicas() = %+v, want %+v", placements, want)
+	}
+}
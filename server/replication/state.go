@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/storage/storagepb"
@@ -18,6 +19,10 @@ const defaultTimeout = 10 * time.Second
 type State struct {
 	cl     *clientv3.Client
 	prefix string
+
+	mu sync.Mutex
+	// reregistered are called when the peer registers again.
+	reregistered []func()
 }
 
 // NewState initialises the connection to the etcd cluster.
@@ -85,8 +90,10 @@ type Peer struct {
 	ListenAddr   string
 }
 
+// RegisterNewPeer registers the instance in the cluster until the process
+// exits, the registration expires PeerTTL after that.
 func (c *State) RegisterNewPeer(ctx context.Context, p Peer) error {
-	return c.put(ctx, "peers/"+p.InstanceName, p.ListenAddr)
+	return c.registerPeer(ctx, p)
 }
 
 func (c *State) ListPeers(ctx context.Context) ([]Peer, error) {
@@ -116,6 +123,18 @@ func (c *State) AddChunkToReplicationQueue(ctx context.Context, targetInstance s
 	key := "replication/" + targetInstance + "/" + ch.Category + "/" + ch.FileName
 	return c.put(ctx, key, ch.Owner)
 }
+
+// InReplicationQueue reports whether the chunk is in the replication
+// queue of the instance.
+func (c *State) InReplicationQueue(ctx context.Context, targetInstance string, ch Chunk) (bool, error) {
+	key := "replication/" + targetInstance + "/" + ch.Category + "/" + ch.FileName
+	resp, err := c.get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return len(resp) > 0, nil
+}
+
 func (c *State) DeleteChunkFromReplicationQueue(ctx context.Context, targetInstance string, ch Chunk) error {
 	key := "replication/" + targetInstance + "/" + ch.Category + "/" + ch.FileName
 	log.Printf("prefix %v, key %v", c.prefix, key)
@@ -123,6 +142,25 @@ func (c *State) DeleteChunkFromReplicationQueue(ctx context.Context, targetInsta
 	return err
 }
 
+// ReplicationQueue returns the chunks in the replication queue of the instance.
+func (c *State) ReplicationQueue(ctx context.Context, instanceName string) ([]Chunk, error) {
+	prefix := c.prefix + "replication/" + instanceName + "/"
+	resp, err := c.cl.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Chunk, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		ch, err := c.ParseReplicationKey(prefix, kv)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ch)
+	}
+	return res, nil
+}
+
 type WatchResponse clientv3.WatchResponse
 
 func (c *State) ParseReplicationKey(prefix string, kv *storagepb.KeyValue) (Chunk, error) {
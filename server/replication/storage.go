@@ -3,6 +3,10 @@ package replication
 import (
 	"context"
 	"fmt"
+	"log"
+	"strings"
+
+	"github.com/yyancy/go-queue/config"
 )
 
 // Storage provide hooks for the ondisk storage that will be called to
@@ -10,12 +14,14 @@ import (
 type Storage struct {
 	client          *State
 	currentInstance string
+	cfg             *config.Config
 }
 
-func NewStorage(client *State, currentInstance string) *Storage {
+func NewStorage(client *State, currentInstance string, cfg *config.Config) *Storage {
 	return &Storage{
 		client:          client,
 		currentInstance: currentInstance,
+		cfg:             cfg,
 	}
 
 }
@@ -26,11 +32,26 @@ func (s *Storage) BeforeCreatingChunk(ctx context.Context, category, filename st
 		return fmt.Errorf("getting peers from etcd: %v", err)
 	}
 
-	for _, p := range peers {
-		if p.InstanceName == s.currentInstance {
-			continue
-		}
+	// the replication factor includes the copy of this instance
+	copies := -1
+	if rf := s.cfg.Category(category).ReplicationFactor; rf > 0 {
+		copies = rf - 1
+	}
+	targets := placeReplicas(peers, s.currentInstance, category, filename, copies)
+	if copies > len(targets) {
+		log.Printf("category %q needs %d replicas of chunk %q, only %d instances are available",
+			category, copies, filename, len(targets))
+	}
+
+	instances := []string{s.currentInstance}
+	for _, p := range targets {
+		instances = append(instances, p.InstanceName)
+	}
+	if err := s.client.SetChunkReplicas(ctx, category, filename, instances); err != nil {
+		return fmt.Errorf("recording replicas of %q: %w", filename, err)
+	}
 
+	for _, p := range targets {
 		if err := s.client.AddChunkToReplicationQueue(ctx, p.InstanceName, Chunk{
 			Owner:    s.currentInstance,
 			Category: category,
@@ -41,3 +62,19 @@ func (s *Storage) BeforeCreatingChunk(ctx context.Context, category, filename st
 	}
 	return nil
 }
+
+// AfterDeletingChunk expires the offsets that the consumer groups
+// committed in the deleted chunk and, on the owner of the chunk,
+// deletes the record of its replicas.
+func (s *Storage) AfterDeletingChunk(ctx context.Context, category, filename string) error {
+	if err := s.client.ExpireChunkOffsets(ctx, category, filename); err != nil {
+		return fmt.Errorf("expiring offsets in %q: %w", filename, err)
+	}
+	if !strings.HasPrefix(filename, s.currentInstance+"-") {
+		return nil
+	}
+	if err := s.client.DeleteChunkReplicas(ctx, category, filename); err != nil {
+		return fmt.Errorf("deleting replicas of %q: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// retentionInterval is how often the janitor enforces the retention policy.
+const retentionInterval = time.Minute
+
+// retentionLoop is the janitor that periodically deletes the chunks
+// that exceed the retention limits of the category.
+func (c *OnDisk) retentionLoop() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.enforceRetention(time.Now()); err != nil {
+			log.Printf("enforcing retention of category %q failed: %v", c.category, err)
+		}
+	}
+}
+
+type chunkStat struct {
+	name     string
+	size     uint64
+	modTime  time.Time
+	complete bool
+}
+
+// enforceRetention deletes the oldest sealed chunks until the chunks
+// of the category fit into the retention limits.
+// The chunks that are still written to are never deleted, but they are
+// taken into account for the size and the number of chunks.
+func (c *OnDisk) enforceRetention(now time.Time) error {
+	chunks, err := c.ListChunks()
+	if err != nil {
+		return err
+	}
+
+	var stats []chunkStat
+	var totalBytes uint64
+	for _, ch := range chunks {
+		filename := c.chunkFilename(ch.Name)
+		if ch.Compressed {
+			filename = c.compressedFilename(ch.Name)
+		}
+		fi, err := os.Stat(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// the limit is on the disk space, so the compressed
+		// chunks count with their compressed size
+		stats = append(stats, chunkStat{
+			name:     ch.Name,
+			size:     uint64(fi.Size()),
+			modTime:  fi.ModTime(),
+			complete: ch.Complete,
+		})
+		totalBytes += uint64(fi.Size())
+	}
+
+	// oldest first
+	sort.Slice(stats, func(i, j int) bool { return stats[i].modTime.Before(stats[j].modTime) })
+
+	totalChunks := len(stats)
+	for _, st := range stats {
+		if !st.complete {
+			continue
+		}
+
+		var reason string
+		switch {
+		case c.retentionAge > 0 && now.Sub(st.modTime) > c.retentionAge:
+			reason = fmt.Sprintf("older than %s", c.retentionAge)
+		case c.retentionBytes > 0 && totalBytes > c.retentionBytes:
+			reason = fmt.Sprintf("category size %d exceeds %d bytes", totalBytes, c.retentionBytes)
+		case c.retentionChunks > 0 && totalChunks > c.retentionChunks:
+			reason = fmt.Sprintf("category has %d chunks, more than %d", totalChunks, c.retentionChunks)
+		default:
+			continue
+		}
+
+		log.Printf("retention: deleting chunk %q of category %q: %s", st.name, c.category, reason)
+		if err := c.deleteChunk(st.name); err != nil {
+			return fmt.Errorf("deleting chunk %q: %v", st.name, err)
+		}
+		totalBytes -= st.size
+		totalChunks--
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+func testCreateChunk(t *testing.T, dir, name string, size int, modTime time.Time, sealed bool) {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, bytes.Repeat([]byte("\n"), size), 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes() failed: %v", err)
+	}
+	if sealed {
+		testCreateFile(t, path+sealSuffix)
+	}
+}
+
+func testChunkNames(t *testing.T, srv *OnDisk) []string {
+	t.Helper()
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks failed %v", err)
+	}
+	var res []string
+	for _, ch := range chunks {
+		res = append(res, ch.Name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		desc string
+		cfg  config.Category
+		want []string
+	}{
+		{
+			desc: "age",
+			cfg:  config.Category{RetentionAge: config.Duration(90 * time.Minute)},
+			want: []string{"london-chunk1", "london-chunk2", "moscow-chunk3"},
+		},
+		{
+			desc: "bytes",
+			cfg:  config.Category{RetentionBytes: 250},
+			want: []string{"london-chunk1", "moscow-chunk3"},
+		},
+		{
+			desc: "chunks",
+			cfg:  config.Category{RetentionChunks: 3},
+			want: []string{"london-chunk1", "london-chunk2", "moscow-chunk3"},
+		},
+		{
+			desc: "incomplete chunks are never deleted",
+			cfg:  config.Category{RetentionChunks: 1},
+			want: []string{"london-chunk1", "moscow-chunk3"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := getTempDir(t)
+			testCreateChunk(t, dir, "moscow-chunk1", 100, now.Add(-3*time.Hour), true)
+			// london-chunk1 is still being replicated
+			testCreateChunk(t, dir, "london-chunk1", 100, now.Add(-time.Hour), false)
+			testCreateChunk(t, dir, "london-chunk2", 100, now.Add(-30*time.Minute), true)
+			testCreateChunk(t, dir, "moscow-chunk3", 100, now, false)
+
+			srv := testNewOnDiskWithConfig(t, dir, tc.cfg)
+			if err := srv.enforceRetention(now); err != nil {
+				t.Fatalf("enforceRetention() = %v, want no errors", err)
+			}
+			if got := testChunkNames(t, srv); !equalStrings(got, tc.want) {
+				t.Errorf("chunks after retention = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetentionBytesCompressed(t *testing.T) {
+	dir := getTempDir(t)
+	contents := testCompressedContents()
+	for _, name := range []string{"moscow-chunk1", "moscow-chunk2"} {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0666); err != nil {
+			t.Fatalf("WriteFile() failed: %v", err)
+		}
+		testCreateFile(t, filepath.Join(dir, name+sealSuffix))
+	}
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Compression: config.CompressionGzip})
+	if err := srv.compressSealed(); err != nil {
+		t.Fatalf("compressSealed() failed: %v", err)
+	}
+
+	var compressed uint64
+	for _, name := range []string{"moscow-chunk1", "moscow-chunk2"} {
+		fi, err := os.Stat(srv.compressedFilename(name))
+		if err != nil {
+			t.Fatalf("Stat() failed: %v", err)
+		}
+		compressed += uint64(fi.Size())
+	}
+
+	// both chunks fit on the disk, but not uncompressed
+	srv.retentionBytes = compressed
+	if err := srv.enforceRetention(time.Now()); err != nil {
+		t.Fatalf("enforceRetention() = %v, want no errors", err)
+	}
+	if got, want := testChunkNames(t, srv), []string{"moscow-chunk1", "moscow-chunk2"}; !equalStrings(got, want) {
+		t.Errorf("chunks after retention = %v, want %v", got, want)
+	}
+
+	srv.retentionBytes = compressed - 1
+	if err := srv.enforceRetention(time.Now()); err != nil {
+		t.Fatalf("enforceRetention() = %v, want no errors", err)
+	}
+	if got := testChunkNames(t, srv); len(got) != 1 {
+		t.Errorf("chunks after retention = %v, want one of them", got)
+	}
+}
+
+func TestAckInLogMode(t *testing.T) {
+	dir := getTempDir(t)
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Mode: config.ModeLog})
+	testCreateChunk(t, dir, "moscow-chunk1", 100, time.Now(), true)
+
+	if err := srv.Ack("moscow-chunk1", 100); err != nil {
+		t.Fatalf("Ack() = %v, want no errors", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moscow-chunk1")); err != nil {
+		t.Errorf("chunk after Ack in the log mode: %v, want it to exist", err)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// maxRolloverInterval is the upper bound of how often the idle chunks are checked.
+const maxRolloverInterval = time.Minute
+
+// rolloverLoop seals the active chunk once it is older than maxChunkAge
+// even if nothing is written to it anymore, so that the consumers and
+// the replicas see it as complete.
+func (c *OnDisk) rolloverLoop() {
+	interval := c.maxChunkAge / 10
+	if interval > maxRolloverInterval {
+		interval = maxRolloverInterval
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.sealExpiredChunk(time.Now()); err != nil {
+			log.Printf("sealing the expired chunk of category %q failed: %v", c.category, err)
+		}
+	}
+}
+
+// sealExpiredChunk seals the active chunk if it is older than maxChunkAge.
+// The next chunk is created, and announced to the replication, only when
+// new data arrives, or right away for the replicas of a category with acks.
+func (c *OnDisk) sealExpiredChunk(now time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.lastChunk == "" || !c.lastChunkExpired(now) {
+		return nil
+	}
+	log.Printf("sealing chunk %q of category %q after %s", c.lastChunk, c.category, now.Sub(c.lastChunkCreated).Round(time.Second))
+	if err := c.rollLastChunk(); err != nil {
+		return err
+	}
+	return c.openFollowedChunk(context.Background())
+}
+
+// lastChunkExpired reports whether the active chunk must be sealed because
+// of its age. Empty chunks are never sealed. It must be called with writeMu held.
+func (c *OnDisk) lastChunkExpired(now time.Time) bool {
+	return c.maxChunkAge > 0 && c.lastChunkSize > 0 && now.Sub(c.lastChunkCreated) >= c.maxChunkAge
+}
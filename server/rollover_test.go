@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+)
+
+type recordingHooks struct {
+	created []string
+	deleted []string
+}
+
+func (h *recordingHooks) BeforeCreatingChunk(ctx context.Context, category, filename string) error {
+	h.created = append(h.created, filename)
+	return nil
+}
+
+func (h *recordingHooks) AfterDeletingChunk(ctx context.Context, category, filename string) error {
+	h.deleted = append(h.deleted, filename)
+	return nil
+}
+
+func TestSealExpiredChunk(t *testing.T) {
+	dir := getTempDir(t)
+	hooks := &recordingHooks{}
+	srv, err := NewOnDisk(dir, "numbers", "moscow", config.Category{MaxChunkAge: config.Duration(time.Hour)}, hooks)
+	if err != nil {
+		t.Fatalf("NewOnDisk failed: %v", err)
+	}
+	defer srv.Close()
+
+	// an empty category has nothing to seal
+	if err := srv.sealExpiredChunk(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("sealExpiredChunk() failed: %v", err)
+	}
+
+	if err := srv.Send(context.Background(), []byte("one\n")); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if err := srv.sealExpiredChunk(time.Now()); err != nil {
+		t.Fatalf("sealExpiredChunk() failed: %v", err)
+	}
+	if srv.isSealed("moscow-chunk0") {
+		t.Fatalf("the chunk must not be sealed before it expires")
+	}
+
+	if err := srv.sealExpiredChunk(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("sealExpiredChunk() failed: %v", err)
+	}
+	if !srv.isSealed("moscow-chunk0") {
+		t.Errorf("the expired chunk must be sealed")
+	}
+	if want := []string{"moscow-chunk0"}; !reflect.DeepEqual(hooks.created, want) {
+		t.Errorf("BeforeCreatingChunk() calls = %v, want %v until new data arrives", hooks.created, want)
+	}
+
+	if err := srv.Send(context.Background(), []byte("two\n")); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if want := []string{"moscow-chunk0", "moscow-chunk1"}; !reflect.DeepEqual(hooks.created, want) {
+		t.Errorf("BeforeCreatingChunk() calls = %v, want %v", hooks.created, want)
+	}
+
+	// the writes roll over an expired chunk even before the ticker does
+	srv.lastChunkCreated = time.Now().Add(-2 * time.Hour)
+	if err := srv.Send(context.Background(), []byte("three\n")); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	if !srv.isSealed("moscow-chunk1") || srv.lastChunk != "moscow-chunk2" {
+		t.Errorf("Send() into an expired chunk must seal it and write to moscow-chunk2, got %q", srv.lastChunk)
+	}
+
+	chunks, err := srv.ListChunks()
+	if err != nil {
+		t.Fatalf("ListChunks() failed: %v", err)
+	}
+	for _, ch := range chunks {
+		if ch.Complete == (ch.Name == "moscow-chunk2") {
+			t.Errorf("chunk %+v has the wrong completeness", ch)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/yyancy/go-queue/protocol"
+)
+
+// TimeRange returns the parts of the chunks that contain the messages
+// written between from and to, inclusive, ordered by the time of the
+// first message. The chunks that are known to have no such messages
+// are skipped.
+//
+// The ranges can include a few messages outside of the time range, the
+// framed messages must be filtered by their Time. The ranges of the
+// newline categories are only as precise as the index.
+func (c *OnDisk) TimeRange(from, to time.Time) ([]protocol.ChunkRange, error) {
+	chunks, err := c.ListChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	type chunkRange struct {
+		protocol.ChunkRange
+		first time.Time
+	}
+	var res []chunkRange
+	for _, ch := range chunks {
+		first, last, err := c.chunkTimes(ch)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("getting times of %q: %v", ch.Name, err)
+		}
+		if (!last.IsZero() && last.Before(from)) || (!first.IsZero() && first.After(to)) {
+			continue
+		}
+
+		off, err := c.TimeOffset(ch.Name, from)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		end, err := c.timeEnd(ch.Name, to)
+		if err != nil {
+			return nil, err
+		}
+		if end != 0 && end <= off {
+			continue
+		}
+		res = append(res, chunkRange{
+			ChunkRange: protocol.ChunkRange{Chunk: ch.Name, Off: off, End: end},
+			first:      first,
+		})
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].first.Before(res[j].first) })
+	ranges := make([]protocol.ChunkRange, 0, len(res))
+	for _, r := range res {
+		ranges = append(ranges, r.ChunkRange)
+	}
+	return ranges, nil
+}
+
+// chunkTimes returns the time of the first and the last message of the chunk,
+// zero when it is not known. They come from the metadata of the chunk if it
+// has any. Otherwise the time of the first message comes from the index or
+// from the first framed message and the time of the last message of the
+// complete chunk is its modification time.
+func (c *OnDisk) chunkTimes(ch protocol.Chunk) (first, last time.Time, err error) {
+	if ch.Complete {
+		last = ch.LastTime
+		if last.IsZero() {
+			if last, err = c.chunkModTime(ch.Name); err != nil {
+				return time.Time{}, time.Time{}, err
+			}
+		}
+	}
+	if !ch.FirstTime.IsZero() {
+		return ch.FirstTime, last, nil
+	}
+
+	entries, err := c.readIndex(ch.Name)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if len(entries) > 0 && entries[0].Offset == 0 {
+		return time.Unix(0, entries[0].Time), last, nil
+	}
+	if c.format != protocol.FormatFramed {
+		return time.Time{}, last, nil
+	}
+
+	h, size, err := c.chunkReader(ch.Name)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer h.Release()
+
+	rec, _, err := protocol.NewRecordReader(io.NewSectionReader(h, 0, size)).Next()
+	if err == io.EOF {
+		return time.Time{}, last, nil
+	} else if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	m, err := protocol.DecodeMessage(rec)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return m.Time, last, nil
+}
+
+// timeEnd returns the offset of the first indexed batch written after t,
+// zero if there is no such batch.
+func (c *OnDisk) timeEnd(chunk string, t time.Time) (uint64, error) {
+	entries, err := c.readIndex(chunk)
+	if err != nil {
+		return 0, fmt.Errorf("reading index of %q: %v", chunk, err)
+	}
+	for _, e := range entries {
+		if e.Time > t.UnixNano() {
+			return e.Offset, nil
+		}
+	}
+	return 0, nil
+}
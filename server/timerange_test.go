@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
+)
+
+func TestTimeRange(t *testing.T) {
+	dir := getTempDir(t)
+	// the replicated chunk written long before the time range
+	old := time.Now().Add(-time.Hour)
+	stamped := protocol.Message{Value: []byte("old"), Time: old}
+	testCreateMessagesChunk(t, dir, "london-chunk1", old, stamped)
+
+	srv := testNewOnDiskWithConfig(t, dir, config.Category{Format: protocol.FormatFramed})
+	send := func(values ...string) {
+		t.Helper()
+
+		var batch []byte
+		for _, v := range values {
+			batch = protocol.AppendMessage(batch, protocol.Message{Value: []byte(v)})
+		}
+		if err := srv.Send(context.Background(), batch); err != nil {
+			t.Fatalf("Send() failed: %v", err)
+		}
+		// every batch gets its own index entry
+		time.Sleep(indexIntervalTime)
+	}
+
+	send("a1", "a2")
+	from := time.Now()
+	send("b1", "b2")
+	to := time.Now()
+	send("c1")
+
+	ranges, err := srv.TimeRange(from, to)
+	if err != nil {
+		t.Fatalf("TimeRange() failed: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0].Chunk != srv.lastChunk || ranges[0].End == 0 {
+		t.Fatalf("TimeRange() = %+v, want the part of %q", ranges, srv.lastChunk)
+	}
+
+	r := ranges[0]
+	var b bytes.Buffer
+	if err := srv.Recv(r.Chunk, uint(r.Off), uint(r.End-r.Off), &b); err != nil {
+		t.Fatalf("Recv() failed: %v", err)
+	}
+	msgs, err := protocol.DecodeMessages(b.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeMessages() failed: %v", err)
+	}
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Value))
+	}
+	if want := []string{"b1", "b2"}; !equalStrings(got, want) {
+		t.Errorf("messages in the time range = %v, want %v", got, want)
+	}
+
+	ranges, err = srv.TimeRange(old.Add(-time.Minute), old.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("TimeRange() failed: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0].Chunk != "london-chunk1" || ranges[0].Off != 0 {
+		t.Errorf("TimeRange() = %+v, want the whole london-chunk1", ranges)
+	}
+}
@@ -1,22 +1,43 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/valyala/fasthttp"
+	"github.com/yyancy/go-queue/config"
+	"github.com/yyancy/go-queue/protocol"
 	"github.com/yyancy/go-queue/server"
 	"github.com/yyancy/go-queue/server/replication"
 )
 
 const defaultBufferSize = 512 * 1024
 
+// deleteConsumedInterval is how often the chunks that every consumer group
+// has read are deleted, including the copies of the chunks of other instances.
+const deleteConsumedInterval = 10 * time.Second
+
+// errGroupsRegistered means that /ack was ignored because the chunks
+// of the category are deleted by the consumer groups.
+var errGroupsRegistered = errors.New("the category has consumer groups, the chunks are deleted once every group commits them with /commit")
+
+// The defaults of /receive.
+const (
+	defaultReceiveMax        = 10
+	defaultVisibilityTimeout = 30 * time.Second
+)
+
 type Web struct {
 	instanceName string
 	dirname      string
@@ -55,7 +76,20 @@ func NewWeb(
 		storages:     make(map[string]*server.OnDisk)}
 }
 func (w *Web) errorHandler(err error, ctx *fasthttp.RequestCtx) {
-	if err != io.EOF {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, server.ErrNotInFlight) {
+		// e.g. the chunk was replaced by the compaction and deleted
+		ctx.SetStatusCode(http.StatusNotFound)
+		ctx.WriteString("not found:" + err.Error())
+	} else if errors.Is(err, server.ErrNotEnoughReplicas) {
+		ctx.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.WriteString("service unavailable:" + err.Error())
+	} else if errors.Is(err, server.ErrDelayedAcks) {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.WriteString("bad request:" + err.Error())
+	} else if errors.Is(err, replication.ErrLeased) || errors.Is(err, errGroupsRegistered) {
+		ctx.SetStatusCode(http.StatusConflict)
+		ctx.WriteString("conflict:" + err.Error())
+	} else if err != io.EOF {
 		ctx.SetStatusCode(http.StatusInternalServerError)
 		ctx.WriteString("internal server error:" + err.Error())
 		// log.Printf("internal server error:" + err.Error())
@@ -89,7 +123,8 @@ func (w *Web) readHandler(ctx *fasthttp.RequestCtx) {
 		w.errorHandler(err, ctx)
 		return
 	}
-	off, err := ctx.QueryArgs().GetUint("off")
+	chunk := ctx.QueryArgs().Peek("chunk")
+	off, err := w.readOffset(ctx, storage, string(chunk))
 	if err != nil {
 		w.errorHandler(err, ctx)
 		return
@@ -99,13 +134,72 @@ func (w *Web) readHandler(ctx *fasthttp.RequestCtx) {
 		w.errorHandler(err, ctx)
 		return
 	}
+	r, size, err := storage.RecvStream(string(chunk), off, uint64(maxSize))
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	ctx.Response.Header.Set(protocol.FormatHeader, storage.Format().String())
+	ctx.Response.Header.Set(protocol.OffsetHeader, strconv.FormatUint(off, 10))
+	if max := storage.MaxDeliveries(); max > 0 {
+		ctx.Response.Header.Set(protocol.MaxDeliveriesHeader, strconv.Itoa(max))
+	}
+	// fasthttp closes the stream once the response is sent
+	ctx.SetBodyStream(r, int(size))
+
+}
+
+// readCompressedHandler serves the raw bytes of a compressed chunk
+// so that replicas can copy it without recompressing.
+func (w *Web) readCompressedHandler(ctx *fasthttp.RequestCtx) {
+	storage, err := w.getStorageByCategory(string(ctx.QueryArgs().Peek("category")))
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
 	chunk := ctx.QueryArgs().Peek("chunk")
-	err = storage.Recv(string(chunk), uint(off), uint(maxSize), ctx)
+	off, err := ctx.QueryArgs().GetUint("off")
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	maxSize, err := ctx.QueryArgs().GetUint("maxSize")
 	if err != nil {
 		w.errorHandler(err, ctx)
 		return
 	}
+	err = storage.RecvCompressed(string(chunk), uint64(off), uint64(maxSize), ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+}
+
+// readOffset returns the offset to read from. Besides the `off` param
+// it is possible to start from the message number `msg` or from the
+// first message written at or after `time` (RFC 3339).
+func (w *Web) readOffset(ctx *fasthttp.RequestCtx, storage *server.OnDisk, chunk string) (uint64, error) {
+	args := ctx.QueryArgs()
+	switch {
+	case args.Has("msg"):
+		seq, err := strconv.ParseUint(string(args.Peek("msg")), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing `msg` param: %v", err)
+		}
+		return storage.MessageOffset(chunk, seq)
+	case args.Has("time"):
+		t, err := time.Parse(time.RFC3339Nano, string(args.Peek("time")))
+		if err != nil {
+			return 0, fmt.Errorf("parsing `time` param: %v", err)
+		}
+		return storage.TimeOffset(chunk, t)
+	}
 
+	off, err := args.GetUint("off")
+	if err != nil {
+		return 0, err
+	}
+	return uint64(off), nil
 }
 func (w *Web) writeHandler(ctx *fasthttp.RequestCtx) {
 	storage, err := w.getStorageByCategory(string(ctx.QueryArgs().Peek("category")))
@@ -113,16 +207,98 @@ func (w *Web) writeHandler(ctx *fasthttp.RequestCtx) {
 		w.errorHandler(err, ctx)
 		return
 	}
+	if format := ctx.Request.Header.Peek(protocol.FormatHeader); len(format) != 0 && string(format) != storage.Format().String() {
+		w.errorHandler(fmt.Errorf("category uses the %s format, got %s", storage.Format(), format), ctx)
+		return
+	}
 	b := ctx.PostBody()
 	// log.Printf("write(): recieved %q", string(b))
-	err = storage.Send(ctx, b)
+	at, err := deliverAt(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	acks := storage.Acks()
+	if v := ctx.Request.Header.Peek(protocol.AcksHeader); len(v) != 0 {
+		if acks, err = config.ParseAcks(string(v)); err != nil {
+			w.errorHandler(fmt.Errorf("parsing %s header: %v", protocol.AcksHeader, err), ctx)
+			return
+		}
+	}
+	if at.IsZero() {
+		err = storage.SendReplicated(ctx, b, acks)
+	} else {
+		// the delayed messages are replicated once they are due
+		err = storage.SendAt(ctx, b, at, acks)
+	}
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	ctx.WriteString("successful\n")
+}
+
+// deliverAt returns when the written messages must be delivered,
+// zero if at once.
+func deliverAt(ctx *fasthttp.RequestCtx) (time.Time, error) {
+	if v := ctx.Request.Header.Peek(protocol.DeliverAtHeader); len(v) != 0 {
+		at, err := time.Parse(time.RFC3339Nano, string(v))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing %s header: %v", protocol.DeliverAtHeader, err)
+		}
+		return at, nil
+	}
+	if v := ctx.Request.Header.Peek(protocol.DeliverAfterHeader); len(v) != 0 {
+		d, err := time.ParseDuration(string(v))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing %s header: %v", protocol.DeliverAfterHeader, err)
+		}
+		return time.Now().Add(d), nil
+	}
+	return time.Time{}, nil
+}
+
+// replicatedHandler records that the `instance` stores the first `off` bytes
+// of the chunk, the writes with acks wait for it.
+func (w *Web) replicatedHandler(ctx *fasthttp.RequestCtx) {
+	storage, chunk, off, err := w.messageParams(ctx)
 	if err != nil {
 		w.errorHandler(err, ctx)
 		return
 	}
+	instance := string(ctx.QueryArgs().Peek("instance"))
+	if instance == "" {
+		w.errorHandler(errors.New("not found `instance` param"), ctx)
+		return
+	}
+	storage.ConfirmReplicated(instance, chunk, off, time.Now())
 	ctx.WriteString("successful\n")
 }
 
+// listCategories returns the categories that have a directory in dirname.
+func listCategories(dirname string) ([]string, error) {
+	dis, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, di := range dis {
+		if di.IsDir() && isValidCategory(di.Name()) {
+			res = append(res, di.Name())
+		}
+	}
+	return res, nil
+}
+
+func (w *Web) listCategoriesHandler(ctx *fasthttp.RequestCtx) {
+	categories, err := listCategories(w.dirname)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	json.NewEncoder(ctx).Encode(categories)
+}
+
 func (w *Web) listChunksHandler(ctx *fasthttp.RequestCtx) {
 	storage, err := w.getStorageByCategory(string(ctx.QueryArgs().Peek("category")))
 	if err != nil {
@@ -139,13 +315,42 @@ func (w *Web) listChunksHandler(ctx *fasthttp.RequestCtx) {
 	json.NewEncoder(ctx).Encode(chunks)
 }
 
-func (w *Web) ackHandler(ctx *fasthttp.RequestCtx) {
+// timeRangeHandler returns the parts of the chunks that contain the messages
+// written between the `from` and `to` params (RFC 3339), see OnDisk.TimeRange.
+func (w *Web) timeRangeHandler(ctx *fasthttp.RequestCtx) {
 	storage, err := w.getStorageByCategory(string(ctx.QueryArgs().Peek("category")))
 	if err != nil {
 		w.errorHandler(err, ctx)
 		return
 	}
 
+	from, err := time.Parse(time.RFC3339Nano, string(ctx.QueryArgs().Peek("from")))
+	if err != nil {
+		w.errorHandler(fmt.Errorf("parsing `from` param: %v", err), ctx)
+		return
+	}
+	to, err := time.Parse(time.RFC3339Nano, string(ctx.QueryArgs().Peek("to")))
+	if err != nil {
+		w.errorHandler(fmt.Errorf("parsing `to` param: %v", err), ctx)
+		return
+	}
+
+	ranges, err := storage.TimeRange(from, to)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	json.NewEncoder(ctx).Encode(ranges)
+}
+
+func (w *Web) ackHandler(ctx *fasthttp.RequestCtx) {
+	category := string(ctx.QueryArgs().Peek("category"))
+	storage, err := w.getStorageByCategory(category)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+
 	chunk := ctx.QueryArgs().Peek("chunk")
 	if len(chunk) == 0 {
 		w.errorHandler(errors.New("not found `chunk` param"), ctx)
@@ -157,6 +362,18 @@ func (w *Web) ackHandler(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	// log.Printf("ack(): recieved chunk=`%s`", chunk)
+	if w.replClient != nil {
+		groups, err := w.replClient.CategoryOffsets(ctx, category)
+		if err != nil {
+			w.errorHandler(err, ctx)
+			return
+		}
+		if len(groups) > 0 {
+			// the chunk is deleted once every consumer group has read it
+			w.errorHandler(fmt.Errorf("ack %q: %w", chunk, errGroupsRegistered), ctx)
+			return
+		}
+	}
 	if err := storage.Ack(string(chunk), uint64(size)); err != nil {
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.WriteString(err.Error())
@@ -164,19 +381,396 @@ func (w *Web) ackHandler(ctx *fasthttp.RequestCtx) {
 		ctx.WriteString("successful\n")
 	}
 }
+
+// groupParams returns the storage, the category and the consumer group
+// of the /fetch and /commit requests.
+func (w *Web) groupParams(ctx *fasthttp.RequestCtx) (*server.OnDisk, string, string, error) {
+	if w.replClient == nil {
+		return nil, "", "", errors.New("consumer groups need the replication state")
+	}
+	category := string(ctx.QueryArgs().Peek("category"))
+	storage, err := w.getStorageByCategory(category)
+	if err != nil {
+		return nil, "", "", err
+	}
+	// the group is a part of the etcd key just like the category
+	group := string(ctx.QueryArgs().Peek("group"))
+	if !isValidCategory(group) {
+		return nil, "", "", errors.New("Invalid group: " + group)
+	}
+	return storage, category, group, nil
+}
+
+// fetchHandler registers the consumer group and returns the offsets
+// it has committed.
+func (w *Web) fetchHandler(ctx *fasthttp.RequestCtx) {
+	_, category, group, err := w.groupParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if err := w.replClient.RegisterGroup(ctx, category, group); err != nil {
+		w.errorHandler(fmt.Errorf("registering group %q: %v", group, err), ctx)
+		return
+	}
+	offsets, err := w.replClient.GroupOffsets(ctx, category, group)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	json.NewEncoder(ctx).Encode(offsets)
+}
+
+// commitHandler stores the offset of the consumer group in the chunk.
+// Once the group has read the chunk (`done` param) the chunks that every
+// group has read are deleted.
+func (w *Web) commitHandler(ctx *fasthttp.RequestCtx) {
+	storage, category, group, err := w.groupParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	chunk := string(ctx.QueryArgs().Peek("chunk"))
+	if !isValidCategory(chunk) {
+		w.errorHandler(errors.New("Invalid chunk: "+chunk), ctx)
+		return
+	}
+	off, err := ctx.QueryArgs().GetUint("off")
+	if err != nil {
+		w.errorHandler(fmt.Errorf("parsing `off` param: %v", err), ctx)
+		return
+	}
+	done := ctx.QueryArgs().GetBool("done")
+
+	// the consumer that lost the lease must not move the offset
+	// of the chunk that is read by another consumer now, and neither
+	// must a commit that does not say which consumer it comes from
+	consumer := string(ctx.QueryArgs().Peek("consumer"))
+	holder, err := w.replClient.ChunkLeaseHolder(ctx, category, group, chunk)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if holder != "" && holder != consumer {
+		w.errorHandler(fmt.Errorf("%w: %q is not held by %q", replication.ErrLeased, chunk, consumer), ctx)
+		return
+	}
+
+	// the group is registered again in case the commit comes
+	// from a consumer that did not fetch the offsets
+	if err := w.replClient.RegisterGroup(ctx, category, group); err != nil {
+		w.errorHandler(fmt.Errorf("registering group %q: %v", group, err), ctx)
+		return
+	}
+	if err := w.replClient.CommitOffset(ctx, category, group, chunk, protocol.Offset{Off: uint64(off), Done: done}); err != nil {
+		w.errorHandler(fmt.Errorf("committing offset: %v", err), ctx)
+		return
+	}
+
+	if done && consumer != "" {
+		if err := w.replClient.ReleaseChunk(ctx, category, group, chunk, consumer); err != nil {
+			w.errorHandler(err, ctx)
+			return
+		}
+	}
+	if done {
+		groups, err := w.replClient.CategoryOffsets(ctx, category)
+		if err != nil {
+			w.errorHandler(err, ctx)
+			return
+		}
+		// this also deletes the copies of the chunks that were
+		// committed through the other instances
+		if _, err := storage.DeleteConsumed(groups); err != nil {
+			w.errorHandler(err, ctx)
+			return
+		}
+	}
+	ctx.WriteString("successful\n")
+}
+
+// leaseParams returns the chunk and the consumer of the /lease
+// and /release requests besides the groupParams.
+func (w *Web) leaseParams(ctx *fasthttp.RequestCtx) (category, group, chunk, consumer string, err error) {
+	_, category, group, err = w.groupParams(ctx)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	chunk = string(ctx.QueryArgs().Peek("chunk"))
+	if !isValidCategory(chunk) {
+		return "", "", "", "", errors.New("Invalid chunk: " + chunk)
+	}
+	consumer = string(ctx.QueryArgs().Peek("consumer"))
+	if consumer == "" {
+		return "", "", "", "", errors.New("not found `consumer` param")
+	}
+	return category, group, chunk, consumer, nil
+}
+
+// leaseHandler leases the chunk to the consumer of the group or renews
+// the lease it holds, see replication.State.LeaseChunk.
+func (w *Web) leaseHandler(ctx *fasthttp.RequestCtx) {
+	category, group, chunk, consumer, err := w.leaseParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if err := w.replClient.LeaseChunk(ctx, category, group, chunk, consumer); err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	json.NewEncoder(ctx).Encode(protocol.Lease{
+		Chunk:    chunk,
+		Consumer: consumer,
+		TTL:      int64(replication.ChunkLeaseTTL / time.Second),
+	})
+}
+
+// releaseHandler releases the lease of the chunk held by the consumer.
+func (w *Web) releaseHandler(ctx *fasthttp.RequestCtx) {
+	category, group, chunk, consumer, err := w.leaseParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if err := w.replClient.ReleaseChunk(ctx, category, group, chunk, consumer); err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	ctx.WriteString("successful\n")
+}
+
+// durationParam parses the optional duration param, e.g. "30s".
+func durationParam(ctx *fasthttp.RequestCtx, name string, def time.Duration) (time.Duration, error) {
+	v := ctx.QueryArgs().Peek(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(string(v))
+	if err != nil {
+		return 0, fmt.Errorf("parsing `%s` param: %v", name, err)
+	}
+	return d, nil
+}
+
+// receiveHandler delivers at most `max` messages of the messages category
+// that are invisible for `visibility` afterwards, see OnDisk.Receive.
+func (w *Web) receiveHandler(ctx *fasthttp.RequestCtx) {
+	storage, err := w.getStorageByCategory(string(ctx.QueryArgs().Peek("category")))
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	max := defaultReceiveMax
+	if ctx.QueryArgs().Has("max") {
+		if max, err = ctx.QueryArgs().GetUint("max"); err != nil {
+			w.errorHandler(fmt.Errorf("parsing `max` param: %v", err), ctx)
+			return
+		}
+	}
+	visibility, err := durationParam(ctx, "visibility", defaultVisibilityTimeout)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+
+	if err := w.moveDeadLetters(ctx, storage); err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	msgs, err := storage.Receive(max, visibility, time.Now())
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if msgs == nil {
+		msgs = []protocol.ReceivedMessage{}
+	}
+	json.NewEncoder(ctx).Encode(msgs)
+}
+
+// messageParams returns the storage and the `chunk` and `off` params
+// of /ackMessage and /nackMessage.
+func (w *Web) messageParams(ctx *fasthttp.RequestCtx) (*server.OnDisk, string, uint64, error) {
+	storage, err := w.getStorageByCategory(string(ctx.QueryArgs().Peek("category")))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	chunk := ctx.QueryArgs().Peek("chunk")
+	if len(chunk) == 0 {
+		return nil, "", 0, errors.New("not found `chunk` param")
+	}
+	off, err := ctx.QueryArgs().GetUint("off")
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("parsing `off` param: %v", err)
+	}
+	return storage, string(chunk), uint64(off), nil
+}
+
+func (w *Web) ackMessageHandler(ctx *fasthttp.RequestCtx) {
+	storage, chunk, off, err := w.messageParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if err := storage.AckMessage(chunk, off); err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	ctx.WriteString("successful\n")
+}
+
+// nackMessageHandler makes the message visible again after `delay`, at once by default.
+func (w *Web) nackMessageHandler(ctx *fasthttp.RequestCtx) {
+	storage, chunk, off, err := w.messageParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	delay, err := durationParam(ctx, "delay", 0)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	lastErr := string(ctx.QueryArgs().Peek("error"))
+	if err := storage.NackMessage(chunk, off, delay, lastErr, time.Now()); err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	if err := w.moveDeadLetters(ctx, storage); err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	ctx.WriteString("successful\n")
+}
+
+// deadLetterStorage returns the dead-letter category of the storage,
+// nil if there is none.
+func (w *Web) deadLetterStorage(storage *server.OnDisk) (*server.OnDisk, error) {
+	if storage.DeadLetter() == "" {
+		return nil, nil
+	}
+	dl, err := w.getStorageByCategory(storage.DeadLetter())
+	if err != nil {
+		return nil, fmt.Errorf("dead-letter category: %v", err)
+	}
+	return dl, nil
+}
+
+// moveDeadLetters moves the messages that failed too many times
+// to the dead-letter category, see OnDisk.MoveDeadLetters.
+func (w *Web) moveDeadLetters(ctx *fasthttp.RequestCtx, storage *server.OnDisk) error {
+	dl, err := w.deadLetterStorage(storage)
+	if err != nil || dl == nil {
+		return err
+	}
+	_, err = storage.MoveDeadLetters(ctx, dl, time.Now())
+	return err
+}
+
+// failMessageHandler records that the consumer group `group` failed to
+// process the message at `off` that /read returned, `error` is the reason.
+// The message is moved to the dead-letter category once it failed
+// max_deliveries times.
+func (w *Web) failMessageHandler(ctx *fasthttp.RequestCtx) {
+	storage, chunk, off, err := w.messageParams(ctx)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	group := string(ctx.QueryArgs().Peek("group"))
+	dl, err := w.deadLetterStorage(storage)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+
+	lastErr := string(ctx.QueryArgs().Peek("error"))
+	attempts, moved, err := storage.FailMessage(ctx, dl, group, chunk, off, lastErr)
+	if err != nil {
+		w.errorHandler(err, ctx)
+		return
+	}
+	json.NewEncoder(ctx).Encode(protocol.FailedMessage{Attempts: attempts, Moved: moved})
+}
+
 func (w *Web) httpHander(ctx *fasthttp.RequestCtx) {
 	switch string(ctx.Path()) {
 	case "/read":
 		w.readHandler(ctx)
+	case "/readCompressed":
+		w.readCompressedHandler(ctx)
 	case "/write":
 		w.writeHandler(ctx)
 	case "/ack":
 		w.ackHandler(ctx)
+	case "/replicated":
+		w.replicatedHandler(ctx)
+	case "/fetch":
+		w.fetchHandler(ctx)
+	case "/commit":
+		w.commitHandler(ctx)
+	case "/lease":
+		w.leaseHandler(ctx)
+	case "/release":
+		w.releaseHandler(ctx)
+	case "/receive":
+		w.receiveHandler(ctx)
+	case "/ackMessage":
+		w.ackMessageHandler(ctx)
+	case "/nackMessage":
+		w.nackMessageHandler(ctx)
+	case "/failMessage":
+		w.failMessageHandler(ctx)
+	case "/listCategories":
+		w.listCategoriesHandler(ctx)
 	case "/listChunks":
 		w.listChunksHandler(ctx)
+	case "/timeRange":
+		w.timeRangeHandler(ctx)
+	}
+}
+
+// deleteConsumedLoop deletes the chunks that every consumer group has read
+// in all categories, /commit only does it on the instance it was sent to.
+func (w *Web) deleteConsumedLoop() {
+	for range time.Tick(deleteConsumedInterval) {
+		if err := w.deleteConsumed(); err != nil {
+			log.Printf("deleting consumed chunks: %v", err)
+		}
+	}
+}
+
+func (w *Web) deleteConsumed() error {
+	categories, err := listCategories(w.dirname)
+	if err != nil {
+		return err
+	}
+	for _, category := range categories {
+		ctx, cancel := context.WithTimeout(context.Background(), deleteConsumedInterval)
+		groups, err := w.replClient.CategoryOffsets(ctx, category)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("getting offsets of %q: %w", category, err)
+		}
+		if len(groups) == 0 {
+			continue
+		}
+		storage, err := w.getStorageByCategory(category)
+		if err != nil {
+			return err
+		}
+		if _, err := storage.DeleteConsumed(groups); err != nil {
+			return fmt.Errorf("category %q: %w", category, err)
+		}
 	}
+	return nil
 }
+
 func (w *Web) Serve() error {
+	if w.replClient != nil {
+		go w.deleteConsumedLoop()
+	}
 
 	log.Printf("The server is running at %s port", w.listenAddr)
 	err := fasthttp.ListenAndServe(w.listenAddr, w.httpHander)
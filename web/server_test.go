@@ -1,6 +1,11 @@
 package web
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
 
 func TestIsValidCategory(t *testing.T) {
 	testCases := []struct {
@@ -24,3 +29,23 @@ func TestIsValidCategory(t *testing.T) {
 		}
 	}
 }
+
+func TestListCategories(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"events", "numbers", ".tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0777); err != nil {
+			t.Fatalf("Mkdir(%q) failed: %v", name, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "write_test"), nil, 0666); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	got, err := listCategories(dir)
+	if err != nil {
+		t.Fatalf("listCategories() failed: %v", err)
+	}
+	if want := []string{"events", "numbers"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listCategories() = %v, want %v", got, want)
+	}
+}